@@ -0,0 +1,37 @@
+// migrate-messages moves the legacy channel_<id> and thread_<id> collections
+// into the unified messages collection. It can run against a live database,
+// and engines stop looking for legacy collections once a run verified them all.
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/db/mongo"
+)
+
+func main() {
+	mongoUri := flag.String("mongo-uri", mongo.DefaultMongoUri, "mongo connection string")
+	batchSize := flag.Int64("batch-size", 500, "messages copied per batch")
+	dropSources := flag.Bool("drop", false, "drop each legacy collection once its messages are verified and none collide on message_id")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	err := mongo.Connect(ctx, *mongoUri)
+	if err != nil {
+		logrus.Fatalf("error connecting: %v", err)
+	}
+
+	err = mongo.EnsureIndexes(ctx)
+	if err != nil {
+		logrus.Fatalf("error ensuring indexes: %v", err)
+	}
+
+	err = mongo.MigrateLegacyMessageCollections(ctx, *batchSize, *dropSources)
+	if err != nil {
+		logrus.Fatalf("error migrating: %v", err)
+	}
+
+	logrus.Info("migration complete")
+}
@@ -0,0 +1,40 @@
+// verify-indexes diffs the indexes declared by the engine against the live
+// database and exits non-zero when they differ.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/db/mongo"
+	"os"
+	"time"
+)
+
+func main() {
+	mongoUri := flag.String("mongo-uri", mongo.DefaultMongoUri, "mongo connection string")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := mongo.Connect(ctx, *mongoUri)
+	if err != nil {
+		logrus.Fatalf("error connecting: %v", err)
+	}
+
+	diffs, err := mongo.VerifyIndexes(ctx)
+	if err != nil {
+		logrus.Fatalf("error verifying indexes: %v", err)
+	}
+
+	for _, diff := range diffs {
+		fmt.Println(diff)
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Printf("all %d declared indexes match\n", len(mongo.DeclaredIndexes))
+}
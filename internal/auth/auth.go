@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/util"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roles tokens can carry
+const (
+	RoleService = "service" // other services of the platform, acting for the system
+	RoleAdmin   = "admin"
+)
+
+// AccessTokenParam carries the JWT of WebSocket handshakes, which browsers
+// cannot add headers to.
+const AccessTokenParam = "access_token"
+
+var (
+	ErrBadToken     = errors.New("token is invalid or expired")
+	ErrTokenMissing = errors.New("authentication is required")
+)
+
+// Identity is who a request was authenticated as, from the claims of its
+// token.
+type Identity struct {
+	AccountId string   `json:"sub"`
+	Roles     []string `json:"roles,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"` // unix seconds
+}
+
+func (i Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// FromContext returns the identity the middleware authenticated the request
+// as.
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// SignToken issues an HS256 JWT for identity. The services calling the
+// engine are given tokens signed with the same key.
+func SignToken(identity Identity, secret []byte) (string, error) {
+	claims, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encodeSegment([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encodeSegment(claims)
+	return signed + "." + encodeSegment(mac(secret, signed)), nil
+}
+
+// VerifyToken checks an HS256 JWT and returns the identity it claims.
+func VerifyToken(token string, secret []byte, now time.Time) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(secret) == 0 {
+		return Identity{}, ErrBadToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Identity{}, ErrBadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac(secret, parts[0]+"."+parts[1])) {
+		return Identity{}, ErrBadToken
+	}
+
+	var identity Identity
+	if err := decodeSegment(parts[1], &identity); err != nil || identity.AccountId == "" {
+		return Identity{}, ErrBadToken
+	}
+	if identity.ExpiresAt != 0 && now.Unix() >= identity.ExpiresAt {
+		return Identity{}, ErrBadToken
+	}
+	return identity, nil
+}
+
+// Middleware authenticates requests by the JWT in their Authorization header,
+// or in the JWT cookie for browsers. Cookie-authenticated requests that change
+// state must also echo the CSRF cookie in the CSRF header.
+func Middleware(next http.Handler, secretKey interface{}, authConfig config.AuthConfig) http.Handler {
+	var secret []byte
+	switch key := secretKey.(type) {
+	case string:
+		secret = []byte(key)
+	case []byte:
+		secret = key
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, fromCookie := bearerToken(r), false
+		if token == "" && authConfig.JwtCookieName != "" {
+			if cookie, err := r.Cookie(authConfig.JwtCookieName); err == nil {
+				token, fromCookie = cookie.Value, true
+			}
+		}
+		if token == "" {
+			util.WriteJSONError(w, util.NewAPIError(http.StatusUnauthorized, util.CodeUnauthorized, "authentication is required"))
+			return
+		}
+
+		identity, err := VerifyToken(token, secret, time.Now())
+		if err != nil {
+			util.WriteJSONError(w, util.NewAPIError(http.StatusUnauthorized, util.CodeUnauthorized, err.Error()))
+			return
+		}
+
+		if fromCookie && !safeMethod(r.Method) && !validCsrf(r, authConfig) {
+			util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "csrf token is missing or does not match"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
+
+// AuthenticateHandshake authenticates a WebSocket handshake by the JWT in its
+// Authorization header or AccessTokenParam. Cookies are not accepted: sockets
+// may be opened from any origin, and browsers send cookies along.
+func AuthenticateHandshake(r *http.Request, secret []byte, now time.Time) (Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get(AccessTokenParam)
+	}
+	if token == "" {
+		return Identity{}, ErrTokenMissing
+	}
+	return VerifyToken(token, secret, now)
+}
+
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func validCsrf(r *http.Request, authConfig config.AuthConfig) bool {
+	if authConfig.CsrfCookieName == "" || authConfig.CsrfHeaderName == "" {
+		return false
+	}
+	cookie, err := r.Cookie(authConfig.CsrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(r.Header.Get(authConfig.CsrfHeaderName)))
+}
+
+func mac(secret []byte, signed string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
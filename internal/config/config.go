@@ -1,7 +1,24 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"os"
+)
+
+// the config file is JSON, read from the path in FileEnv
+const (
+	FileEnv     = "MESSAGING_ENGINE_CONFIG"
+	DefaultFile = "config.json"
+)
+
+// secrets can be given in the environment rather than the file, and win over it
+const (
+	AuthSecretKeyEnv = "MESSAGING_ENGINE_AUTH_SECRET_KEY"
+	MongoUriEnv      = "MESSAGING_ENGINE_MONGO_URI"
+	SigningKeyEnv    = "MESSAGING_ENGINE_ATTACHMENTS_SIGNING_KEY"
 )
 
 var Config MessagingEngineConfig
@@ -15,11 +32,137 @@ type AuthConfig struct {
 	CsrfHeaderName          string `json:"csrf_header_name"`
 }
 
+type MongoConfig struct {
+	Uri string `json:"uri"`
+}
+
+type DeletedMessagesConfig struct {
+	RestoreWindowMinutes int `json:"restore_window_minutes"` // how long moderators can restore a deleted message
+	PurgeAfterHours      int `json:"purge_after_hours"`      // grace period before a deleted message is hard-deleted
+}
+
+type S3Config struct {
+	Endpoint        string `json:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or a local stand-in
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+type AttachmentsConfig struct {
+	Backend               string   `json:"backend"`   // local or s3
+	LocalDir              string   `json:"local_dir"` // where the local backend keeps blobs
+	S3                    S3Config `json:"s3"`
+	MaxBytes              int64    `json:"max_bytes"`                // upper bound of a single attachment
+	SigningKey            string   `json:"signing_key"`              // signs download urls, random per process when empty and nodes is at most 1
+	DownloadUrlTTLMinutes int      `json:"download_url_ttl_minutes"` // how long a signed download url stays valid
+}
+
+type PushConfig struct {
+	WebhookURL    string `json:"webhook_url"` // receives the notifications of platforms without a provider of their own
+	Workers       int    `json:"workers"`
+	MaxAttempts   int    `json:"max_attempts"`   // sends per device before a notification is given up
+	BackoffMillis int    `json:"backoff_millis"` // before the first retry, doubled for every next one
+}
+
+type WebhooksConfig struct {
+	Workers        int `json:"workers"`
+	MaxAttempts    int `json:"max_attempts"`    // deliveries failing this many times wait for a replay
+	BackoffSeconds int `json:"backoff_seconds"` // before the first retry, doubled for every next one
+}
+
+type OutboxConfig struct {
+	Workers       int   `json:"workers"`
+	BusSizeMB     int64 `json:"bus_size_mb"`    // capped size of the inter-node bus collection
+	BackoffMillis int   `json:"backoff_millis"` // before republishing a failed event, doubled for every next try
+}
+
+type ChangeStreamsConfig struct {
+	Enabled bool `json:"enabled"` // fan out writes made to the messages collection by other services
+}
+
+type RateLimitConfig struct {
+	PerSecond float64 `json:"per_second"` // messages a connected client may send per second, sustained
+	Burst     int     `json:"burst"`
+}
+
 type MessagingEngineConfig struct {
-	Host           string     `json:"host"`
-	Port           int        `json:"port"`
-	AllowedOrigins string     `json:"allowed_origins"` // comma seperated origins
-	Auth           AuthConfig `json:"auth"`
+	Host                    string                `json:"host"`
+	Port                    int                   `json:"port"`
+	AllowedOrigins          string                `json:"allowed_origins"` // comma seperated origins
+	Nodes                   int                   `json:"nodes"`           // engine processes behind the same address
+	Auth                    AuthConfig            `json:"auth"`
+	Mongo                   MongoConfig           `json:"mongo"`
+	MaxPageSize             int64                 `json:"max_page_size"` // upper bound of messages per history page
+	DeletedMessages         DeletedMessagesConfig `json:"deleted_messages"`
+	DedupeWindowMinutes     int                   `json:"dedupe_window_minutes"`     // how long a retried submission is recognised
+	ReactionSummaryReactors int                   `json:"reaction_summary_reactors"` // reactors listed per emoji in reaction summaries
+	Attachments             AttachmentsConfig     `json:"attachments"`
+	MaxContentLength        int                   `json:"max_content_length"` // upper bound of characters in a message
+	Push                    PushConfig            `json:"push"`
+	Webhooks                WebhooksConfig        `json:"webhooks"`
+	Outbox                  OutboxConfig          `json:"outbox"`
+	ChangeStreams           ChangeStreamsConfig   `json:"change_streams"`
+	MessageRateLimit        RateLimitConfig       `json:"message_rate_limit"`
+}
+
+// Load reads the config file named by FileEnv into Config, then the secrets
+// set in the environment. Without FileEnv a missing DefaultFile is not an
+// error, every setting keeps its default.
+func Load() error {
+	path, named := os.LookupEnv(FileEnv)
+	if !named {
+		path = DefaultFile
+	}
+
+	loaded, err := read(path)
+	if errors.Is(err, os.ErrNotExist) && !named {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	overrideFromEnv(&loaded)
+	Config = loaded
+	return nil
+}
+
+// Validate reports the settings the engine cannot run without.
+func (c MessagingEngineConfig) Validate() error {
+	if c.Auth.AuthMiddlewareSecretKey == "" {
+		return fmt.Errorf("auth.auth_middleware_secret_key is required, or %s, to verify tokens", AuthSecretKeyEnv)
+	}
+	if c.Nodes > 1 && c.Attachments.SigningKey == "" {
+		return fmt.Errorf("attachments.signing_key is required, or %s, when nodes is more than 1, for urls signed by one node to download from another", SigningKeyEnv)
+	}
+	return nil
+}
+
+func read(path string) (MessagingEngineConfig, error) {
+	var loaded MessagingEngineConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return loaded, err
+	}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return loaded, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return loaded, nil
+}
+
+func overrideFromEnv(c *MessagingEngineConfig) {
+	for env, setting := range map[string]*string{
+		AuthSecretKeyEnv: &c.Auth.AuthMiddlewareSecretKey,
+		MongoUriEnv:      &c.Mongo.Uri,
+		SigningKeyEnv:    &c.Attachments.SigningKey,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*setting = value
+		}
+	}
 }
 
 func init() {
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.json")
+	err := os.WriteFile(path, []byte(`{
+		"port": 8080,
+		"auth": {"auth_middleware_secret_key": "from the file"},
+		"mongo": {"uri": "mongodb://from-the-file"},
+		"change_streams": {"enabled": true},
+		"outbox": {"workers": 3}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileEnv, path)
+	t.Setenv(MongoUriEnv, "mongodb://from-the-environment")
+
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.Port != 8080 || !Config.ChangeStreams.Enabled || Config.Outbox.Workers != 3 {
+		t.Errorf("loaded %+v, want the settings of the file", Config)
+	}
+	if Config.Auth.AuthMiddlewareSecretKey != "from the file" {
+		t.Errorf("the secret key is %q, want the one of the file", Config.Auth.AuthMiddlewareSecretKey)
+	}
+	if Config.Mongo.Uri != "mongodb://from-the-environment" {
+		t.Errorf("the mongo uri is %q, want the one of the environment", Config.Mongo.Uri)
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := Load(); err != nil {
+		t.Errorf("a missing default file gave %v", err)
+	}
+
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "missing.json"))
+	if err := Load(); err == nil {
+		t.Error("a missing file named in the environment was accepted")
+	}
+}
+
+func TestLoadRejectsMalformedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.json")
+	if err := os.WriteFile(path, []byte(`{"port": "8080"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileEnv, path)
+
+	if err := Load(); err == nil {
+		t.Error("a malformed file was accepted")
+	}
+}
+
+func TestValidateRequiresSecretKey(t *testing.T) {
+	if err := (MessagingEngineConfig{}).Validate(); err == nil {
+		t.Error("a config without a secret key is valid")
+	}
+
+	valid := MessagingEngineConfig{Auth: AuthConfig{AuthMiddlewareSecretKey: "secret"}}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateRequiresSigningKeyOnSeveralNodes(t *testing.T) {
+	c := MessagingEngineConfig{Nodes: 2, Auth: AuthConfig{AuthMiddlewareSecretKey: "secret"}}
+	if err := c.Validate(); err == nil {
+		t.Error("several nodes without a signing key are valid")
+	}
+
+	c.Attachments.SigningKey = "shared"
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
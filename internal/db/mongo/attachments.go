@@ -0,0 +1,184 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"strconv"
+)
+
+const attachmentsCollectionName = "attachments"
+
+var (
+	ErrAttachmentNotFound     = errors.New("attachment not found")
+	ErrAttachmentNotUploading = errors.New("attachment not found or its upload is already complete")
+)
+
+func NewAttachment(ctx context.Context, attachment models.Attachment) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	attachmentsCollection := catacheDatabase.Collection(attachmentsCollectionName)
+
+	_, err := attachmentsCollection.InsertOne(ctx, attachment)
+	if err != nil {
+		return fmt.Errorf("failed to insert attachment: %v", err)
+	}
+	return nil
+}
+
+func FindAttachmentById(ctx context.Context, AttachmentId string) (models.Attachment, error) {
+	var attachment models.Attachment
+
+	attachmentId, err := parseId("attachment", AttachmentId)
+	if err != nil {
+		return attachment, err
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	attachmentsCollection := catacheDatabase.Collection(attachmentsCollectionName)
+
+	err = attachmentsCollection.FindOne(ctx, bson.M{"id": attachmentId}).Decode(&attachment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return attachment, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return attachment, fmt.Errorf("failed to find attachment %s: %v", AttachmentId, err)
+	}
+
+	return attachment, nil
+}
+
+func FindAttachmentsByIds(ctx context.Context, attachmentIds []uuid.UUID) ([]models.Attachment, error) {
+	if len(attachmentIds) == 0 {
+		return nil, nil
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	attachmentsCollection := catacheDatabase.Collection(attachmentsCollectionName)
+
+	cursor, err := attachmentsCollection.Find(ctx, bson.M{"id": bson.M{"$in": attachmentIds}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find attachments: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return nil, fmt.Errorf("failed to decode attachments: %v", err)
+	}
+
+	return attachments, nil
+}
+
+// RecordAttachmentPart notes a received part of a resumable upload. Sending a
+// part again replaces it.
+func RecordAttachmentPart(ctx context.Context, AttachmentId string, partNumber int, size int64) (models.Attachment, error) {
+	return updateUploadingAttachment(ctx, AttachmentId, bson.M{
+		"$set": bson.M{"parts." + strconv.Itoa(partNumber): size},
+	})
+}
+
+// CompleteAttachment marks a resumable upload ready once its parts have been
+// assembled into the final blob.
+func CompleteAttachment(ctx context.Context, AttachmentId, contentType, sha256 string) (models.Attachment, error) {
+	return updateUploadingAttachment(ctx, AttachmentId, bson.M{
+		"$set": bson.M{
+			"status":       models.AttachmentReady,
+			"content_type": contentType,
+			"sha256":       sha256,
+		},
+		"$unset": bson.M{"parts": ""},
+	})
+}
+
+func updateUploadingAttachment(ctx context.Context, AttachmentId string, update bson.M) (models.Attachment, error) {
+	var attachment models.Attachment
+
+	attachmentId, err := parseId("attachment", AttachmentId)
+	if err != nil {
+		return attachment, err
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	attachmentsCollection := catacheDatabase.Collection(attachmentsCollectionName)
+
+	filter := bson.M{"id": attachmentId, "status": models.AttachmentUploading}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = attachmentsCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&attachment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return attachment, ErrAttachmentNotUploading
+	}
+	if err != nil {
+		return attachment, fmt.Errorf("failed to update attachment %s: %v", AttachmentId, err)
+	}
+
+	return attachment, nil
+}
+
+// FinishAttachmentProcessing stores what processing an image found and wrote:
+// its dimensions, thumbnails and, with metadata stripped, its new size and
+// checksum.
+func FinishAttachmentProcessing(ctx context.Context, attachment models.Attachment) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	attachmentsCollection := catacheDatabase.Collection(attachmentsCollectionName)
+
+	update := bson.M{"$set": bson.M{
+		"size":         attachment.Size,
+		"sha256":       attachment.Sha256,
+		"width":        attachment.Width,
+		"height":       attachment.Height,
+		"thumbnails":   attachment.Thumbnails,
+		"processed_at": attachment.ProcessedAt,
+	}}
+	_, err := attachmentsCollection.UpdateOne(ctx, bson.M{"id": attachment.Id}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update attachment %s: %v", attachment.Id, err)
+	}
+	return nil
+}
+
+// FindAttachmentPostings returns the channels and threads of the live messages
+// the attachment is posted in.
+func FindAttachmentPostings(ctx context.Context, attachmentId uuid.UUID) ([]uuid.UUID, []uuid.UUID, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	filter := bson.M{"files.attachmentid": attachmentId, "deleted": bson.M{"$exists": false}}
+	opts := options.Find().SetProjection(bson.M{"channel_id": 1, "thread_id": 1})
+	cursor, err := messagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find messages with attachment %s: %v", attachmentId, err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var postings []struct {
+		ChannelId uuid.UUID `bson:"channel_id"`
+		ThreadId  uuid.UUID `bson:"thread_id"`
+	}
+	if err := cursor.All(ctx, &postings); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode messages with attachment %s: %v", attachmentId, err)
+	}
+
+	var channelIds, threadIds []uuid.UUID
+	for _, posting := range postings {
+		if posting.ThreadId != uuid.Nil {
+			threadIds = append(threadIds, posting.ThreadId)
+		} else {
+			channelIds = append(channelIds, posting.ChannelId)
+		}
+	}
+	return channelIds, threadIds, nil
+}
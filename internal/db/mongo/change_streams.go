@@ -0,0 +1,236 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// resumeTokensCollection keeps, per change stream, the resume token of the
+// last change handled.
+const resumeTokensCollection = "change_stream_tokens"
+
+// MessageChange is an insert, update, replace or delete in the messages
+// collection.
+type MessageChange struct {
+	Token         bson.Raw
+	OperationType string
+	Document      bson.Raw // the message after the change, nil for deletes
+	Before        bson.Raw // the message before the change, only when the collection records pre-images
+	ChangedFields []string // top-level fields an update set or removed
+	ByEngine      bool     // made by the engine, which publishes its own writes through the outbox
+}
+
+type changeEvent struct {
+	OperationType     string   `bson:"operationType"`
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	Before            bson.Raw `bson:"fullDocumentBeforeChange"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// EnableMessagePreImages makes the messages collection record pre-images, so
+// that changes carry the message they replaced. It needs MongoDB 6.0.
+func EnableMessagePreImages(ctx context.Context) error {
+	catacheDatabase := MongodbClient.Database("catache")
+
+	err := catacheDatabase.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: MessagesCollection},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to enable pre-images of %s: %v", MessagesCollection, err)
+	}
+	return nil
+}
+
+// WatchMessages calls fn with every change to the messages collection after
+// the one resumeToken belongs to, or from now on when it is nil, until fn or
+// the stream fails.
+func WatchMessages(ctx context.Context, resumeToken bson.Raw, fn func(change MessageChange) error) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(MessagesCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}}}}},
+	}
+	streamOptions := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if resumeToken != nil {
+		streamOptions.SetResumeAfter(resumeToken)
+	}
+
+	stream, err := collection.Watch(ctx, pipeline, streamOptions)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", MessagesCollection, err)
+	}
+	defer func() {
+		if err := stream.Close(context.Background()); err != nil {
+			logrus.Errorf("failed to close change stream: %v", err)
+		}
+	}()
+
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode change event: %v", err)
+		}
+
+		change := MessageChange{
+			Token:         stream.ResumeToken(),
+			OperationType: event.OperationType,
+			Document:      event.FullDocument,
+			Before:        event.Before,
+		}
+		if event.OperationType == "update" {
+			change.ChangedFields = changedFields(event.UpdateDescription.UpdatedFields, event.UpdateDescription.RemovedFields)
+		}
+		change.ByEngine = writtenByEngine(change)
+
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", MessagesCollection, err)
+	}
+	return errors.New("change stream closed")
+}
+
+// engineWriteField marks the writes the engine makes to messages. Every write
+// sets it to a new value, so the writes of other services, which leave it as
+// it is, never carry it among their changes.
+const engineWriteField = "engine_write"
+
+// markEngineInsert returns document with the engine write mark.
+func markEngineInsert(document interface{}) (bson.D, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var marked bson.D
+	if err := bson.Unmarshal(data, &marked); err != nil {
+		return nil, err
+	}
+	return append(marked, bson.E{Key: engineWriteField, Value: uuid.New()}), nil
+}
+
+// markEngineUpdate returns update with the engine write mark set as well.
+func markEngineUpdate(update bson.M) bson.M {
+	set := bson.M{engineWriteField: uuid.New()}
+	if fields, ok := update["$set"].(bson.M); ok {
+		for field, value := range fields {
+			set[field] = value
+		}
+	}
+
+	marked := bson.M{"$set": set}
+	for operator, fields := range update {
+		if operator != "$set" {
+			marked[operator] = fields
+		}
+	}
+	return marked
+}
+
+// writtenByEngine tells whether the engine made a change by the mark it set.
+// The engine never replaces messages, and only deletes purged tombstones.
+func writtenByEngine(change MessageChange) bool {
+	switch change.OperationType {
+	case "insert":
+		_, err := change.Document.LookupErr(engineWriteField)
+		return err == nil
+	case "update":
+		for _, field := range change.ChangedFields {
+			if field == engineWriteField {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changedFields lists the top-level fields of updated and removed dotted
+// paths, once each.
+func changedFields(updated bson.Raw, removed []string) []string {
+	paths := append([]string{}, removed...)
+	if elements, err := updated.Elements(); err == nil {
+		for _, element := range elements {
+			paths = append(paths, element.Key())
+		}
+	}
+
+	var fields []string
+	seen := map[string]bool{}
+	for _, path := range paths {
+		field, _, _ := strings.Cut(path, ".")
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// IsChangeStreamHistoryLost tells whether a stream cannot resume because the
+// oplog no longer holds its resume token.
+func IsChangeStreamHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(286)
+}
+
+// FindResumeToken returns the saved resume token of a stream, nil when there
+// is none.
+func FindResumeToken(ctx context.Context, stream string) (bson.Raw, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(resumeTokensCollection)
+
+	var saved struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := collection.FindOne(ctx, bson.M{"_id": stream}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find resume token of %s: %v", stream, err)
+	}
+	return saved.Token, nil
+}
+
+func SaveResumeToken(ctx context.Context, stream string, token bson.Raw) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(resumeTokensCollection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": stream},
+		bson.M{"$set": bson.M{"token": token, "date_updated": time.Now().UTC()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save resume token of %s: %v", stream, err)
+	}
+	return nil
+}
+
+func DeleteResumeToken(ctx context.Context, stream string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(resumeTokensCollection)
+
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": stream})
+	if err != nil {
+		return fmt.Errorf("failed to delete resume token of %s: %v", stream, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestEngineWritesAreMarked(t *testing.T) {
+	document, err := markEngineInsert(bson.M{"message_id": "m1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted, err := bson.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !writtenByEngine(MessageChange{OperationType: "insert", Document: inserted}) {
+		t.Error("an insert of the engine is not recognized")
+	}
+	foreign, _ := bson.Marshal(bson.M{"message_id": "m2"})
+	if writtenByEngine(MessageChange{OperationType: "insert", Document: foreign}) {
+		t.Error("an insert of another service is taken for the engine's")
+	}
+
+	update := markEngineUpdate(bson.M{"$set": bson.M{"content": "edited"}, "$unset": bson.M{"deleted": ""}})
+	set := update["$set"].(bson.M)
+	if set["content"] != "edited" || set[engineWriteField] == nil || update["$unset"] == nil {
+		t.Errorf("marked update is %v", update)
+	}
+
+	engineUpdate := MessageChange{OperationType: "update", ChangedFields: []string{"deleted", engineWriteField}}
+	if !writtenByEngine(engineUpdate) {
+		t.Error("an update of the engine is not recognized")
+	}
+	foreignUpdate := MessageChange{OperationType: "update", Document: inserted, ChangedFields: []string{"content"}}
+	if writtenByEngine(foreignUpdate) {
+		t.Error("an update of another service to a message of the engine is taken for the engine's")
+	}
+}
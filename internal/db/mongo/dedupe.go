@@ -0,0 +1,85 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"messaging-engine/internal/util"
+	"net/http"
+	"time"
+)
+
+// messageSubmissionsCollection remembers which idempotency keys were used, and
+// for which message, until they expire.
+const messageSubmissionsCollection = "message_submissions"
+
+type messageSubmission struct {
+	Id        string    `bson:"_id"` // author account id and idempotency key
+	MessageId uuid.UUID `bson:"message_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// insertOnce runs insert in a transaction together with claiming the author's
+// idempotency key. When the key was already claimed within its window, nothing
+// is inserted and the message stored by the first submission is decoded into
+// original instead. The claim is looked up before it is made, rather than
+// detected by its duplicate key, so that a repeated submission does not abort
+// a transaction the caller runs insertOnce in.
+func insertOnce(
+	ctx context.Context,
+	authorAccountId uuid.UUID,
+	idempotencyKey string,
+	messageId uuid.UUID,
+	window time.Duration,
+	insert func(sessCtx mongo.SessionContext) error,
+	original interface{},
+) (bool, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	submissionsCollection := catacheDatabase.Collection(messageSubmissionsCollection)
+
+	submission := messageSubmission{
+		Id:        authorAccountId.String() + "/" + idempotencyKey,
+		MessageId: messageId,
+		ExpiresAt: time.Now().UTC().Add(window),
+	}
+
+	var duplicate bool
+	err := withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		duplicate = false
+
+		var claimed messageSubmission
+		err := submissionsCollection.FindOne(sessCtx, bson.M{"_id": submission.Id}).Decode(&claimed)
+		switch {
+		case err == nil && claimed.ExpiresAt.After(time.Now()):
+			duplicate = true
+			messagesCollection := catacheDatabase.Collection(MessagesCollection)
+			err = messagesCollection.FindOne(sessCtx, bson.M{"message_id": claimed.MessageId}).Decode(original)
+			if err != nil {
+				return fmt.Errorf("failed to find originally submitted message: %v", err)
+			}
+			return nil
+		case err == nil:
+			// expired claims linger until the TTL monitor runs
+			_, err = submissionsCollection.DeleteOne(sessCtx, bson.M{"_id": claimed.Id})
+			if err != nil {
+				return fmt.Errorf("failed to remove expired submission: %v", err)
+			}
+		case !errors.Is(err, mongo.ErrNoDocuments):
+			return fmt.Errorf("failed to find submission: %v", err)
+		}
+
+		_, err = submissionsCollection.InsertOne(sessCtx, submission)
+		if err != nil {
+			return err
+		}
+		return insert(sessCtx)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// the same key submitted concurrently, or a clash on the message id
+		return false, util.NewAPIError(http.StatusConflict, util.CodeConflict, "message was submitted concurrently, retry it")
+	}
+	return duplicate, err
+}
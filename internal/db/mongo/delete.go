@@ -0,0 +1,247 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+var (
+	ErrMessageNotDeletable  = errors.New("message not found, already deleted or not authored by the deleter")
+	ErrMessageNotRestorable = errors.New("message not deleted or restore window elapsed")
+)
+
+// DeleteChannelMessage tombstones a message. Unless byModerator, only the
+// author's own messages match.
+func DeleteChannelMessage(
+	ctx context.Context,
+	ChannelId, MessageId string,
+	tombstone models.Tombstone,
+	byModerator bool,
+) error {
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return softDeleteMessage(ctx, filter, tombstone, byModerator)
+}
+
+// DeleteThreadMessage is DeleteChannelMessage for thread replies.
+func DeleteThreadMessage(
+	ctx context.Context,
+	threadId, MessageId string,
+	tombstone models.Tombstone,
+	byModerator bool,
+) error {
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return softDeleteMessage(ctx, filter, tombstone, byModerator)
+}
+
+func softDeleteMessage(ctx context.Context, filter bson.M, tombstone models.Tombstone, byModerator bool) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	filter["deleted"] = bson.M{"$exists": false}
+	if !byModerator {
+		filter["author_account_id"] = tombstone.DeletedBy
+	}
+
+	result, err := messagesCollection.UpdateOne(ctx, filter, markEngineUpdate(bson.M{"$set": bson.M{"deleted": tombstone}}))
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrMessageNotDeletable
+	}
+	return nil
+}
+
+// RestoreChannelMessage lifts the tombstone of a message deleted less than
+// window ago and returns the restored message.
+func RestoreChannelMessage(
+	ctx context.Context,
+	ChannelId, MessageId string,
+	window time.Duration,
+) (models.ChannelMessage, error) {
+	var restored models.ChannelMessage
+
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return restored, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return restored, err
+	}
+
+	err = restoreMessage(ctx, filter, window, &restored)
+	return restored, err
+}
+
+// RestoreThreadMessage is RestoreChannelMessage for thread replies.
+func RestoreThreadMessage(
+	ctx context.Context,
+	threadId, MessageId string,
+	window time.Duration,
+) (models.ThreadMessage, error) {
+	var restored models.ThreadMessage
+
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return restored, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return restored, err
+	}
+
+	err = restoreMessage(ctx, filter, window, &restored)
+	return restored, err
+}
+
+func restoreMessage(ctx context.Context, filter bson.M, window time.Duration, restored interface{}) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	filter["deleted.deleted_at"] = bson.M{"$gte": time.Now().UTC().Add(-window)}
+
+	err := messagesCollection.FindOneAndUpdate(
+		ctx,
+		filter,
+		markEngineUpdate(bson.M{"$unset": bson.M{"deleted": ""}}),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(restored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrMessageNotRestorable
+	}
+	return err
+}
+
+// PurgeDeletedMessages hard-deletes up to limit messages that were deleted
+// before cutoff, along with their edit history and mentions, and the thread
+// attached to any of them with its replies. It returns how many messages were
+// purged.
+func PurgeDeletedMessages(ctx context.Context, cutoff time.Time, limit int64) (int64, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetProjection(bson.M{"message_id": 1, "attached_thread_id": 1})
+	findOptions.SetLimit(limit)
+
+	cursor, err := messagesCollection.Find(ctx, bson.M{"deleted.deleted_at": bson.M{"$lt": cutoff}}, findOptions)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find purgeable messages: %v", err)
+	}
+	var purgeable []struct {
+		MessageId        interface{} `bson:"message_id"`
+		AttachedThreadId uuid.UUID   `bson:"attached_thread_id"`
+	}
+	if err := cursor.All(ctx, &purgeable); err != nil {
+		return 0, fmt.Errorf("failed to decode purgeable messages: %v", err)
+	}
+	if len(purgeable) == 0 {
+		return 0, nil
+	}
+
+	messageIds := make(bson.A, 0, len(purgeable))
+	threadIds, threadKeys := bson.A{}, bson.A{}
+	for _, p := range purgeable {
+		messageIds = append(messageIds, p.MessageId)
+		if p.AttachedThreadId != uuid.Nil {
+			threadIds = append(threadIds, p.AttachedThreadId)
+			threadKeys = append(threadKeys, p.AttachedThreadId.String())
+		}
+	}
+
+	var purged int64
+	err = withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// the replies of attached threads go with them
+		purgedIds := append(bson.A{}, messageIds...)
+		if len(threadIds) > 0 {
+			cursor, err := messagesCollection.Find(
+				sessCtx,
+				bson.M{"thread_id": bson.M{"$in": threadIds}},
+				options.Find().SetProjection(bson.M{"message_id": 1}),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to find replies of purged threads: %v", err)
+			}
+			var replies []struct {
+				MessageId interface{} `bson:"message_id"`
+			}
+			if err := cursor.All(sessCtx, &replies); err != nil {
+				return fmt.Errorf("failed to decode replies of purged threads: %v", err)
+			}
+			for _, reply := range replies {
+				purgedIds = append(purgedIds, reply.MessageId)
+			}
+		}
+
+		_, err := catacheDatabase.Collection(messageRevisionsCollection).DeleteMany(
+			sessCtx,
+			bson.M{"message_id": bson.M{"$in": purgedIds}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to purge revisions: %v", err)
+		}
+
+		// mentions keep an excerpt of the content
+		_, err = catacheDatabase.Collection(mentionsCollection).DeleteMany(
+			sessCtx,
+			bson.M{"message_id": bson.M{"$in": purgedIds}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to purge mentions: %v", err)
+		}
+
+		if len(threadIds) > 0 {
+			_, err = messagesCollection.DeleteMany(sessCtx, bson.M{"thread_id": bson.M{"$in": threadIds}})
+			if err != nil {
+				return fmt.Errorf("failed to purge thread replies: %v", err)
+			}
+			_, err = catacheDatabase.Collection("thread_unreads").DeleteMany(sessCtx, bson.M{"thread_id": bson.M{"$in": threadKeys}})
+			if err != nil {
+				return fmt.Errorf("failed to purge thread unreads: %v", err)
+			}
+			_, err = catacheDatabase.Collection("threads").DeleteMany(sessCtx, bson.M{"id": bson.M{"$in": threadKeys}})
+			if err != nil {
+				return fmt.Errorf("failed to purge threads: %v", err)
+			}
+		}
+
+		result, err := messagesCollection.DeleteMany(sessCtx, bson.M{
+			"message_id":         bson.M{"$in": messageIds},
+			"deleted.deleted_at": bson.M{"$lt": cutoff},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to purge messages: %v", err)
+		}
+		purged = result.DeletedCount
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,81 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const devicesCollection = "devices"
+
+var ErrDeviceNotFound = errors.New("device not found")
+
+// RegisterDevice records a push token for the account, taking it over from
+// whichever account registered it before.
+func RegisterDevice(ctx context.Context, device models.Device) (models.Device, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(devicesCollection)
+
+	device.DateRegistered = time.Now().UTC()
+
+	filter := bson.M{"token": device.Token}
+	_, err := collection.ReplaceOne(ctx, filter, device, options.Replace().SetUpsert(true))
+	if err != nil {
+		return device, fmt.Errorf("failed to register device: %v", err)
+	}
+	return device, nil
+}
+
+func FindDevicesByAccountId(ctx context.Context, accountId string) ([]models.Device, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(devicesCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{"account_id": accountId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find devices: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var devices []models.Device
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, fmt.Errorf("failed to decode devices: %v", err)
+	}
+
+	return devices, nil
+}
+
+// DeleteDevice unregisters a token of the account.
+func DeleteDevice(ctx context.Context, accountId, token string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(devicesCollection)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"account_id": accountId, "token": token})
+	if err != nil {
+		return fmt.Errorf("failed to delete device: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// DeleteDeviceByToken forgets a token a push provider reported as dead.
+func DeleteDeviceByToken(ctx context.Context, token string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(devicesCollection)
+
+	_, err := collection.DeleteOne(ctx, bson.M{"token": token})
+	if err != nil {
+		return fmt.Errorf("failed to delete device: %v", err)
+	}
+	return nil
+}
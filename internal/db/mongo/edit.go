@@ -0,0 +1,222 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const messageRevisionsCollection = "message_revisions"
+
+var (
+	ErrMessageNotEditable = errors.New("message not found, deleted or not authored by the editor")
+	ErrMessageNotFound    = errors.New("message not found or deleted")
+)
+
+// EditChannelMessage replaces the content and files of a message written by
+// EditorAccountId, keeping the previous version as a revision. It returns the
+// message before and after the edit, which are the same when nothing changed.
+func EditChannelMessage(
+	ctx context.Context,
+	ChannelId, MessageId, EditorAccountId string,
+	content models.Content,
+	files []models.File,
+) (models.ChannelMessage, models.ChannelMessage, error) {
+	var before, after models.ChannelMessage
+
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return before, after, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return before, after, err
+	}
+	filter["author_account_id"], err = parseId("editor account", EditorAccountId)
+	if err != nil {
+		return before, after, err
+	}
+	filter["deleted"] = bson.M{"$exists": false}
+
+	err = withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		catacheDatabase := MongodbClient.Database("catache")
+		messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+		err := messagesCollection.FindOne(sessCtx, filter).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrMessageNotEditable
+		}
+		if err != nil {
+			return err
+		}
+
+		after = before
+		if before.Content.Equal(content) && models.SameFiles(before.Files, files) {
+			return nil
+		}
+
+		editedAt := time.Now().UTC()
+		after.Content, after.Files, after.EditedAt = content, files, &editedAt
+
+		update := markEngineUpdate(bson.M{"$set": bson.M{"content": content, "files": files, "edited_at": editedAt}})
+		_, err = messagesCollection.UpdateOne(sessCtx, filter, update)
+		if err != nil {
+			return err
+		}
+
+		_, err = catacheDatabase.Collection(messageRevisionsCollection).InsertOne(sessCtx, models.ChannelMessageRevision{
+			ChannelId:    before.ChannelId,
+			MessageId:    before.MessageId,
+			Content:      before.Content,
+			Files:        before.Files,
+			DateWritten:  before.WrittenAt(),
+			DateReplaced: editedAt,
+		})
+		return err
+	})
+
+	return before, after, err
+}
+
+// EditThreadMessage is EditChannelMessage for thread replies.
+func EditThreadMessage(
+	ctx context.Context,
+	threadId, MessageId, EditorAccountId string,
+	content models.Content,
+	files []models.File,
+) (models.ThreadMessage, models.ThreadMessage, error) {
+	var before, after models.ThreadMessage
+
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return before, after, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return before, after, err
+	}
+	filter["author_account_id"], err = parseId("editor account", EditorAccountId)
+	if err != nil {
+		return before, after, err
+	}
+	filter["deleted"] = bson.M{"$exists": false}
+
+	err = withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		catacheDatabase := MongodbClient.Database("catache")
+		messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+		err := messagesCollection.FindOne(sessCtx, filter).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrMessageNotEditable
+		}
+		if err != nil {
+			return err
+		}
+
+		after = before
+		if before.Content.Equal(content) && models.SameFiles(before.Files, files) {
+			return nil
+		}
+
+		editedAt := time.Now().UTC()
+		after.Content, after.Files, after.EditedAt = content, files, &editedAt
+
+		update := markEngineUpdate(bson.M{"$set": bson.M{"content": content, "files": files, "edited_at": editedAt}})
+		_, err = messagesCollection.UpdateOne(sessCtx, filter, update)
+		if err != nil {
+			return err
+		}
+
+		_, err = catacheDatabase.Collection(messageRevisionsCollection).InsertOne(sessCtx, models.ThreadMessageRevision{
+			ThreadId:     before.ThreadId,
+			MessageId:    before.MessageId,
+			Content:      before.Content,
+			Files:        before.Files,
+			DateWritten:  before.WrittenAt(),
+			DateReplaced: editedAt,
+		})
+		return err
+	})
+
+	return before, after, err
+}
+
+func FindChannelMessageRevisions(
+	ctx context.Context,
+	ChannelId, MessageId string,
+) ([]models.ChannelMessageRevision, error) {
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []models.ChannelMessageRevision
+	err = findLiveMessageRevisions(ctx, filter, &revisions)
+	return revisions, err
+}
+
+func FindThreadMessageRevisions(
+	ctx context.Context,
+	threadId, MessageId string,
+) ([]models.ThreadMessageRevision, error) {
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []models.ThreadMessageRevision
+	err = findLiveMessageRevisions(ctx, filter, &revisions)
+	return revisions, err
+}
+
+// liveMessageFilter narrows a message filter to messages that are not deleted.
+func liveMessageFilter(filter bson.M) bson.M {
+	live := bson.M{"deleted": bson.M{"$exists": false}}
+	for key, value := range filter {
+		live[key] = value
+	}
+	return live
+}
+
+// findLiveMessageRevisions decodes the revisions of the message matching
+// filter, oldest first, into results. The earlier versions of a deleted
+// message are as hidden as the message itself.
+func findLiveMessageRevisions(ctx context.Context, filter bson.M, results interface{}) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	opts := options.FindOne().SetProjection(bson.M{"message_id": 1})
+	err := messagesCollection.FindOne(ctx, liveMessageFilter(filter), opts).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrMessageNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find message: %v", err)
+	}
+
+	revisionsCollection := catacheDatabase.Collection(messageRevisionsCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "date_replaced", Value: 1}})
+
+	cursor, err := revisionsCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return fmt.Errorf("failed to find revisions: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	if err := cursor.All(ctx, results); err != nil {
+		return fmt.Errorf("failed to decode revisions: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package mongo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+)
+
+func TestRevisionsAreReadOfLiveMessagesOnly(t *testing.T) {
+	filter, err := channelMessageFilter("0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11", "0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := liveMessageFilter(filter)
+	if !reflect.DeepEqual(live["deleted"], bson.M{"$exists": false}) {
+		t.Errorf("the message is looked up as %v, which matches deleted messages", live)
+	}
+	for key, value := range filter {
+		if !reflect.DeepEqual(live[key], value) {
+			t.Errorf("the message is looked up with %s %v, want %v", key, live[key], value)
+		}
+	}
+	if _, ok := filter["deleted"]; ok {
+		t.Error("the filter of the revisions was changed")
+	}
+}
@@ -0,0 +1,110 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+)
+
+const customEmojiCollection = "custom_emoji"
+
+var (
+	ErrEmojiTaken    = errors.New("short code or alias already in use")
+	ErrEmojiNotFound = errors.New("custom emoji not found or not created by the account")
+)
+
+// NewCustomEmoji registers an emoji. Its short code and aliases share one
+// namespace with those of every other custom emoji.
+func NewCustomEmoji(ctx context.Context, emoji models.CustomEmoji) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	emojiCollection := catacheDatabase.Collection(customEmojiCollection)
+
+	names := emoji.Names()
+	taken, err := emojiCollection.CountDocuments(ctx, bson.M{"$or": bson.A{
+		bson.M{"short_code": bson.M{"$in": names}},
+		bson.M{"aliases": bson.M{"$in": names}},
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to check custom emoji names: %v", err)
+	}
+	if taken > 0 {
+		return ErrEmojiTaken
+	}
+
+	_, err = emojiCollection.InsertOne(ctx, emoji)
+	if mongo.IsDuplicateKeyError(err) {
+		// lost a race for the same short code
+		return ErrEmojiTaken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert custom emoji: %v", err)
+	}
+
+	return nil
+}
+
+func FindCustomEmoji(ctx context.Context) ([]models.CustomEmoji, error) {
+	return findCustomEmoji(ctx, bson.M{})
+}
+
+// FindCustomEmojiByNames finds the emoji any of names is a short code or alias of.
+func FindCustomEmojiByNames(ctx context.Context, names []string) ([]models.CustomEmoji, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	return findCustomEmoji(ctx, bson.M{"$or": bson.A{
+		bson.M{"short_code": bson.M{"$in": names}},
+		bson.M{"aliases": bson.M{"$in": names}},
+	}})
+}
+
+func findCustomEmoji(ctx context.Context, filter bson.M) ([]models.CustomEmoji, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	emojiCollection := catacheDatabase.Collection(customEmojiCollection)
+
+	opts := options.Find().SetSort(bson.D{{Key: "short_code", Value: 1}})
+	cursor, err := emojiCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find custom emoji: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var emoji []models.CustomEmoji
+	if err := cursor.All(ctx, &emoji); err != nil {
+		return nil, fmt.Errorf("failed to decode custom emoji: %v", err)
+	}
+
+	return emoji, nil
+}
+
+// DeleteCustomEmoji removes an emoji created by accountId. Reactions already
+// using it are kept.
+func DeleteCustomEmoji(ctx context.Context, shortCode, accountId string) error {
+	creatorId, err := parseId("account", accountId)
+	if err != nil {
+		return err
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	emojiCollection := catacheDatabase.Collection(customEmojiCollection)
+
+	result, err := emojiCollection.DeleteOne(ctx, bson.M{"short_code": shortCode, "creator_account_id": creatorId})
+	if err != nil {
+		return fmt.Errorf("failed to delete custom emoji: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrEmojiNotFound
+	}
+
+	return nil
+}
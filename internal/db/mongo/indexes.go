@@ -0,0 +1,370 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec declares an index the engine's queries rely on.
+type IndexSpec struct {
+	Collection         string
+	Name               string
+	Keys               bson.D
+	Unique             bool
+	Partial            bson.M // partialFilterExpression, nil for a full index
+	ExpireAfterSeconds *int32 // makes a TTL index when set
+}
+
+// DeclaredIndexes are ensured at startup and checked by VerifyIndexes.
+var DeclaredIndexes = []IndexSpec{
+	// ---------- messages ----------
+	{
+		Collection: MessagesCollection,
+		Name:       "message_id_unique",
+		Keys:       bson.D{{Key: "message_id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		// channel history, sorted by (date_created, message_id)
+		Collection: MessagesCollection,
+		Name:       "channel_history",
+		Keys: bson.D{
+			{Key: "channel_id", Value: 1},
+			{Key: "date_created", Value: -1},
+			{Key: "message_id", Value: -1},
+		},
+		Partial: bson.M{"channel_id": bson.M{"$exists": true}},
+	},
+	{
+		// thread history, sorted by (date_created, message_id)
+		Collection: MessagesCollection,
+		Name:       "thread_history",
+		Keys: bson.D{
+			{Key: "thread_id", Value: 1},
+			{Key: "date_created", Value: -1},
+			{Key: "message_id", Value: -1},
+		},
+		Partial: bson.M{"thread_id": bson.M{"$exists": true}},
+	},
+
+	{
+		// tombstones awaiting purge
+		Collection: MessagesCollection,
+		Name:       "deleted_at",
+		Keys:       bson.D{{Key: "deleted.deleted_at", Value: 1}},
+		Partial:    bson.M{"deleted": bson.M{"$exists": true}},
+	},
+	{
+		Collection: messageRevisionsCollection,
+		Name:       "message_revisions",
+		Keys:       bson.D{{Key: "message_id", Value: 1}, {Key: "date_replaced", Value: 1}},
+	},
+
+	{
+		// claims expire at their own expires_at
+		Collection:         messageSubmissionsCollection,
+		Name:               "expires_at_ttl",
+		Keys:               bson.D{{Key: "expires_at", Value: 1}},
+		ExpireAfterSeconds: new(int32),
+	},
+
+	// ---------- channels ----------
+	{
+		Collection: "channels",
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+
+	// ---------- attachments ----------
+	{
+		Collection: attachmentsCollectionName,
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+
+	// ---------- custom emoji ----------
+	{
+		Collection: customEmojiCollection,
+		Name:       "short_code_unique",
+		Keys:       bson.D{{Key: "short_code", Value: 1}},
+		Unique:     true,
+	},
+	{
+		Collection: customEmojiCollection,
+		Name:       "aliases",
+		Keys:       bson.D{{Key: "aliases", Value: 1}},
+	},
+
+	// ---------- mentions ----------
+	{
+		Collection: mentionsCollection,
+		Name:       "account_message_unique",
+		Keys:       bson.D{{Key: "account_id", Value: 1}, {Key: "message_id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		// an account's inbox, sorted by (date_created, message_id)
+		Collection: mentionsCollection,
+		Name:       "account_inbox",
+		Keys: bson.D{
+			{Key: "account_id", Value: 1},
+			{Key: "date_created", Value: -1},
+			{Key: "message_id", Value: -1},
+		},
+	},
+
+	// ---------- devices ----------
+	{
+		Collection: devicesCollection,
+		Name:       "token_unique",
+		Keys:       bson.D{{Key: "token", Value: 1}},
+		Unique:     true,
+	},
+	{
+		Collection: devicesCollection,
+		Name:       "account_id",
+		Keys:       bson.D{{Key: "account_id", Value: 1}},
+	},
+
+	// ---------- notification settings ----------
+	{
+		Collection: notificationSettingsCollection,
+		Name:       "account_id_unique",
+		Keys:       bson.D{{Key: "account_id", Value: 1}},
+		Unique:     true,
+	},
+
+	// ---------- webhooks ----------
+	{
+		Collection: webhookSubscriptionsCollection,
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		Collection: webhookDeliveriesCollection,
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		// the retry queue
+		Collection: webhookDeliveriesCollection,
+		Name:       "due",
+		Keys:       bson.D{{Key: "next_attempt_at", Value: 1}},
+		Partial:    bson.M{"status": "pending"},
+	},
+	{
+		// the delivery log of a subscription
+		Collection: webhookDeliveriesCollection,
+		Name:       "subscription_log",
+		Keys:       bson.D{{Key: "subscription_id", Value: 1}, {Key: "date_created", Value: -1}},
+	},
+
+	{
+		// outbox events are published at least once, so retries must not
+		// queue a delivery twice
+		Collection: webhookDeliveriesCollection,
+		Name:       "event_subscription_unique",
+		Keys:       bson.D{{Key: "event_id", Value: 1}, {Key: "subscription_id", Value: 1}},
+		Unique:     true,
+	},
+
+	// ---------- outbox ----------
+	{
+		Collection: outboxCollection,
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		// unpublished events due to be claimed, in the order they were written
+		Collection: outboxCollection,
+		Name:       "unpublished_due",
+		Keys:       bson.D{{Key: "published_at", Value: 1}, {Key: "id", Value: 1}, {Key: "publish_at", Value: 1}},
+	},
+	{
+		// the unpublished events of a scope holding back its later ones
+		Collection: outboxCollection,
+		Name:       "unpublished_scope",
+		Keys:       bson.D{{Key: "published_at", Value: 1}, {Key: "scope_id", Value: 1}, {Key: "id", Value: 1}},
+	},
+	{
+		// events without published_at are kept until they are published
+		Collection:         outboxCollection,
+		Name:               "published_at_ttl",
+		Keys:               bson.D{{Key: "published_at", Value: 1}},
+		ExpireAfterSeconds: &publishedOutboxRetention,
+	},
+
+	// ---------- threads ----------
+	{
+		Collection: "threads",
+		Name:       "id_unique",
+		Keys:       bson.D{{Key: "id", Value: 1}},
+		Unique:     true,
+	},
+	{
+		// active threads of a channel
+		Collection: "threads",
+		Name:       "channel_last_reply",
+		Keys:       bson.D{{Key: "channelid", Value: 1}, {Key: "lastreplyat", Value: -1}},
+	},
+	{
+		// threads an account participates in
+		Collection: "threads",
+		Name:       "participant_last_reply",
+		Keys:       bson.D{{Key: "participants", Value: 1}, {Key: "lastreplyat", Value: -1}},
+	},
+	{
+		Collection: "thread_unreads",
+		Name:       "account_thread_unique",
+		Keys:       bson.D{{Key: "account_id", Value: 1}, {Key: "thread_id", Value: 1}},
+		Unique:     true,
+	},
+}
+
+func (spec IndexSpec) model() mongo.IndexModel {
+	indexOptions := options.Index().SetName(spec.Name)
+	if spec.Unique {
+		indexOptions.SetUnique(true)
+	}
+	if spec.Partial != nil {
+		indexOptions.SetPartialFilterExpression(spec.Partial)
+	}
+	if spec.ExpireAfterSeconds != nil {
+		indexOptions.SetExpireAfterSeconds(*spec.ExpireAfterSeconds)
+	}
+
+	return mongo.IndexModel{Keys: spec.Keys, Options: indexOptions}
+}
+
+// EnsureIndexes creates every declared index that does not exist yet. It is
+// idempotent; an index whose definition changed is reported and left as is.
+func EnsureIndexes(ctx context.Context) error {
+	catacheDatabase := MongodbClient.Database("catache")
+
+	var failed int
+	for _, spec := range DeclaredIndexes {
+		indexView := catacheDatabase.Collection(spec.Collection).Indexes()
+
+		_, err := indexView.CreateOne(ctx, spec.model())
+		if err != nil {
+			failed++
+			logrus.Errorf("failed to ensure index %s.%s: %v", spec.Collection, spec.Name, err)
+			continue
+		}
+		logrus.Infof("ensured index %s.%s", spec.Collection, spec.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d indexes could not be ensured", failed, len(DeclaredIndexes))
+	}
+	return nil
+}
+
+// liveIndex is the subset of listIndexes output compared against IndexSpec.
+type liveIndex struct {
+	Name               string `bson:"name"`
+	Keys               bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	Partial            bson.M `bson:"partialFilterExpression"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+}
+
+// VerifyIndexes diffs the declared indexes against the live database and
+// returns one line per missing, changed or undeclared index.
+func VerifyIndexes(ctx context.Context) ([]string, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+
+	declared := map[string]map[string]IndexSpec{}
+	for _, spec := range DeclaredIndexes {
+		if declared[spec.Collection] == nil {
+			declared[spec.Collection] = map[string]IndexSpec{}
+		}
+		declared[spec.Collection][spec.Name] = spec
+	}
+
+	var diffs []string
+	for collection, specs := range declared {
+		cursor, err := catacheDatabase.Collection(collection).Indexes().List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list indexes of %s: %v", collection, err)
+		}
+		var live []liveIndex
+		if err := cursor.All(ctx, &live); err != nil {
+			return nil, fmt.Errorf("failed to decode indexes of %s: %v", collection, err)
+		}
+
+		seen := map[string]bool{}
+		for _, index := range live {
+			if index.Name == "_id_" {
+				continue
+			}
+			seen[index.Name] = true
+
+			spec, ok := specs[index.Name]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("undeclared %s.%s %v", collection, index.Name, index.Keys))
+				continue
+			}
+			if !sameIndex(spec, index) {
+				diffs = append(diffs, fmt.Sprintf(
+					"changed %s.%s: declared %v unique=%t partial=%v, live %v unique=%t partial=%v",
+					collection, index.Name,
+					spec.Keys, spec.Unique, spec.Partial,
+					index.Keys, index.Unique, index.Partial,
+				))
+			}
+		}
+
+		for name, spec := range specs {
+			if !seen[name] {
+				diffs = append(diffs, fmt.Sprintf("missing %s.%s %v", collection, name, spec.Keys))
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+func sameIndex(spec IndexSpec, live liveIndex) bool {
+	if spec.Unique != live.Unique || len(spec.Keys) != len(live.Keys) {
+		return false
+	}
+	if (spec.ExpireAfterSeconds == nil) != (live.ExpireAfterSeconds == nil) ||
+		spec.ExpireAfterSeconds != nil && *spec.ExpireAfterSeconds != *live.ExpireAfterSeconds {
+		return false
+	}
+	for i, key := range spec.Keys {
+		// the server reports key directions as int32 or double
+		if key.Key != live.Keys[i].Key || fmt.Sprint(key.Value) != fmt.Sprint(live.Keys[i].Value) {
+			return false
+		}
+	}
+
+	return fmt.Sprint(normalize(spec.Partial)) == fmt.Sprint(normalize(live.Partial))
+}
+
+// normalize round-trips a filter through bson so declared and live filters
+// compare with the same value types.
+func normalize(filter bson.M) bson.M {
+	if filter == nil {
+		return nil
+	}
+	raw, err := bson.Marshal(filter)
+	if err != nil {
+		return filter
+	}
+	var normalized bson.M
+	if err := bson.Unmarshal(raw, &normalized); err != nil {
+		return filter
+	}
+	return normalized
+}
@@ -0,0 +1,132 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+)
+
+// Until the migration of a legacy channel_<id> or thread_<id> collection is
+// verified, some of its messages may not be in MessagesCollection yet. Channel
+// and thread history is read from both, and a message found only in the legacy
+// collection is copied over before it is changed, so the change is not lost to
+// the copy the migration skips.
+
+// legacyMigrationsDone is the checkpoint a migration run leaves once it
+// verified every legacy collection, so scopes that never had one need no
+// fallback either.
+const legacyMigrationsDone = "legacy_message_collections"
+
+// migratedLegacyCollections remembers the legacy collections known to need no
+// fallback, which stays true once it is.
+var migratedLegacyCollections sync.Map
+
+// legacyCollectionName names the legacy collection of the channel or thread
+// of scope.
+func legacyCollectionName(scope bson.M) string {
+	if threadId, ok := scope["thread_id"].(uuid.UUID); ok {
+		return "thread_" + threadId.String()
+	}
+	channelId, _ := scope["channel_id"].(uuid.UUID)
+	return "channel_" + channelId.String()
+}
+
+// unmigratedLegacyCollection returns the legacy collection of scope while its
+// migration is not verified, nil after. Reading a collection that does not
+// exist finds nothing, so it needs no listCollections, which transactions do
+// not allow.
+func unmigratedLegacyCollection(ctx context.Context, scope bson.M) (*mongo.Collection, error) {
+	name := legacyCollectionName(scope)
+	if _, ok := migratedLegacyCollections.Load(legacyMigrationsDone); ok {
+		return nil, nil
+	}
+	if _, ok := migratedLegacyCollections.Load(name); ok {
+		return nil, nil
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	migrations := catacheDatabase.Collection(messageMigrationsCollection)
+
+	cursor, err := migrations.Find(
+		ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"_id": name, "verified": true},
+			bson.M{"_id": legacyMigrationsDone, "done": true},
+		}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find migration of %s: %v", name, err)
+	}
+	var migrated []legacyMigration
+	if err := cursor.All(ctx, &migrated); err != nil {
+		return nil, fmt.Errorf("failed to decode migration of %s: %v", name, err)
+	}
+	for _, migration := range migrated {
+		migratedLegacyCollections.Store(migration.Source, true)
+	}
+	if len(migrated) > 0 {
+		return nil, nil
+	}
+	return catacheDatabase.Collection(name), nil
+}
+
+// historyCollections are the collections the history of scope is paged
+// through: MessagesCollection, and its legacy collection while that is not
+// migrated.
+func historyCollections(ctx context.Context, scope bson.M) ([]*mongo.Collection, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collections := []*mongo.Collection{catacheDatabase.Collection(MessagesCollection)}
+
+	legacy, err := unmigratedLegacyCollection(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		collections = append(collections, legacy)
+	}
+	return collections, nil
+}
+
+// copyLegacyMessage copies the message matching filter, which must be its
+// scope and message_id, from its unmigrated legacy collection unless it is
+// in MessagesCollection already.
+func copyLegacyMessage(ctx context.Context, filter bson.M) error {
+	legacy, err := unmigratedLegacyCollection(ctx, filter)
+	if err != nil || legacy == nil {
+		return err
+	}
+
+	var document bson.Raw
+	err = legacy.FindOne(ctx, filter).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find legacy message: %v", err)
+	}
+	marked, err := markEngineInsert(document)
+	if err != nil {
+		return fmt.Errorf("failed to copy legacy message: %v", err)
+	}
+
+	// an upsert leaves a copy made meanwhile alone, where an insert would
+	// fail the transaction it is part of
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+	_, err = messagesCollection.UpdateOne(
+		ctx,
+		filter,
+		bson.M{"$setOnInsert": marked},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to copy legacy message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const mentionsCollection = "mentions"
+
+// InsertMentions adds the entries to their accounts' inboxes. An account is
+// mentioned at most once per message, so inserting again is a no-op.
+func InsertMentions(ctx context.Context, mentions []models.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(mentionsCollection)
+
+	writes := make([]mongo.WriteModel, 0, len(mentions))
+	for _, mention := range mentions {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"account_id": mention.AccountId, "message_id": mention.MessageId}).
+			SetUpdate(bson.M{"$setOnInsert": mention}).
+			SetUpsert(true),
+		)
+	}
+
+	_, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("failed to insert mentions: %v", err)
+	}
+	return nil
+}
+
+// FindMentionsByAccountId pages through an account's mention inbox, newest
+// first, optionally leaving out the mentions already read.
+func FindMentionsByAccountId(
+	ctx context.Context,
+	accountId string,
+	unreadOnly bool,
+	query models.PageQuery,
+) (models.MessagePage[models.Mention], error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(mentionsCollection)
+
+	scope := bson.M{"account_id": accountId}
+	if unreadOnly {
+		scope["read_at"] = bson.M{"$exists": false}
+	}
+
+	return findMessagePage[models.Mention](ctx, []*mongo.Collection{collection}, scope, query)
+}
+
+// MarkMentionsRead marks the account's mentions of the given messages as read,
+// or all of its mentions when no message is given, and returns how many were
+// unread.
+func MarkMentionsRead(ctx context.Context, accountId string, messageIds []string) (int64, error) {
+	filter := bson.M{"account_id": accountId, "read_at": bson.M{"$exists": false}}
+	if len(messageIds) > 0 {
+		ids := make([]uuid.UUID, 0, len(messageIds))
+		for _, messageId := range messageIds {
+			id, err := parseId("message", messageId)
+			if err != nil {
+				return 0, err
+			}
+			ids = append(ids, id)
+		}
+		filter["message_id"] = bson.M{"$in": ids}
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(mentionsCollection)
+
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"read_at": time.Now().UTC()}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark mentions read: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,382 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// legacy collections were named channel_<uuid> and thread_<uuid>
+const legacyMessageCollectionPattern = `^(channel|thread)_[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+
+const messageMigrationsCollection = "message_migrations"
+
+// messageMigrationConflictsCollection lists the legacy messages that cannot be
+// copied because another message already has their message_id.
+const messageMigrationConflictsCollection = "message_migration_conflicts"
+
+// legacyMigration checkpoints the copy of one legacy collection.
+type legacyMigration struct {
+	Source   string             `bson:"_id"`
+	LastId   primitive.ObjectID `bson:"last_id"`
+	Copied   int64              `bson:"copied"`
+	Done     bool               `bson:"done"`
+	Verified bool               `bson:"verified"` // every message was found in the unified collection, reads stop falling back
+}
+
+// migrationConflict is a legacy message whose message_id is taken. It is
+// resolved by deleting the legacy message, or by giving it another
+// message_id, and running the migration again.
+type migrationConflict struct {
+	LegacyId  primitive.ObjectID `bson:"_id"`
+	Source    string             `bson:"source"`
+	MessageId bson.RawValue      `bson:"message_id"`
+	TakenBy   primitive.ObjectID `bson:"taken_by"` // the _id of the message holding message_id
+	DateFound time.Time          `bson:"date_found"`
+}
+
+// MigrateLegacyMessageCollections copies every per-channel and per-thread
+// collection into MessagesCollection.
+//
+// It is safe to run while engines serve traffic: new writes already land in
+// the unified collection, copies are inserts that skip documents already
+// present, and progress is checkpointed per source so an interrupted run
+// resumes where it stopped. A source is marked verified once every one of its
+// documents is found in the unified collection, which stops engines from
+// reading it as well, and with dropSources it is dropped then. Once every
+// source is verified the run is checkpointed done, and engines stop looking
+// for legacy collections at all.
+//
+// Legacy messages whose message_id another message holds are recorded in
+// message_migration_conflicts rather than copied. Their sources are neither
+// verified nor dropped, and the migration fails once every source was copied,
+// until a run finds them resolved.
+func MigrateLegacyMessageCollections(ctx context.Context, batchSize int64, dropSources bool) error {
+	catacheDatabase := MongodbClient.Database("catache")
+
+	sources, err := catacheDatabase.ListCollectionNames(
+		ctx,
+		bson.M{"name": bson.M{"$regex": legacyMessageCollectionPattern}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list legacy collections: %v", err)
+	}
+
+	logrus.Infof("found %d legacy message collections", len(sources))
+
+	var conflicts, unverified int64
+	for _, source := range sources {
+		copied, err := migrateLegacyCollection(ctx, catacheDatabase, source, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", source, err)
+		}
+		logrus.Infof("migrated %s: %d messages copied", source, copied)
+
+		unresolved, err := retryMigrationConflicts(ctx, catacheDatabase, source)
+		if err != nil {
+			return fmt.Errorf("failed to retry conflicts of %s: %v", source, err)
+		}
+		if unresolved > 0 {
+			logrus.Errorf(
+				"%s has %d messages whose message_id another message holds, listed in %s; it is not verified or dropped",
+				source, unresolved, messageMigrationConflictsCollection,
+			)
+			conflicts += unresolved
+			continue
+		}
+
+		err = verifyLegacyCollection(ctx, catacheDatabase, source, batchSize)
+		if err != nil && dropSources {
+			return fmt.Errorf("failed to verify %s: %v", source, err)
+		}
+		if err != nil {
+			logrus.Warnf("engines keep reading %s as well: failed to verify it: %v", source, err)
+			unverified++
+			continue
+		}
+		_, err = catacheDatabase.Collection(messageMigrationsCollection).UpdateOne(
+			ctx,
+			bson.M{"_id": source},
+			bson.M{"$set": bson.M{"verified": true}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to mark %s verified: %v", source, err)
+		}
+		logrus.Infof("verified %s", source)
+
+		if !dropSources {
+			continue
+		}
+		err = catacheDatabase.Collection(source).Drop(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to drop %s: %v", source, err)
+		}
+		logrus.Infof("dropped %s", source)
+	}
+
+	if conflicts > 0 {
+		return fmt.Errorf("%d legacy messages collide on message_id, resolve them and run again", conflicts)
+	}
+	if unverified > 0 {
+		return nil
+	}
+
+	_, err = catacheDatabase.Collection(messageMigrationsCollection).UpdateOne(
+		ctx,
+		bson.M{"_id": legacyMigrationsDone},
+		bson.M{"$set": bson.M{"done": true}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark the migration done: %v", err)
+	}
+	return nil
+}
+
+func migrateLegacyCollection(
+	ctx context.Context,
+	catacheDatabase *mongo.Database,
+	source string,
+	batchSize int64,
+) (int64, error) {
+	migrations := catacheDatabase.Collection(messageMigrationsCollection)
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+	sourceCollection := catacheDatabase.Collection(source)
+
+	checkpoint := legacyMigration{Source: source}
+	err := migrations.FindOne(ctx, bson.M{"_id": source}).Decode(&checkpoint)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+
+	for !checkpoint.Done {
+		findOptions := options.Find()
+		findOptions.SetSort(bson.D{{Key: "_id", Value: 1}})
+		findOptions.SetLimit(batchSize)
+
+		cursor, err := sourceCollection.Find(ctx, bson.M{"_id": bson.M{"$gt": checkpoint.LastId}}, findOptions)
+		if err != nil {
+			return checkpoint.Copied, err
+		}
+		var batch []bson.Raw
+		err = cursor.All(ctx, &batch)
+		if err != nil {
+			return checkpoint.Copied, err
+		}
+
+		if len(batch) > 0 {
+			// copies are not new messages to fan out
+			docs := make([]interface{}, len(batch))
+			for i, doc := range batch {
+				docs[i], err = markEngineInsert(doc)
+				if err != nil {
+					return checkpoint.Copied, fmt.Errorf("failed to copy %s: %v", doc.Lookup("_id"), err)
+				}
+			}
+
+			inserted, refused, err := insertSkippingDuplicates(ctx, messagesCollection, docs)
+			if err != nil {
+				return checkpoint.Copied, err
+			}
+			for _, i := range refused {
+				err = recordMigrationConflict(ctx, catacheDatabase, source, batch[i])
+				if err != nil {
+					return checkpoint.Copied, err
+				}
+			}
+
+			checkpoint.Copied += inserted
+			checkpoint.LastId = batch[len(batch)-1].Lookup("_id").ObjectID()
+		}
+		checkpoint.Done = int64(len(batch)) < batchSize
+
+		_, err = migrations.ReplaceOne(
+			ctx,
+			bson.M{"_id": source},
+			checkpoint,
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil {
+			return checkpoint.Copied, fmt.Errorf("failed to save checkpoint: %v", err)
+		}
+	}
+
+	return checkpoint.Copied, nil
+}
+
+// insertSkippingDuplicates inserts docs, and returns how many were inserted
+// and the indexes of the ones a unique index refused.
+func insertSkippingDuplicates(ctx context.Context, collection *mongo.Collection, docs []interface{}) (int64, []int, error) {
+	result, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return int64(len(result.InsertedIDs)), nil, nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		return 0, nil, err
+	}
+	refused := make([]int, 0, len(bulkErr.WriteErrors))
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return 0, nil, err
+		}
+		refused = append(refused, writeErr.Index)
+	}
+
+	return int64(len(docs) - len(refused)), refused, nil
+}
+
+// recordMigrationConflict checks why a legacy message was refused. It is
+// either copied already, or another message holds its message_id, which is
+// recorded as a conflict.
+func recordMigrationConflict(ctx context.Context, catacheDatabase *mongo.Database, source string, doc bson.Raw) error {
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	legacyId := doc.Lookup("_id")
+	copied, err := messagesCollection.CountDocuments(ctx, bson.M{"_id": legacyId})
+	if err != nil {
+		return fmt.Errorf("failed to find copy of %s: %v", legacyId, err)
+	}
+	if copied > 0 {
+		return nil
+	}
+
+	conflict := migrationConflict{
+		LegacyId:  legacyId.ObjectID(),
+		Source:    source,
+		MessageId: doc.Lookup("message_id"),
+		DateFound: time.Now().UTC(),
+	}
+	var holder struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	err = messagesCollection.FindOne(ctx, bson.M{"message_id": conflict.MessageId}).Decode(&holder)
+	if err != nil {
+		return fmt.Errorf("failed to find the message holding the message_id of %s: %v", legacyId, err)
+	}
+	conflict.TakenBy = holder.Id
+
+	logrus.Warnf("%s: message %s has message_id %s, which message %s holds", source, legacyId, conflict.MessageId, holder.Id)
+	_, err = catacheDatabase.Collection(messageMigrationConflictsCollection).ReplaceOne(
+		ctx,
+		bson.M{"_id": conflict.LegacyId},
+		conflict,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record conflict of %s: %v", legacyId, err)
+	}
+	return nil
+}
+
+// retryMigrationConflicts copies the conflicting messages of source again, as
+// they are now, and returns how many still conflict. Conflicts whose legacy
+// message was deleted are resolved.
+func retryMigrationConflicts(ctx context.Context, catacheDatabase *mongo.Database, source string) (int64, error) {
+	conflictsCollection := catacheDatabase.Collection(messageMigrationConflictsCollection)
+	sourceCollection := catacheDatabase.Collection(source)
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	cursor, err := conflictsCollection.Find(ctx, bson.M{"source": source})
+	if err != nil {
+		return 0, err
+	}
+	var conflicts []migrationConflict
+	err = cursor.All(ctx, &conflicts)
+	if err != nil {
+		return 0, err
+	}
+
+	var unresolved int64
+	for _, conflict := range conflicts {
+		var doc bson.Raw
+		err := sourceCollection.FindOne(ctx, bson.M{"_id": conflict.LegacyId}).Decode(&doc)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return unresolved, err
+		}
+
+		if err == nil {
+			marked, err := markEngineInsert(doc)
+			if err != nil {
+				return unresolved, err
+			}
+			_, refused, err := insertSkippingDuplicates(ctx, messagesCollection, []interface{}{marked})
+			if err != nil {
+				return unresolved, err
+			}
+			if len(refused) > 0 {
+				err = recordMigrationConflict(ctx, catacheDatabase, source, doc)
+				if err != nil {
+					return unresolved, err
+				}
+				unresolved++
+				continue
+			}
+		}
+
+		_, err = conflictsCollection.DeleteOne(ctx, bson.M{"_id": conflict.LegacyId})
+		if err != nil {
+			return unresolved, err
+		}
+		logrus.Infof("%s: conflict of message %s resolved", source, conflict.LegacyId)
+	}
+	return unresolved, nil
+}
+
+// verifyLegacyCollection checks that every document of source exists in the
+// unified collection.
+func verifyLegacyCollection(ctx context.Context, catacheDatabase *mongo.Database, source string, batchSize int64) error {
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+	sourceCollection := catacheDatabase.Collection(source)
+
+	findOptions := options.Find()
+	findOptions.SetProjection(bson.M{"_id": 1})
+	findOptions.SetBatchSize(int32(batchSize))
+
+	cursor, err := sourceCollection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var ids bson.A
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		found, err := messagesCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		if found != int64(len(ids)) {
+			return fmt.Errorf("%d of %d messages missing", int64(len(ids))-found, len(ids))
+		}
+		ids = ids[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		ids = append(ids, cursor.Current.Lookup("_id"))
+		if int64(len(ids)) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
@@ -0,0 +1,124 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const notificationSettingsCollection = "notification_settings"
+
+// FindNotificationSettings returns the account's settings, the defaults when
+// it never saved any.
+func FindNotificationSettings(ctx context.Context, accountId string) (models.NotificationSettings, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(notificationSettingsCollection)
+
+	var settings models.NotificationSettings
+	err := collection.FindOne(ctx, bson.M{"account_id": accountId}).Decode(&settings)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.NotificationSettings{AccountId: accountId}, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("failed to find notification settings of %s: %v", accountId, err)
+	}
+
+	return settings, nil
+}
+
+// FindNotificationSettingsOf returns the saved settings of the given accounts
+// by account id. Accounts missing from it have the defaults.
+func FindNotificationSettingsOf(ctx context.Context, accountIds []string) (map[string]models.NotificationSettings, error) {
+	return findNotificationSettings(ctx, bson.M{"account_id": bson.M{"$in": accountIds}})
+}
+
+// FindKeywordSettingsOf is FindNotificationSettingsOf limited to the accounts
+// with keyword alerts.
+func FindKeywordSettingsOf(ctx context.Context, accountIds []string) (map[string]models.NotificationSettings, error) {
+	return findNotificationSettings(ctx, bson.M{
+		"account_id": bson.M{"$in": accountIds},
+		"keywords.0": bson.M{"$exists": true},
+	})
+}
+
+func findNotificationSettings(ctx context.Context, filter bson.M) (map[string]models.NotificationSettings, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(notificationSettingsCollection)
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find notification settings: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var found []models.NotificationSettings
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode notification settings: %v", err)
+	}
+
+	settings := make(map[string]models.NotificationSettings, len(found))
+	for _, s := range found {
+		settings[s.AccountId] = s
+	}
+	return settings, nil
+}
+
+// ReplaceNotificationSettings saves the whole of an account's settings.
+func ReplaceNotificationSettings(ctx context.Context, settings models.NotificationSettings) (models.NotificationSettings, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(notificationSettingsCollection)
+
+	settings.DateUpdated = time.Now().UTC()
+
+	filter := bson.M{"account_id": settings.AccountId}
+	_, err := collection.ReplaceOne(ctx, filter, settings, options.Replace().SetUpsert(true))
+	if err != nil {
+		return settings, fmt.Errorf("failed to save notification settings of %s: %v", settings.AccountId, err)
+	}
+	return settings, nil
+}
+
+// SetChannelNotificationLevel changes the level of one channel, leaving the
+// rest of the settings as they are.
+func SetChannelNotificationLevel(ctx context.Context, accountId, channelId string, level models.NotificationLevel) (models.NotificationSettings, error) {
+	return updateNotificationSettings(ctx, accountId, bson.M{
+		"$set": bson.M{"channel_levels." + channelId: level, "date_updated": time.Now().UTC()},
+	})
+}
+
+// SetThreadMuted mutes or unmutes one thread, leaving the rest of the settings
+// as they are.
+func SetThreadMuted(ctx context.Context, accountId, threadId string, muted bool) (models.NotificationSettings, error) {
+	op := "$pull"
+	if muted {
+		op = "$addToSet"
+	}
+	return updateNotificationSettings(ctx, accountId, bson.M{
+		op:     bson.M{"muted_threads": threadId},
+		"$set": bson.M{"date_updated": time.Now().UTC()},
+	})
+}
+
+func updateNotificationSettings(ctx context.Context, accountId string, update bson.M) (models.NotificationSettings, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(notificationSettingsCollection)
+
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var settings models.NotificationSettings
+	err := collection.FindOneAndUpdate(ctx, bson.M{"account_id": accountId}, update, updateOptions).Decode(&settings)
+	if err != nil {
+		return settings, fmt.Errorf("failed to update notification settings of %s: %v", accountId, err)
+	}
+	return settings, nil
+}
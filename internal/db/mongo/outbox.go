@@ -0,0 +1,208 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const (
+	outboxCollection = "outbox"
+	busCollection    = "bus_events"
+)
+
+// outboxClaimCandidates is how many due events a claim looks at for one that
+// is the oldest of its scope.
+const outboxClaimCandidates = 100
+
+// publishedOutboxRetention is how many seconds published events are kept for.
+var publishedOutboxRetention int32 = 7 * 24 * 60 * 60
+
+// InsertOutboxEvents records the events of a state change. Call it with the
+// txCtx of the transaction making the change.
+func InsertOutboxEvents(ctx context.Context, events []models.OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		documents = append(documents, event)
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(outboxCollection)
+
+	_, err := collection.InsertMany(ctx, documents)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox events: %v", err)
+	}
+	return nil
+}
+
+// ClaimDueOutboxEvent leases the oldest unpublished event due at now that no
+// older unpublished event of its scope holds back, whether it is leased or
+// waiting for a retry.
+func ClaimDueOutboxEvent(ctx context.Context, now time.Time, lease time.Duration) (models.OutboxEvent, bool, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(outboxCollection)
+
+	filter := bson.M{"published_at": nil, "publish_at": bson.M{"$lte": now}}
+	findOptions := options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetLimit(outboxClaimCandidates).
+		SetProjection(bson.M{"id": 1, "scope_id": 1})
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return models.OutboxEvent{}, false, fmt.Errorf("failed to find due outbox events: %v", err)
+	}
+	var candidates []models.OutboxEvent
+	err = cursor.All(ctx, &candidates)
+	if err != nil {
+		return models.OutboxEvent{}, false, fmt.Errorf("failed to decode due outbox events: %v", err)
+	}
+
+	heldBack := map[string]bool{}
+	for _, candidate := range candidates {
+		if heldBack[candidate.ScopeId] {
+			continue
+		}
+
+		older := bson.M{"published_at": nil, "scope_id": candidate.ScopeId, "id": bson.M{"$lt": candidate.Id}}
+		count, err := collection.CountDocuments(ctx, older, options.Count().SetLimit(1))
+		if err != nil {
+			return models.OutboxEvent{}, false, fmt.Errorf("failed to count older outbox events: %v", err)
+		}
+		if count > 0 {
+			heldBack[candidate.ScopeId] = true
+			continue
+		}
+
+		// another relay may have claimed it since
+		claim := bson.M{"id": candidate.Id, "published_at": nil, "publish_at": bson.M{"$lte": now}}
+		update := bson.M{"$set": bson.M{"publish_at": now.Add(lease)}}
+
+		var event models.OutboxEvent
+		err = collection.FindOneAndUpdate(ctx, claim, update).Decode(&event)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			heldBack[candidate.ScopeId] = true
+			continue
+		}
+		if err != nil {
+			return models.OutboxEvent{}, false, fmt.Errorf("failed to claim outbox event: %v", err)
+		}
+		return event, true, nil
+	}
+	return models.OutboxEvent{}, false, nil
+}
+
+// RetryOutboxEvent puts back an event that failed to publish, due again at
+// retryAt.
+func RetryOutboxEvent(ctx context.Context, event models.OutboxEvent, retryAt time.Time) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(outboxCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"id": event.Id}, bson.M{
+		"$set": bson.M{"publish_at": retryAt},
+		"$inc": bson.M{"attempts": 1},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to retry outbox event %s: %v", event.Id, err)
+	}
+	return nil
+}
+
+func MarkOutboxEventPublished(ctx context.Context, event models.OutboxEvent, publishedAt time.Time) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(outboxCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"id": event.Id}, bson.M{"$set": bson.M{"published_at": publishedAt}})
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox event %s published: %v", event.Id, err)
+	}
+	return nil
+}
+
+// EnsureBus creates the capped collection of the inter-node bus. A seed event
+// keeps it from ever being empty, which would end tailing cursors at once.
+func EnsureBus(ctx context.Context, sizeBytes int64) error {
+	catacheDatabase := MongodbClient.Database("catache")
+
+	names, err := catacheDatabase.ListCollectionNames(ctx, bson.M{"name": busCollection})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %v", err)
+	}
+	if len(names) > 0 {
+		return nil
+	}
+
+	err = catacheDatabase.CreateCollection(ctx, busCollection, options.CreateCollection().SetCapped(true).SetSizeInBytes(sizeBytes))
+	if err != nil && !isNamespaceExists(err) {
+		return fmt.Errorf("failed to create bus collection: %v", err)
+	}
+
+	_, err = catacheDatabase.Collection(busCollection).InsertOne(ctx, models.BusEvent{})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("failed to seed bus collection: %v", err)
+	}
+	return nil
+}
+
+func isNamespaceExists(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == 48
+}
+
+// PublishBusEvent puts an event on the bus. Publishing the same event again is
+// a no-op.
+func PublishBusEvent(ctx context.Context, event models.BusEvent) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(busCollection)
+
+	_, err := collection.InsertOne(ctx, event)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("failed to publish bus event %s: %v", event.Id, err)
+	}
+	return nil
+}
+
+// TailBusEvents calls fn with every event published on the bus from since on,
+// in publishing order, until ctx is done or the cursor is lost. The older
+// events are skipped here rather than filtered out by the query, since a
+// tailing cursor whose query matches nothing yet is closed by the server.
+func TailBusEvents(ctx context.Context, since time.Time, fn func(event models.BusEvent)) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(busCollection)
+
+	findOptions := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(time.Second)
+	cursor, err := collection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return fmt.Errorf("failed to tail bus: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(context.Background()); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	for cursor.Next(ctx) {
+		var event models.BusEvent
+		if err := cursor.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode bus event: %v", err)
+		}
+		if event.PublishedAt.Before(since) {
+			continue
+		}
+		fn(event)
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to tail bus: %v", err)
+	}
+	return errors.New("bus cursor closed")
+}
@@ -0,0 +1,207 @@
+package mongo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"sort"
+)
+
+type pageable interface {
+	PageCursor() models.MessageCursor
+}
+
+// findMessagePage pages through the messages of the collections matching
+// scope ordered by (date_created, message_id), the newest message first.
+func findMessagePage[T pageable](
+	ctx context.Context,
+	collections []*mongo.Collection,
+	scope bson.M,
+	query models.PageQuery,
+) (models.MessagePage[T], error) {
+	var page models.MessagePage[T]
+	var err error
+
+	switch query.Direction {
+	case models.PageAfter:
+		newer, hasMore, err := findPageSlice[T](ctx, collections, scope, query.Cursor, false, query.Limit)
+		if err != nil {
+			return page, err
+		}
+		reverse(newer)
+
+		page.Messages = newer
+		if hasMore {
+			page.Prev = newer[0].PageCursor().Encode()
+		}
+		page.Next = query.Cursor.Encode()
+		if len(newer) > 0 {
+			page.Next = newer[len(newer)-1].PageCursor().Encode()
+		}
+
+	case models.PageAround:
+		var anchor T
+		anchorFilter := bson.M{"message_id": query.AroundMessageId}
+		for k, v := range scope {
+			anchorFilter[k] = v
+		}
+		for _, c := range collections {
+			err = c.FindOne(ctx, anchorFilter).Decode(&anchor)
+			if !errors.Is(err, mongo.ErrNoDocuments) {
+				break
+			}
+		}
+		if err != nil {
+			return page, anchorError(err, query.AroundMessageId)
+		}
+		from := anchor.PageCursor()
+
+		olderLimit := (query.Limit - 1) / 2
+		newerLimit := query.Limit - 1 - olderLimit
+
+		older, hasOlder, err := findPageSlice[T](ctx, collections, scope, &from, true, olderLimit)
+		if err != nil {
+			return page, err
+		}
+		newer, hasNewer, err := findPageSlice[T](ctx, collections, scope, &from, false, newerLimit)
+		if err != nil {
+			return page, err
+		}
+		reverse(newer)
+
+		page.Messages = append(append(newer, anchor), older...)
+		if hasOlder {
+			page.Next = page.Messages[len(page.Messages)-1].PageCursor().Encode()
+		}
+		if hasNewer {
+			page.Prev = page.Messages[0].PageCursor().Encode()
+		}
+
+	default:
+		older, hasMore, err := findPageSlice[T](ctx, collections, scope, query.Cursor, true, query.Limit)
+		if err != nil {
+			return page, err
+		}
+
+		page.Messages = older
+		if hasMore {
+			page.Next = older[len(older)-1].PageCursor().Encode()
+		}
+		if query.Cursor != nil {
+			page.Prev = query.Cursor.Encode()
+			if len(older) > 0 {
+				page.Prev = older[0].PageCursor().Encode()
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// anchorError reports a failed lookup of the message a page is read around. A
+// message missing from the scope is the client's to fix.
+func anchorError(err error, messageId uuid.UUID) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return util.NewAPIError(
+			http.StatusNotFound,
+			util.CodeNotFound,
+			"message "+messageId.String()+" not found",
+			util.FieldError{Field: "around", Message: "must be a message of this history"},
+		)
+	}
+	return fmt.Errorf("failed to find anchor message: %v", err)
+}
+
+// findPageSlice returns up to limit messages strictly older (or newer) than
+// from, nearest first, and whether more exist beyond them. Messages found in
+// several collections are taken from the first.
+func findPageSlice[T pageable](
+	ctx context.Context,
+	collections []*mongo.Collection,
+	scope bson.M,
+	from *models.MessageCursor,
+	older bool,
+	limit int64,
+) ([]T, bool, error) {
+	if limit <= 0 {
+		return nil, false, nil
+	}
+
+	op, order := "$gt", 1
+	if older {
+		op, order = "$lt", -1
+	}
+
+	filter := scope
+	if from != nil {
+		filter = bson.M{
+			"$and": bson.A{
+				scope,
+				bson.M{"$or": bson.A{
+					bson.M{"date_created": bson.M{op: from.DateCreated}},
+					bson.M{"date_created": from.DateCreated, "message_id": bson.M{op: from.MessageId}},
+				}},
+			},
+		}
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "date_created", Value: order}, {Key: "message_id", Value: order}})
+	findOptions.SetLimit(limit + 1) // one extra tells whether there is more
+
+	var messages []T
+	seen := map[uuid.UUID]bool{}
+	for _, collection := range collections {
+		cursor, err := collection.Find(ctx, filter, findOptions)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to find messages: %v", err)
+		}
+		var found []T
+		err = cursor.All(ctx, &found)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode messages: %v", err)
+		}
+
+		for _, message := range found {
+			if id := message.PageCursor().MessageId; !seen[id] {
+				seen[id] = true
+				messages = append(messages, message)
+			}
+		}
+	}
+	if len(collections) > 1 {
+		sort.SliceStable(messages, func(i, j int) bool {
+			return nearer(messages[i].PageCursor(), messages[j].PageCursor(), older)
+		})
+	}
+
+	hasMore := int64(len(messages)) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	return messages, hasMore, nil
+}
+
+// nearer tells whether a comes before b in pages read towards older (or
+// newer) messages.
+func nearer(a, b models.MessageCursor, older bool) bool {
+	if !a.DateCreated.Equal(b.DateCreated) {
+		return a.DateCreated.After(b.DateCreated) == older
+	}
+	return (bytes.Compare(a.MessageId[:], b.MessageId[:]) > 0) == older
+}
+
+func reverse[T any](s []T) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
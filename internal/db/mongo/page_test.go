@@ -0,0 +1,48 @@
+package mongo
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNearerOrdersLikeThePageQueries(t *testing.T) {
+	now := time.Now().UTC()
+	low, high := uuid.MustParse("00000000-0000-7000-8000-000000000001"), uuid.MustParse("00000000-0000-7000-8000-000000000002")
+
+	earlier := models.MessageCursor{DateCreated: now.Add(-time.Second), MessageId: high}
+	sameTimeLow := models.MessageCursor{DateCreated: now, MessageId: low}
+	sameTimeHigh := models.MessageCursor{DateCreated: now, MessageId: high}
+
+	// towards older messages the newest comes first, ties broken by the higher id
+	if !nearer(sameTimeLow, earlier, true) || nearer(earlier, sameTimeLow, true) {
+		t.Error("reading older messages does not start from the newest")
+	}
+	if !nearer(sameTimeHigh, sameTimeLow, true) {
+		t.Error("reading older messages does not break ties by the higher id")
+	}
+
+	if !nearer(earlier, sameTimeLow, false) || !nearer(sameTimeLow, sameTimeHigh, false) {
+		t.Error("reading newer messages does not start from the oldest")
+	}
+}
+
+func TestMissingAnchorIsNotFound(t *testing.T) {
+	messageId := uuid.MustParse("00000000-0000-7000-8000-000000000001")
+
+	// a message of another channel is just as missing from this one
+	err := anchorError(mongo.ErrNoDocuments, messageId)
+	if apiErr := util.AsAPIError(err); apiErr.Status != http.StatusNotFound || apiErr.Code != util.CodeNotFound {
+		t.Errorf("a missing anchor gave %+v, want a 404", apiErr)
+	}
+
+	err = anchorError(errors.New("connection reset"), messageId)
+	if apiErr := util.AsAPIError(err); apiErr.Status != http.StatusInternalServerError {
+		t.Errorf("a failed lookup gave %+v, want a 500", apiErr)
+	}
+}
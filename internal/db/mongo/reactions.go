@@ -0,0 +1,202 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+)
+
+var ErrReactionTargetMissing = errors.New("message not found or deleted")
+
+// Reactions are a set of (reactor, emoji) pairs. Every function returns the
+// message's reactions as they are after the change.
+
+func AddReactionToChannelMessage(
+	ctx context.Context,
+	ChannelId, MessageId string,
+	reaction models.MessageReaction,
+) ([]models.MessageReaction, error) {
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return addReaction(ctx, filter, reaction)
+}
+
+func AddReactionToThreadMessage(
+	ctx context.Context,
+	threadId, MessageId string,
+	reaction models.MessageReaction,
+) ([]models.MessageReaction, error) {
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return addReaction(ctx, filter, reaction)
+}
+
+func RemoveReactionFromChannelMessage(
+	ctx context.Context,
+	ChannelId, MessageId, ReactorAccountId string,
+	EmojiUnifiedCode string,
+) ([]models.MessageReaction, error) {
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	reactorId, err := parseId("reactor account", ReactorAccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	return removeReaction(ctx, filter, models.MessageReaction{
+		ReactorAccountId: reactorId,
+		EmojiUnifiedCode: EmojiUnifiedCode,
+	})
+}
+
+func RemoveReactionFromThreadMessage(
+	ctx context.Context,
+	threadId, MessageId, ReactorAccountId string,
+	EmojiUnifiedCode string,
+) ([]models.MessageReaction, error) {
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return nil, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	reactorId, err := parseId("reactor account", ReactorAccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	return removeReaction(ctx, filter, models.MessageReaction{
+		ReactorAccountId: reactorId,
+		EmojiUnifiedCode: EmojiUnifiedCode,
+	})
+}
+
+// ToggleChannelMessageReaction removes the reaction if the reactor already
+// reacted with that emoji and adds it otherwise. added reports which it did.
+func ToggleChannelMessageReaction(
+	ctx context.Context,
+	ChannelId, MessageId string,
+	reaction models.MessageReaction,
+) (reactions []models.MessageReaction, added bool, err error) {
+	filter, err := channelMessageFilter(ChannelId, MessageId)
+	if err != nil {
+		return nil, false, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return toggleReaction(ctx, filter, reaction)
+}
+
+// ToggleThreadMessageReaction is ToggleChannelMessageReaction for thread replies.
+func ToggleThreadMessageReaction(
+	ctx context.Context,
+	threadId, MessageId string,
+	reaction models.MessageReaction,
+) (reactions []models.MessageReaction, added bool, err error) {
+	filter, err := threadMessageFilter(threadId, MessageId)
+	if err != nil {
+		return nil, false, err
+	}
+	err = copyLegacyMessage(ctx, filter)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return toggleReaction(ctx, filter, reaction)
+}
+
+func toggleReaction(ctx context.Context, filter bson.M, reaction models.MessageReaction) ([]models.MessageReaction, bool, error) {
+	reacted := bson.M{
+		"reactions": bson.M{
+			"$elemMatch": bson.M{
+				"reactor_account_id": reaction.ReactorAccountId,
+				"emoji_unified_code": reaction.EmojiUnifiedCode,
+			},
+		},
+	}
+	for k, v := range filter {
+		reacted[k] = v
+	}
+
+	reactions, err := removeReaction(ctx, reacted, reaction)
+	if !errors.Is(err, ErrReactionTargetMissing) {
+		return reactions, false, err
+	}
+
+	// not reacted yet, or the message is gone, which addReaction reports
+	reactions, err = addReaction(ctx, filter, reaction)
+	return reactions, true, err
+}
+
+func addReaction(ctx context.Context, filter bson.M, reaction models.MessageReaction) ([]models.MessageReaction, error) {
+	// $addToSet compares whole documents, which always have the same field order
+	return updateReactions(ctx, filter, bson.M{"$addToSet": bson.M{"reactions": reaction}})
+}
+
+func removeReaction(ctx context.Context, filter bson.M, reaction models.MessageReaction) ([]models.MessageReaction, error) {
+	update := bson.M{
+		"$pull": bson.M{
+			"reactions": bson.M{
+				"reactor_account_id": reaction.ReactorAccountId,
+				"emoji_unified_code": reaction.EmojiUnifiedCode,
+			},
+		},
+	}
+	return updateReactions(ctx, filter, update)
+}
+
+// updateReactions applies update to a message that is not deleted.
+func updateReactions(ctx context.Context, filter bson.M, update bson.M) ([]models.MessageReaction, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	messagesCollection := catacheDatabase.Collection(MessagesCollection)
+
+	live := bson.M{"deleted": bson.M{"$exists": false}}
+	for k, v := range filter {
+		live[k] = v
+	}
+
+	var updated struct {
+		Reactions []models.MessageReaction `bson:"reactions"`
+	}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"reactions": 1})
+	err := messagesCollection.FindOneAndUpdate(ctx, live, markEngineUpdate(update), opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrReactionTargetMissing
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update reactions of message: %v", err)
+	}
+
+	return updated.Reactions, nil
+}
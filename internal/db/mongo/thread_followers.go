@@ -0,0 +1,100 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+)
+
+func FindThreadById(ctx context.Context, threadId string) (models.Thread, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	threadsCollection := catacheDatabase.Collection("threads")
+
+	var thread models.Thread
+	err := threadsCollection.FindOne(ctx, bson.M{"id": threadId}).Decode(&thread)
+	if err != nil {
+		return thread, fmt.Errorf("failed to find thread %s: %v", threadId, err)
+	}
+
+	return thread, nil
+}
+
+func FollowThread(ctx context.Context, threadId, accountId string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	threadsCollection := catacheDatabase.Collection("threads")
+
+	filter := bson.M{"id": threadId}
+	update := bson.M{"$addToSet": bson.M{"followers": accountId}}
+	_, err := threadsCollection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func UnfollowThread(ctx context.Context, threadId, accountId string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	threadsCollection := catacheDatabase.Collection("threads")
+
+	filter := bson.M{"id": threadId}
+	update := bson.M{"$pull": bson.M{"followers": accountId}}
+	_, err := threadsCollection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// IncrementThreadUnreads adds one unread reply for every given account.
+func IncrementThreadUnreads(ctx context.Context, threadId string, accountIds []string) error {
+	if len(accountIds) == 0 {
+		return nil
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	unreadsCollection := catacheDatabase.Collection("thread_unreads")
+
+	writes := make([]mongo.WriteModel, 0, len(accountIds))
+	for _, accountId := range accountIds {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"thread_id": threadId, "account_id": accountId}).
+			SetUpdate(bson.M{"$inc": bson.M{"unread_count": 1}}).
+			SetUpsert(true),
+		)
+	}
+
+	_, err := unreadsCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("failed to increment thread unreads: %v", err)
+	}
+	return nil
+}
+
+func ClearThreadUnread(ctx context.Context, threadId, accountId string) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	unreadsCollection := catacheDatabase.Collection("thread_unreads")
+
+	filter := bson.M{"thread_id": threadId, "account_id": accountId}
+	_, err := unreadsCollection.DeleteOne(ctx, filter)
+	return err
+}
+
+func FindThreadUnreadsByAccountId(ctx context.Context, accountId string) ([]models.ThreadUnread, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	unreadsCollection := catacheDatabase.Collection("thread_unreads")
+
+	cursor, err := unreadsCollection.Find(ctx, bson.M{"account_id": accountId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find thread unreads: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var unreads []models.ThreadUnread
+	if err := cursor.All(ctx, &unreads); err != nil {
+		return nil, fmt.Errorf("failed to decode thread unreads: %v", err)
+	}
+
+	return unreads, nil
+}
@@ -0,0 +1,267 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+const (
+	webhookSubscriptionsCollection = "webhook_subscriptions"
+	webhookDeliveriesCollection    = "webhook_deliveries"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook subscription not found")
+	ErrWebhookDeliveryNotFound = errors.New("failed webhook delivery not found")
+)
+
+func NewWebhookSubscription(ctx context.Context, subscription models.WebhookSubscription) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookSubscriptionsCollection)
+
+	_, err := collection.InsertOne(ctx, subscription)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook subscription: %v", err)
+	}
+	return nil
+}
+
+func FindWebhookSubscription(ctx context.Context, subscriptionId string) (models.WebhookSubscription, error) {
+	var subscription models.WebhookSubscription
+
+	id, err := parseId("webhook", subscriptionId)
+	if err != nil {
+		return subscription, err
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookSubscriptionsCollection)
+
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&subscription)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return subscription, ErrWebhookNotFound
+	}
+	if err != nil {
+		return subscription, fmt.Errorf("failed to find webhook subscription %s: %v", subscriptionId, err)
+	}
+	return subscription, nil
+}
+
+func FindWebhookSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error) {
+	return findWebhookSubscriptions(ctx, bson.M{})
+}
+
+// FindWebhookSubscriptionsFor returns the subscriptions selecting eventType,
+// whatever their channel filter.
+func FindWebhookSubscriptionsFor(ctx context.Context, eventType string) ([]models.WebhookSubscription, error) {
+	return findWebhookSubscriptions(ctx, bson.M{"$or": bson.A{
+		bson.M{"event_types": bson.M{"$size": 0}},
+		bson.M{"event_types": eventType},
+	}})
+}
+
+func findWebhookSubscriptions(ctx context.Context, filter bson.M) ([]models.WebhookSubscription, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookSubscriptionsCollection)
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"date_created": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find webhook subscriptions: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var subscriptions []models.WebhookSubscription
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook subscriptions: %v", err)
+	}
+	return subscriptions, nil
+}
+
+// DeleteWebhookSubscription removes a subscription and gives up on its
+// pending deliveries.
+func DeleteWebhookSubscription(ctx context.Context, subscriptionId string) error {
+	id, err := parseId("webhook", subscriptionId)
+	if err != nil {
+		return err
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+
+	result, err := catacheDatabase.Collection(webhookSubscriptionsCollection).DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription %s: %v", subscriptionId, err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+
+	_, err = catacheDatabase.Collection(webhookDeliveriesCollection).UpdateMany(
+		ctx,
+		bson.M{"subscription_id": id, "status": models.WebhookDeliveryPending},
+		bson.M{"$set": bson.M{"status": models.WebhookDeliveryFailed, "last_error": "subscription deleted"}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fail deliveries of webhook subscription %s: %v", subscriptionId, err)
+	}
+	return nil
+}
+
+// InsertWebhookDeliveries queues deliveries. Queueing the deliveries of an
+// event again is a no-op.
+func InsertWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		documents = append(documents, delivery)
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookDeliveriesCollection)
+
+	// deliveries queued before for the same event are skipped, not failed
+	_, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return fmt.Errorf("failed to queue webhook deliveries: %v", err)
+	}
+	return nil
+}
+
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// ClaimDueWebhookDelivery leases the pending delivery due the earliest.
+func ClaimDueWebhookDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.WebhookDelivery, bool, error) {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookDeliveriesCollection)
+
+	filter := bson.M{"status": models.WebhookDeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}
+	claimOptions := options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1})
+
+	var delivery models.WebhookDelivery
+	err := collection.FindOneAndUpdate(ctx, filter, update, claimOptions).Decode(&delivery)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return delivery, false, nil
+	}
+	if err != nil {
+		return delivery, false, fmt.Errorf("failed to claim webhook delivery: %v", err)
+	}
+	return delivery, true, nil
+}
+
+// RecordWebhookDeliveryAttempt saves the outcome of an attempt.
+func RecordWebhookDeliveryAttempt(ctx context.Context, delivery models.WebhookDelivery) error {
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookDeliveriesCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"id": delivery.Id}, bson.M{"$set": bson.M{
+		"status":           delivery.Status,
+		"attempts":         delivery.Attempts,
+		"next_attempt_at":  delivery.NextAttemptAt,
+		"last_attempt_at":  delivery.LastAttemptAt,
+		"last_status_code": delivery.LastStatusCode,
+		"last_error":       delivery.LastError,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery %s: %v", delivery.Id, err)
+	}
+	return nil
+}
+
+// FindWebhookDeliveries returns the delivery log of a subscription, newest
+// first, optionally only the deliveries of one status.
+func FindWebhookDeliveries(
+	ctx context.Context,
+	subscriptionId string,
+	status models.WebhookDeliveryStatus,
+	limit int64,
+) ([]models.WebhookDelivery, error) {
+	id, err := parseId("webhook", subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"subscription_id": id}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookDeliveriesCollection)
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "date_created", Value: -1}}).SetLimit(limit)
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find webhook deliveries: %v", err)
+	}
+	defer func() {
+		if err := cursor.Close(ctx); err != nil {
+			logrus.Errorf("failed to close cursor: %v", err)
+		}
+	}()
+
+	var deliveries []models.WebhookDelivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// ReplayWebhookDeliveries queues failed deliveries of a subscription again
+// with fresh attempts, only the one given when deliveryId is set, and returns
+// how many were queued.
+func ReplayWebhookDeliveries(ctx context.Context, subscriptionId, deliveryId string) (int64, error) {
+	id, err := parseId("webhook", subscriptionId)
+	if err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{"subscription_id": id, "status": models.WebhookDeliveryFailed}
+	if deliveryId != "" {
+		delivery, err := parseId("delivery", deliveryId)
+		if err != nil {
+			return 0, err
+		}
+		filter["id"] = delivery
+	}
+
+	catacheDatabase := MongodbClient.Database("catache")
+	collection := catacheDatabase.Collection(webhookDeliveriesCollection)
+
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{
+		"status":          models.WebhookDeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now().UTC(),
+	}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay webhook deliveries: %v", err)
+	}
+	if deliveryId != "" && result.ModifiedCount == 0 {
+		return 0, ErrWebhookDeliveryNotFound
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,85 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/gif" // registers GIF with image.Decode
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxPixels bounds the images that get decoded for thumbnails, so that a small
+// file cannot claim gigabytes of memory.
+const MaxPixels = 40_000_000
+
+// ThumbnailSizes are the longest sides thumbnails are scaled to, by name.
+var ThumbnailSizes = []struct {
+	Name    string
+	MaxSide int
+}{
+	{Name: "small", MaxSide: 160},
+	{Name: "medium", MaxSide: 480},
+	{Name: "large", MaxSide: 1024},
+}
+
+func Dimensions(data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image dimensions: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+func Decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img, nil
+}
+
+// Scale fits img within a maxSide square, keeping its aspect ratio. ok is
+// false when img already fits.
+func Scale(img image.Image, maxSide int) (scaled image.Image, ok bool) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img, false
+	}
+
+	if width >= height {
+		width, height = maxSide, height*maxSide/width
+	} else {
+		width, height = width*maxSide/height, maxSide
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst, true
+}
+
+// Encode writes a thumbnail as JPEG for photos and as PNG otherwise, which
+// keeps transparency. It returns the content type used.
+func Encode(img image.Image, sourceContentType string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	contentType := "image/png"
+	if sourceContentType == "image/jpeg" {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), contentType, nil
+}
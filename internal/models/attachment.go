@@ -0,0 +1,86 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"strconv"
+	"time"
+)
+
+type AttachmentStatus string
+
+const (
+	AttachmentUploading AttachmentStatus = "uploading" // a resumable upload still receiving parts
+	AttachmentReady     AttachmentStatus = "ready"
+)
+
+// Attachment describes an uploaded file whose bytes live in the blob backend.
+type Attachment struct {
+	Id             uuid.UUID        `bson:"id"                     json:"id"`
+	OwnerAccountId uuid.UUID        `bson:"owner_account_id"       json:"owner_account_id"`
+	FileName       string           `bson:"file_name"              json:"file_name"`
+	ContentType    string           `bson:"content_type"           json:"content_type"` // sniffed from the bytes
+	Size           int64            `bson:"size"                   json:"size"`         // declared up front by resumable uploads
+	Sha256         string           `bson:"sha256"                 json:"sha256,omitempty"`
+	Status         AttachmentStatus `bson:"status"                 json:"status"`
+	Parts          map[string]int64 `bson:"parts,omitempty"        json:"parts,omitempty"` // sizes of the received parts by part number
+	DateCreated    time.Time        `bson:"date_created"           json:"date_created"`
+	Width          int              `bson:"width,omitempty"        json:"width,omitempty"` // images only, once processed
+	Height         int              `bson:"height,omitempty"       json:"height,omitempty"`
+	Thumbnails     []Thumbnail      `bson:"thumbnails,omitempty"   json:"thumbnails,omitempty"`
+	ProcessedAt    *time.Time       `bson:"processed_at,omitempty" json:"processed_at,omitempty"`
+}
+
+// Thumbnail is a downscaled copy of an image attachment.
+type Thumbnail struct {
+	Name        string `bson:"name"         json:"name"` // small, medium or large
+	Width       int    `bson:"width"        json:"width"`
+	Height      int    `bson:"height"       json:"height"`
+	ContentType string `bson:"content_type" json:"content_type"`
+	Size        int64  `bson:"size"         json:"size"`
+}
+
+// IsImageType reports whether the engine processes files of the content type.
+func IsImageType(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// AwaitingProcessing reports an image that must not be downloaded until its
+// metadata has been stripped.
+func (a Attachment) AwaitingProcessing() bool {
+	return IsImageType(a.ContentType) && a.ProcessedAt == nil
+}
+
+func (a Attachment) Thumbnail(name string) (Thumbnail, bool) {
+	for _, thumbnail := range a.Thumbnails {
+		if thumbnail.Name == name {
+			return thumbnail, true
+		}
+	}
+	return Thumbnail{}, false
+}
+
+func (a Attachment) StorageKey() string {
+	return "attachments/" + a.Id.String()
+}
+
+func (a Attachment) ThumbnailStorageKey(name string) string {
+	return "thumbnails/" + a.Id.String() + "/" + name
+}
+
+func (a Attachment) PartStorageKey(partNumber int) string {
+	return "uploads/" + a.Id.String() + "/" + strconv.Itoa(partNumber)
+}
+
+// File is how a message references the attachment.
+func (a Attachment) File() File {
+	return File{
+		AttachmentId: a.Id,
+		FileName:     a.FileName,
+		FileType:     a.ContentType,
+		Size:         a.Size,
+	}
+}
@@ -1,6 +1,25 @@
 package models
 
 type Channel struct {
-	Id      string
-	Clients []string
+	Id         string   `json:"id"`
+	Clients    []string `json:"clients"`
+	Moderators []string `json:"moderators"` // accounts allowed to delete and restore any message
+}
+
+func (c Channel) IsModerator(accountId string) bool {
+	for _, moderator := range c.Moderators {
+		if moderator == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Channel) HasClient(accountId string) bool {
+	for _, client := range c.Clients {
+		if client == accountId {
+			return true
+		}
+	}
+	return false
 }
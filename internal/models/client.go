@@ -1,19 +1,26 @@
 package models
 
 import (
-	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/util"
+	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 type Client struct {
 	ID                string
 	Conn              *websocket.Conn
 	ClientPool        *ClientPool
-	HandleMessageFunc func(message Message) error
+	HandleMessageFunc func(senderId string, message Message) (Message, error)
+	ProtocolVersion   int   // negotiated when connecting, frames are read and written in it
+	Codec             Codec // negotiated as the subprotocol when connecting
 	readMu            sync.Mutex
 	writeMu           sync.Mutex
+	backgrounded      atomic.Bool // the app reported it is in the background
 }
 
 func (c *Client) safeRead() (int, []byte, error) {
@@ -23,11 +30,16 @@ func (c *Client) safeRead() (int, []byte, error) {
 	return c.Conn.ReadMessage()
 }
 
-func (c *Client) SafeWriteJson(message Message) error {
+func (c *Client) SafeWrite(message Message) error {
+	data, err := c.Codec.Encode(message)
+	if err != nil {
+		return err
+	}
+
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
-	return c.Conn.WriteJSON(message)
+	return c.Conn.WriteMessage(c.Codec.FrameType(), data)
 }
 
 func (c *Client) Read() {
@@ -47,29 +59,76 @@ func (c *Client) Read() {
 			return
 		}
 
-		var message Message
-		err = json.Unmarshal(m, &message)
+		message, err := c.Codec.Decode(m)
 		if err != nil {
-			logrus.Errorf("error unmarshal client received message: %v", err)
+			requestId := uuid.New().String()
+			logrus.Errorf("error decoding client received message, request %s: %v", requestId, err)
+			c.Write(NewErrorMessage(c.ID, requestId, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				"message is not valid "+c.Codec.Name(),
+			)))
+		} else if err := c.checkVersion(message); err != nil {
+			requestId := uuid.New().String()
+			logrus.Debugf("rejected %s from %q, request %s: %v", message.Type, c.ID, requestId, err)
+			c.Write(c.errorReply(message, requestId, err))
 		} else {
 			// client handles the message
-			err := c.HandleMessageFunc(message)
+			outgoing, err := c.HandleMessageFunc(c.ID, message)
 
 			// we only proceed sending to other clients once it's processed
-			if err == nil {
+			if err != nil {
+				// logged by the handling under the request id it carries
+				c.Write(c.errorReply(message, util.AsAPIError(err).RequestId, err))
+			} else if outgoing.SendTo != "" {
 				// ready to send to another end client
-				c.ClientPool.SendMsgToClient(message)
+				c.ClientPool.SendMsgToClient(outgoing)
 			}
 		}
 	}
 }
 
+// checkVersion rejects frames of another protocol version than the one the
+// connection negotiated.
+func (c *Client) checkVersion(message Message) error {
+	version := message.Version
+	if version == 0 {
+		version = ProtocolV1
+	}
+	if version == c.ProtocolVersion {
+		return nil
+	}
+	return util.NewAPIError(
+		http.StatusBadRequest,
+		util.CodeInvalidRequest,
+		fmt.Sprintf("this connection speaks protocol version %d", c.ProtocolVersion),
+		util.FieldError{Field: "version", Message: fmt.Sprintf("must be %d", c.ProtocolVersion)},
+	)
+}
+
+func (c *Client) errorReply(message Message, requestId string, err error) Message {
+	reply := NewErrorMessage(c.ID, requestId, err)
+	reply.ReplyTo = message.Id
+	return reply
+}
+
+// Write writes a message to the connection in its protocol version.
 func (c *Client) Write(message Message) {
-	if err := c.SafeWriteJson(message); err != nil {
+	if err := c.SafeWrite(message.ForProtocol(c.ProtocolVersion)); err != nil {
 		logrus.Errorf("failed to write to client %s: %v", c.ID, err)
 	}
 }
 
+// Backgrounded reports whether the app behind the connection is in the
+// background, where messages written to it may go unseen.
+func (c *Client) Backgrounded() bool {
+	return c.backgrounded.Load()
+}
+
+func (c *Client) SetBackgrounded(backgrounded bool) {
+	c.backgrounded.Store(backgrounded)
+}
+
 func (c *Client) Leave() {
 	c.ClientPool.Unregister <- c
 }
@@ -78,7 +137,8 @@ func NewClient(
 	clientId string,
 	conn *websocket.Conn,
 	ClientPool *ClientPool,
-	HandleMessageFunc func(message Message) error,
+	HandleMessageFunc func(senderId string, message Message) (Message, error),
+	protocolVersion int,
 ) *Client {
 	logrus.Infof("creating client %s", clientId)
 	return &Client{
@@ -86,5 +146,7 @@ func NewClient(
 		Conn:              conn,
 		ClientPool:        ClientPool,
 		HandleMessageFunc: HandleMessageFunc,
+		ProtocolVersion:   protocolVersion,
+		Codec:             CodecFor(conn.Subprotocol()),
 	}
 }
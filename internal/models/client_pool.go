@@ -25,18 +25,24 @@ func (ClientPool *ClientPool) Start(wg *sync.WaitGroup) {
 	for {
 		select {
 		case client := <-ClientPool.Register:
+			ClientPool.rwMutex.Lock()
 			ClientPool.Clients[client.ID] = client
-			break
+			ClientPool.rwMutex.Unlock()
 		case client := <-ClientPool.Unregister:
-			delete(ClientPool.Clients, client.ID)
-			break
+			// a connection closing after its account reconnected leaves the
+			// new one registered
+			ClientPool.rwMutex.Lock()
+			if ClientPool.Clients[client.ID] == client {
+				delete(ClientPool.Clients, client.ID)
+			}
+			ClientPool.rwMutex.Unlock()
 		}
 	}
 }
 
 func (ClientPool *ClientPool) GetTheClient(clientId string) *Client {
-	ClientPool.rwMutex.Lock()
-	defer ClientPool.rwMutex.Unlock()
+	ClientPool.rwMutex.RLock()
+	defer ClientPool.rwMutex.RUnlock()
 
 	if client, ok := ClientPool.Clients[clientId]; ok {
 		return client
@@ -45,12 +51,51 @@ func (ClientPool *ClientPool) GetTheClient(clientId string) *Client {
 	return nil
 }
 
+// SendMsgToClient writes the message to its SendTo client if it is online.
+// Like SendMsgToClients and Broadcast, it writes after releasing the pool's
+// lock, so a slow connection does not hold up registering and unregistering
+// clients; every client serializes its own writes.
 func (ClientPool *ClientPool) SendMsgToClient(message Message) {
-	ClientPool.rwMutex.Lock()
-	defer ClientPool.rwMutex.Unlock()
-
-	foundClient := ClientPool.Clients[message.SendTo]
+	foundClient := ClientPool.GetTheClient(message.SendTo)
 	if foundClient != nil {
 		foundClient.Write(message)
 	}
 }
+
+// SendMsgToClients writes the message to every online client in clientIds and
+// returns the ids that are not currently connected.
+func (ClientPool *ClientPool) SendMsgToClients(clientIds []string, message Message) []string {
+	ClientPool.rwMutex.RLock()
+	online := make([]*Client, 0, len(clientIds))
+	var offline []string
+	for _, clientId := range clientIds {
+		foundClient := ClientPool.Clients[clientId]
+		if foundClient == nil {
+			offline = append(offline, clientId)
+			continue
+		}
+		online = append(online, foundClient)
+	}
+	ClientPool.rwMutex.RUnlock()
+
+	for _, client := range online {
+		message.SendTo = client.ID
+		client.Write(message)
+	}
+	return offline
+}
+
+// Broadcast writes the message to every connected client.
+func (ClientPool *ClientPool) Broadcast(message Message) {
+	ClientPool.rwMutex.RLock()
+	clients := make([]*Client, 0, len(ClientPool.Clients))
+	for _, client := range ClientPool.Clients {
+		clients = append(clients, client)
+	}
+	ClientPool.rwMutex.RUnlock()
+
+	for _, client := range clients {
+		message.SendTo = client.ID
+		client.Write(message)
+	}
+}
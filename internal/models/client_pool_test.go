@@ -0,0 +1,60 @@
+package models
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestClientPoolRegistersWhileLookedUp(t *testing.T) {
+	pool := NewClientPool()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pool.Start(&wg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client := &Client{ID: strconv.Itoa(i)}
+			pool.Register <- client
+			pool.Unregister <- client
+		}
+		pool.Register <- &Client{ID: "last"}
+	}()
+
+	for {
+		select {
+		case <-done:
+			// Start handles the last registration before taking the next one
+			pool.Register <- &Client{ID: "sync"}
+			if pool.GetTheClient("last") == nil {
+				t.Error("the last client registered is not found")
+			}
+			if offline := pool.SendMsgToClients([]string{"0", "1"}, Message{}); len(offline) != 2 {
+				t.Errorf("unregistered clients are not offline: %q", offline)
+			}
+			return
+		default:
+			pool.GetTheClient("0")
+			pool.SendMsgToClients([]string{"never-registered"}, Message{})
+		}
+	}
+}
+
+func TestClientPoolKeepsReconnectedClients(t *testing.T) {
+	pool := NewClientPool()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pool.Start(&wg)
+
+	closing, reconnected := &Client{ID: "a"}, &Client{ID: "a"}
+	pool.Register <- closing
+	pool.Register <- reconnected
+	pool.Unregister <- closing
+	pool.Register <- &Client{ID: "sync"}
+
+	if pool.GetTheClient("a") != reconnected {
+		t.Error("the closing connection unregistered the one its account reconnected with")
+	}
+}
@@ -0,0 +1,406 @@
+package models
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec encodes the frames of a connection in the format the client chose as
+// the WebSocket subprotocol when connecting. The binary formats carry the same
+// data as JSON, ids and timestamps included, so payloads look the same to the
+// handlers and match the published schemas whatever the format.
+type Codec interface {
+	Name() string   // the subprotocol it is negotiated as
+	FrameType() int // websocket.TextMessage or websocket.BinaryMessage
+	Encode(message Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+// Codecs are the formats the engine speaks, JSON being the default for
+// clients not asking for a subprotocol.
+var Codecs = []Codec{JSONCodec{}, MsgpackCodec{}, ProtobufCodec{}}
+
+// CodecFor returns the codec negotiated as subprotocol.
+func CodecFor(subprotocol string) Codec {
+	for _, codec := range Codecs {
+		if codec.Name() == subprotocol {
+			return codec
+		}
+	}
+	return JSONCodec{}
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (JSONCodec) Encode(message Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (JSONCodec) Decode(data []byte) (Message, error) {
+	var message Message
+	err := json.Unmarshal(data, &message)
+	return message, err
+}
+
+type MsgpackCodec struct{}
+
+// msgpackEnvelope is a Message as MessagePack, with its payload as plainPayload
+// renders it.
+type msgpackEnvelope struct {
+	Version int                    `msgpack:"version,omitempty"`
+	Id      string                 `msgpack:"id,omitempty"`
+	ReplyTo string                 `msgpack:"reply_to,omitempty"`
+	Type    string                 `msgpack:"type"`
+	SendTo  string                 `msgpack:"send_to"`
+	Payload map[string]interface{} `msgpack:"payload"`
+}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (MsgpackCodec) Encode(message Message) ([]byte, error) {
+	payload, err := plainPayload(message.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(msgpackEnvelope{
+		Version: message.Version,
+		Id:      message.Id,
+		ReplyTo: message.ReplyTo,
+		Type:    message.Type,
+		SendTo:  message.SendTo,
+		Payload: payload,
+	})
+}
+
+func (MsgpackCodec) Decode(data []byte) (Message, error) {
+	var envelope msgpackEnvelope
+	if err := msgpack.Unmarshal(data, &envelope); err != nil {
+		return Message{}, err
+	}
+
+	// MessagePack has integers of every size where JSON only has numbers
+	payload, err := plainPayload(envelope.Payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Version: envelope.Version,
+		Id:      envelope.Id,
+		ReplyTo: envelope.ReplyTo,
+		Type:    envelope.Type,
+		SendTo:  envelope.SendTo,
+		Payload: payload,
+	}, nil
+}
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative envelope.proto
+
+// ProtobufCodec writes messages as the Envelope of envelope.proto, with the
+// payload as a google.protobuf.Struct.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (ProtobufCodec) Encode(message Message) ([]byte, error) {
+	envelope := &Envelope{
+		Version: int32(message.Version),
+		Id:      message.Id,
+		ReplyTo: message.ReplyTo,
+		Type:    message.Type,
+		SendTo:  message.SendTo,
+	}
+	if message.Payload != nil {
+		payload, err := plainPayload(message.Payload)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Payload, err = structpb.NewStruct(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %v", err)
+		}
+	}
+	return proto.Marshal(envelope)
+}
+
+func (ProtobufCodec) Decode(data []byte) (Message, error) {
+	var envelope Envelope
+	if err := proto.Unmarshal(data, &envelope); err != nil {
+		return Message{}, err
+	}
+
+	message := Message{
+		Version: int(envelope.Version),
+		Id:      envelope.Id,
+		ReplyTo: envelope.ReplyTo,
+		Type:    envelope.Type,
+		SendTo:  envelope.SendTo,
+	}
+	if envelope.Payload != nil {
+		message.Payload = envelope.Payload.AsMap()
+	}
+	return message, nil
+}
+
+// plainPayload renders a payload, which may hold any type encoding/json can
+// marshal, as the maps, slices, strings, float64s and bools encoding/json
+// decodes it to, so it reads the same in every format. Values are walked as
+// encoding/json walks them, by their json tags and text marshalers, without
+// encoding them.
+func plainPayload(payload map[string]interface{}) (map[string]interface{}, error) {
+	if payload == nil {
+		return nil, nil
+	}
+
+	plain, err := plainValue(reflect.ValueOf(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %v", err)
+	}
+	return plain.(map[string]interface{}), nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func plainValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, nil
+	}
+
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return string(text), nil
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		// only the type knows its JSON, no payload type has one of its own
+		data, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		var plain interface{}
+		err = json.Unmarshal(data, &plain)
+		return plain, err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return plainValue(v.Elem())
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("unsupported value: %v", f)
+		}
+		return f, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return base64.StdEncoding.EncodeToString(v.Bytes()), nil
+		}
+		plain := make([]interface{}, v.Len())
+		for i := range plain {
+			element, err := plainValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			plain[i] = element
+		}
+		return plain, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		plain := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := plainKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			plain[key], err = plainValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return plain, nil
+	case reflect.Struct:
+		plain := map[string]interface{}{}
+		for _, field := range jsonFields(v.Type()) {
+			value, ok := fieldByIndex(v, field.index)
+			if !ok || field.omitEmpty && isEmptyValue(value) {
+				continue
+			}
+			element, err := plainValue(value)
+			if err != nil {
+				return nil, err
+			}
+			plain[field.name] = element
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", v.Type())
+}
+
+// plainKey renders a map key as encoding/json does.
+func plainKey(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if key.Type().Implements(textMarshalerType) {
+		text, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type: %s", key.Type())
+}
+
+type jsonField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// jsonFieldsCache holds the []jsonField of every struct type walked.
+var jsonFieldsCache sync.Map
+
+// jsonFields lists the fields encoding/json writes for a struct type, the
+// fields of embedded structs included unless an outer field has their name.
+func jsonFields(t reflect.Type) []jsonField {
+	if fields, ok := jsonFieldsCache.Load(t); ok {
+		return fields.([]jsonField)
+	}
+
+	var fields, embedded []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			for _, inner := range jsonFields(fieldType) {
+				inner.index = append([]int{i}, inner.index...)
+				embedded = append(embedded, inner)
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+
+	for _, inner := range embedded {
+		shadowed := false
+		for _, field := range fields {
+			shadowed = shadowed || field.name == inner.name
+		}
+		if !shadowed {
+			fields = append(fields, inner)
+		}
+	}
+
+	jsonFieldsCache.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, reporting fields behind a nil
+// embedded pointer as missing rather than panicking.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, fieldIndex := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(fieldIndex)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether omitempty leaves v out.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
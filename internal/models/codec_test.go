@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPayload() map[string]interface{} {
+	editedAt := time.Date(2026, 10, 19, 11, 15, 46, 123456789, time.UTC)
+	return map[string]interface{}{
+		"message": ChannelMessage{
+			MessageId:       uuid.New(),
+			AuthorAccountId: uuid.New(),
+			ChannelId:       uuid.New(),
+			DateCreated:     editedAt.Add(-time.Hour),
+			Content: Content{
+				Text:     "hi <@0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11>",
+				Entities: []Entity{{Type: EntityMention, Offset: 3, Length: 39, Value: "0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11"}},
+			},
+			Files:    []File{{AttachmentId: uuid.New(), FileName: "a.png", FileType: "image/png", Size: 1024}},
+			EditedAt: &editedAt,
+		},
+		"duplicate":  false,
+		"counts":     map[int]uint8{1: 2},
+		"thumbnail":  []byte{0, 1, 2},
+		"no_message": (*ChannelMessage)(nil),
+	}
+}
+
+func TestPlainPayloadMatchesJSON(t *testing.T) {
+	payload := testPayload()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want map[string]interface{}
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := plainPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plain payload is\n%#v\nwant as JSON has it\n%#v", got, want)
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	message := Message{
+		Version: ProtocolV2,
+		Id:      uuid.NewString(),
+		ReplyTo: uuid.NewString(),
+		Type:    "NEW_CHANNEL_MESSAGE",
+		SendTo:  uuid.NewString(),
+		Payload: testPayload(),
+	}
+	want, err := plainPayload(message.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range Codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			data, err := codec.Encode(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := codec.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decoded.Payload, want) {
+				t.Errorf("decoded payload is\n%#v\nwant\n%#v", decoded.Payload, want)
+			}
+			decoded.Payload = message.Payload
+			if !reflect.DeepEqual(decoded, message) {
+				t.Errorf("decoded %+v, want %+v", decoded, message)
+			}
+		})
+	}
+}
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	for _, test := range []struct {
+		offered []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"mqtt", "protobuf", "msgpack"}, "protobuf"},
+		{[]string{"msgpack", "json"}, "msgpack"},
+		{[]string{"mqtt"}, ""},
+	} {
+		if got := negotiateSubprotocol(test.offered); got != test.want {
+			t.Errorf("offered %q, negotiated %q, want %q", test.offered, got, test.want)
+		}
+		if codec := CodecFor(test.want); test.want != "" && codec.Name() != test.want {
+			t.Errorf("the codec for %q is %s", test.want, codec.Name())
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"html"
+	"messaging-engine/internal/util"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMaxContentLength = 4000
+	ExcerptLength           = 140 // of the plaintext shown in inboxes and notifications
+)
+
+type EntityType string
+
+const (
+	EntityMention   EntityType = "mention"    // <@account_id>, @channel or @here
+	EntityChannel   EntityType = "channel"    // <#channel_id>
+	EntityURL       EntityType = "url"        // http and https only
+	EntityCode      EntityType = "code"       // `inline code`
+	EntityCodeBlock EntityType = "code_block" // ```fenced code```
+	EntityEmoji     EntityType = "emoji"      // a Unicode emoji or a :short_code:
+)
+
+// values of a mention entity that address a whole channel rather than an account
+const (
+	MentionChannel = "channel" // every client of the channel
+	MentionHere    = "here"    // the clients of the channel that are online
+)
+
+// Entity marks a span of the text. Offsets and lengths count code points.
+type Entity struct {
+	Type   EntityType `bson:"type"   json:"type"`
+	Offset int        `bson:"offset" json:"offset"`
+	Length int        `bson:"length" json:"length"`
+	Value  string     `bson:"value"  json:"value"` // the account or channel id, url, code or emoji
+}
+
+// Content is the body of a message. Clients send the text, the entities are
+// always parsed by the server, and the renderings are only filled in for
+// history responses.
+type Content struct {
+	Text      string   `bson:"text"               json:"text"                mapstructure:"text"`
+	Entities  []Entity `bson:"entities,omitempty" json:"entities,omitempty"  mapstructure:"-"`
+	HTML      string   `bson:"-"                  json:"html,omitempty"      mapstructure:"-"`
+	Plaintext string   `bson:"-"                  json:"plaintext,omitempty" mapstructure:"-"`
+}
+
+var (
+	codeBlockPattern = regexp.MustCompile("(?s)```(.+?)```")
+	codeSpanPattern  = regexp.MustCompile("`([^`\n]+)`")
+	mentionPattern   = regexp.MustCompile(`<@([0-9a-fA-F-]{36})>`)
+	broadcastPattern = regexp.MustCompile(`\B@(channel|here)\b`)
+	channelPattern   = regexp.MustCompile(`<#([0-9a-fA-F-]{36})>`)
+	urlPattern       = regexp.MustCompile(`https?://[^\s<>]+`)
+
+	boldPattern   = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	strikePattern = regexp.MustCompile(`~~(.+?)~~`)
+	italicPattern = regexp.MustCompile(`\*([^*\s][^*]*?)\*`)
+)
+
+// ParseContent validates text and finds its entities. Code is matched first,
+// and nothing inside code is an entity of its own.
+func ParseContent(text string, maxLength int) (Content, error) {
+	if !utf8.ValidString(text) {
+		return Content{}, errors.New("content is not valid UTF-8")
+	}
+	if utf8.RuneCountInString(text) > maxLength {
+		return Content{}, fmt.Errorf("content is longer than %d characters", maxLength)
+	}
+
+	p := &contentParser{text: text, claimed: make([]bool, len(text))}
+	p.match(codeBlockPattern, EntityCodeBlock, func(value string) (string, bool) { return value, true })
+	p.match(codeSpanPattern, EntityCode, func(value string) (string, bool) { return value, true })
+	p.match(mentionPattern, EntityMention, validId)
+	p.match(broadcastPattern, EntityMention, func(value string) (string, bool) { return value, true })
+	p.match(channelPattern, EntityChannel, validId)
+	p.matchURLs()
+	p.match(contentShortCodePattern, EntityEmoji, func(value string) (string, bool) { return ":" + value + ":", true })
+	p.matchUnicodeEmoji()
+
+	sort.Slice(p.entities, func(i, j int) bool { return p.entities[i].Offset < p.entities[j].Offset })
+	return Content{Text: text, Entities: p.entities}, nil
+}
+
+func validId(value string) (string, bool) {
+	id, err := uuid.Parse(value)
+	return id.String(), err == nil
+}
+
+// JSONSchema accepts the text on its own as well, as clients usually send it.
+func (c Content) JSONSchema() *util.Schema {
+	text := &util.Schema{
+		Type:                 "object",
+		Properties:           map[string]*util.Schema{"text": {Type: "string"}},
+		Required:             []string{"text"},
+		AdditionalProperties: new(bool),
+	}
+	return &util.Schema{OneOf: []*util.Schema{{Type: "string"}, text}}
+}
+
+// Equal compares the text only, since entities are derived from it.
+func (c Content) Equal(other Content) bool {
+	return c.Text == other.Text
+}
+
+// CustomEmojiShortCodes lists the short codes of the custom emoji used.
+func (c Content) CustomEmojiShortCodes() []string {
+	var shortCodes []string
+	for _, entity := range c.Entities {
+		if shortCode, ok := CustomEmojiShortCode(entity.Value); entity.Type == EntityEmoji && ok {
+			shortCodes = append(shortCodes, shortCode)
+		}
+	}
+	return shortCodes
+}
+
+// Excerpt shortens the plaintext rendering to ExcerptLength characters.
+func (c Content) Excerpt() string {
+	excerpt := []rune(c.Rendered().Plaintext)
+	if len(excerpt) > ExcerptLength {
+		return string(excerpt[:ExcerptLength-1]) + "…"
+	}
+	return string(excerpt)
+}
+
+// Mentions lists the accounts mentioned by id, and whether the whole channel
+// or its online clients were mentioned.
+func (c Content) Mentions() (accountIds []string, channel, here bool) {
+	for _, entity := range c.Entities {
+		if entity.Type != EntityMention {
+			continue
+		}
+		switch entity.Value {
+		case MentionChannel:
+			channel = true
+		case MentionHere:
+			here = true
+		default:
+			accountIds = append(accountIds, entity.Value)
+		}
+	}
+	return accountIds, channel, here
+}
+
+type contentParser struct {
+	text     string
+	claimed  []bool // bytes already covered by an entity
+	entities []Entity
+}
+
+// claim records an entity over text[start:end] unless it overlaps another.
+func (p *contentParser) claim(start, end int, entityType EntityType, value string) bool {
+	for i := start; i < end; i++ {
+		if p.claimed[i] {
+			return false
+		}
+	}
+	for i := start; i < end; i++ {
+		p.claimed[i] = true
+	}
+
+	p.entities = append(p.entities, Entity{
+		Type:   entityType,
+		Offset: utf8.RuneCountInString(p.text[:start]),
+		Length: utf8.RuneCountInString(p.text[start:end]),
+		Value:  value,
+	})
+	return true
+}
+
+// match claims every match of pattern whose first group the value func accepts.
+func (p *contentParser) match(pattern *regexp.Regexp, entityType EntityType, value func(string) (string, bool)) {
+	for _, loc := range pattern.FindAllStringSubmatchIndex(p.text, -1) {
+		if v, ok := value(p.text[loc[2]:loc[3]]); ok {
+			p.claim(loc[0], loc[1], entityType, v)
+		}
+	}
+}
+
+func (p *contentParser) matchURLs() {
+	for _, loc := range urlPattern.FindAllStringIndex(p.text, -1) {
+		// punctuation ending a sentence is not part of the url
+		end := loc[1]
+		for end > loc[0] && strings.ContainsRune(".,;:!?)]'\"", rune(p.text[end-1])) {
+			end--
+		}
+		p.claim(loc[0], end, EntityURL, p.text[loc[0]:end])
+	}
+}
+
+// matchUnicodeEmoji claims emoji sequences: a base joined to further bases by
+// zero width joiners, with modifiers, or a keycap. Symbols that are text by
+// default only count when followed by the emoji presentation selector.
+func (p *contentParser) matchUnicodeEmoji() {
+	runeAt := func(i int) (rune, int) {
+		if i >= len(p.text) {
+			return utf8.RuneError, 0
+		}
+		return utf8.DecodeRuneInString(p.text[i:])
+	}
+
+	for i := 0; i < len(p.text); {
+		r, size := runeAt(i)
+		start, end := i, i+size
+		i = end
+
+		next, nextSize := runeAt(end)
+		switch {
+		case (r >= '0' && r <= '9') || r == '#' || r == '*':
+			if next == 0xFE0F {
+				end += nextSize
+				next, nextSize = runeAt(end)
+			}
+			if next != 0x20E3 {
+				continue
+			}
+			end += nextSize
+
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			// a flag is a pair of regional indicators
+			if next >= 0x1F1E6 && next <= 0x1F1FF {
+				end += nextSize
+			}
+			end = p.emojiTail(end)
+
+		case r >= 0x1F000 && isEmojiBase(r):
+			end = p.emojiTail(end)
+
+		case isEmojiBase(r) && next == 0xFE0F:
+			end = p.emojiTail(end)
+
+		default:
+			continue
+		}
+
+		if p.claim(start, end, EntityEmoji, p.text[start:end]) {
+			i = end
+		}
+	}
+}
+
+// emojiTail extends an emoji sequence past its modifiers and joined bases.
+func (p *contentParser) emojiTail(end int) int {
+	for end < len(p.text) {
+		r, size := utf8.DecodeRuneInString(p.text[end:])
+		switch {
+		case r == 0xFE0F, r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F:
+			end += size
+		case r == 0x200D:
+			joined, joinedSize := utf8.DecodeRuneInString(p.text[end+size:])
+			if !isEmojiBase(joined) {
+				return end
+			}
+			end += size + joinedSize
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+// Rendered fills in the sanitized HTML and plaintext renderings.
+func (c Content) Rendered() Content {
+	c.HTML = c.render(renderHTMLEntity, renderHTMLText)
+	c.Plaintext = c.render(renderPlaintextEntity, renderPlaintextText)
+	return c
+}
+
+func (c Content) render(entity func(Entity, string) string, text func(string) string) string {
+	runes := []rune(c.Text)
+
+	var b strings.Builder
+	pos := 0
+	for _, e := range c.Entities {
+		if e.Offset < pos || e.Offset+e.Length > len(runes) {
+			continue
+		}
+		b.WriteString(text(string(runes[pos:e.Offset])))
+		b.WriteString(entity(e, string(runes[e.Offset:e.Offset+e.Length])))
+		pos = e.Offset + e.Length
+	}
+	b.WriteString(text(string(runes[pos:])))
+
+	return b.String()
+}
+
+// renderHTMLText escapes plain text, then applies the markdown emphasis, which
+// escaping leaves intact.
+func renderHTMLText(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = boldPattern.ReplaceAllString(escaped, "<strong>$1</strong>")
+	escaped = strikePattern.ReplaceAllString(escaped, "<del>$1</del>")
+	escaped = italicPattern.ReplaceAllString(escaped, "<em>$1</em>")
+	return strings.ReplaceAll(escaped, "\n", "<br>")
+}
+
+func renderHTMLEntity(e Entity, raw string) string {
+	value := html.EscapeString(e.Value)
+
+	switch e.Type {
+	case EntityMention:
+		if e.Value == MentionChannel || e.Value == MentionHere {
+			return `<span class="mention" data-broadcast="` + value + `">@` + value + `</span>`
+		}
+		return `<span class="mention" data-account-id="` + value + `">@` + value + `</span>`
+	case EntityChannel:
+		return `<span class="channel" data-channel-id="` + value + `">#` + value + `</span>`
+	case EntityURL:
+		return `<a href="` + value + `" rel="nofollow noopener noreferrer" target="_blank">` + value + `</a>`
+	case EntityCode:
+		return `<code>` + value + `</code>`
+	case EntityCodeBlock:
+		return `<pre><code>` + value + `</code></pre>`
+	case EntityEmoji:
+		if shortCode, ok := CustomEmojiShortCode(e.Value); ok {
+			return `<span class="emoji" data-short-code="` + shortCode + `">` + value + `</span>`
+		}
+	}
+	return html.EscapeString(raw)
+}
+
+func renderPlaintextText(text string) string {
+	text = boldPattern.ReplaceAllString(text, "$1")
+	text = strikePattern.ReplaceAllString(text, "$1")
+	return italicPattern.ReplaceAllString(text, "$1")
+}
+
+func renderPlaintextEntity(e Entity, raw string) string {
+	switch e.Type {
+	case EntityMention:
+		return "@" + e.Value
+	case EntityChannel:
+		return "#" + e.Value
+	case EntityCode, EntityCodeBlock:
+		return e.Value
+	}
+	return raw
+}
+
+// UnmarshalBSONValue also reads messages stored before Content existed, whose
+// content was a bare string for replies and a uuid for channel messages.
+func (c *Content) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bsontype.String:
+		text, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return errors.New("malformed legacy string content")
+		}
+		*c = Content{Text: text}
+
+	case bsontype.Binary:
+		_, b, _, ok := bsoncore.ReadBinary(data)
+		if !ok {
+			return errors.New("malformed legacy uuid content")
+		}
+		id, err := uuid.FromBytes(b)
+		if err != nil {
+			return fmt.Errorf("malformed legacy uuid content: %v", err)
+		}
+		*c = Content{}
+		if id != uuid.Nil {
+			c.Text = id.String()
+		}
+
+	case bsontype.Null, bsontype.Undefined:
+		*c = Content{}
+
+	default:
+		type plain Content
+		var p plain
+		err := bson.RawValue{Type: t, Value: data}.Unmarshal(&p)
+		if err != nil {
+			return err
+		}
+		*c = Content(p)
+	}
+
+	return nil
+}
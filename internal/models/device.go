@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+const (
+	DevicePlatformAPNs    = "apns"
+	DevicePlatformFCM     = "fcm"
+	DevicePlatformWebhook = "webhook"
+)
+
+func IsDevicePlatform(platform string) bool {
+	switch platform {
+	case DevicePlatformAPNs, DevicePlatformFCM, DevicePlatformWebhook:
+		return true
+	}
+	return false
+}
+
+// Device is a push token an account registered. A token belongs to the account
+// that registered it last.
+type Device struct {
+	AccountId      string    `bson:"account_id"      json:"account_id"`
+	Token          string    `bson:"token"           json:"token"`
+	Platform       string    `bson:"platform"        json:"platform"`
+	DateRegistered time.Time `bson:"date_registered" json:"date_registered"`
+}
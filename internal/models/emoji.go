@@ -0,0 +1,115 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ShortCodePattern is the shape of a custom emoji short code or alias. The
+// leading letter keeps times such as 10:30:45 from reading as emoji.
+var ShortCodePattern = regexp.MustCompile(`^[a-z][a-z0-9_+-]{1,31}$`)
+
+var contentShortCodePattern = regexp.MustCompile(`:([a-z][a-z0-9_+-]{1,31}):`)
+
+type CustomEmoji struct {
+	ShortCode        string    `bson:"short_code"         json:"short_code"`
+	ImageUrl         string    `bson:"image_url"          json:"image_url"`
+	CreatorAccountId uuid.UUID `bson:"creator_account_id" json:"creator_account_id"`
+	Aliases          []string  `bson:"aliases"            json:"aliases,omitempty"`
+	DateCreated      time.Time `bson:"date_created"       json:"date_created"`
+}
+
+// Names returns the short code followed by the aliases.
+func (e CustomEmoji) Names() []string {
+	return append([]string{e.ShortCode}, e.Aliases...)
+}
+
+// CustomEmojiShortCode returns the short code of a :short_code: reference.
+func CustomEmojiShortCode(code string) (string, bool) {
+	if len(code) < 2 || !strings.HasPrefix(code, ":") || !strings.HasSuffix(code, ":") {
+		return "", false
+	}
+	shortCode := code[1 : len(code)-1]
+	return shortCode, ShortCodePattern.MatchString(shortCode)
+}
+
+// IsUnicodeEmoji reports whether code is a single Unicode emoji, either as the
+// characters themselves or as an emoji-data unified code such as 1F44D-1F3FB.
+// It checks code points against the emoji blocks rather than the full emoji
+// sequence data, which is good enough to reject arbitrary text.
+func IsUnicodeEmoji(code string) bool {
+	runes, ok := unifiedCodeRunes(code)
+	if !ok {
+		if !utf8.ValidString(code) {
+			return false
+		}
+		runes = []rune(code)
+	}
+	if len(runes) == 0 || len(runes) > 16 {
+		return false
+	}
+
+	hasBase := false
+	for _, r := range runes {
+		switch {
+		case isEmojiBase(r):
+			hasBase = true
+		case isEmojiComponent(r):
+		default:
+			return false
+		}
+	}
+	return hasBase
+}
+
+func unifiedCodeRunes(code string) ([]rune, bool) {
+	var runes []rune
+	for _, part := range strings.Split(code, "-") {
+		if len(part) < 4 || len(part) > 6 {
+			return nil, false
+		}
+		r, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return nil, false
+		}
+		runes = append(runes, rune(r))
+	}
+	return runes, true
+}
+
+func isEmojiBase(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // pictographs, emoticons, transport, flags
+		r >= 0x2600 && r <= 0x27BF, // misc symbols and dingbats
+		r >= 0x2300 && r <= 0x23FF,
+		r >= 0x2B00 && r <= 0x2BFF,
+		r >= 0x2190 && r <= 0x21FF,
+		r >= 0x25AA && r <= 0x25FE,
+		r >= 0x2934 && r <= 0x2935:
+		return true
+	}
+	switch r {
+	case 0x20E3: // keycap, whose base is a plain digit, # or *
+		return true
+	case 0x00A9, 0x00AE, 0x203C, 0x2049, 0x2122, 0x2139, 0x24C2, 0x3030, 0x303D, 0x3297, 0x3299:
+		return true
+	}
+	return false
+}
+
+// isEmojiComponent matches the code points that only modify or join emoji.
+func isEmojiComponent(r rune) bool {
+	switch {
+	case r == 0x200D, // zero width joiner
+		r == 0xFE0F,                  // emoji presentation selector
+		r >= 0x1F3FB && r <= 0x1F3FF, // skin tones
+		r >= 0xE0020 && r <= 0xE007F, // tag sequences
+		r >= '0' && r <= '9', r == '#', r == '*':
+		return true
+	}
+	return false
+}
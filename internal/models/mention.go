@@ -0,0 +1,59 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type MentionKind string
+
+const (
+	MentionKindAccount MentionKind = "account" // mentioned by id
+	MentionKindChannel MentionKind = "channel" // through @channel
+	MentionKindHere    MentionKind = "here"    // through @here
+)
+
+// Mention is an entry of an account's mention inbox. Entries are paged like
+// messages, by (date_created, message_id) of the message that mentioned.
+type Mention struct {
+	AccountId       string      `bson:"account_id"          json:"account_id"`
+	MessageId       uuid.UUID   `bson:"message_id"          json:"message_id"`
+	ChannelId       string      `bson:"channel_id"          json:"channel_id"`
+	ThreadId        string      `bson:"thread_id,omitempty" json:"thread_id,omitempty"` // set when the message is a thread reply
+	AuthorAccountId uuid.UUID   `bson:"author_account_id"   json:"author_account_id"`
+	Kind            MentionKind `bson:"kind"                json:"kind"`
+	Excerpt         string      `bson:"excerpt"             json:"excerpt"`
+	DateCreated     time.Time   `bson:"date_created"        json:"date_created"`
+	ReadAt          *time.Time  `bson:"read_at,omitempty"   json:"read_at,omitempty"`
+}
+
+func (m Mention) PageCursor() MessageCursor {
+	return MessageCursor{DateCreated: m.DateCreated, MessageId: m.MessageId}
+}
+
+// ResolveMentions decides who a message notifies and how. An account mentioned
+// by id keeps that kind even when @channel or @here also reach it. Only clients
+// of the channel are notified, @here only reaches the online ones, and authors
+// never notify themselves.
+func ResolveMentions(content Content, channel Channel, authorId string, isOnline func(string) bool) map[string]MentionKind {
+	accountIds, toChannel, toHere := content.Mentions()
+
+	recipients := map[string]MentionKind{}
+	for _, client := range channel.Clients {
+		if client == authorId {
+			continue
+		}
+		if toChannel {
+			recipients[client] = MentionKindChannel
+		} else if toHere && isOnline(client) {
+			recipients[client] = MentionKindHere
+		}
+	}
+	for _, accountId := range accountIds {
+		if accountId != authorId && channel.HasClient(accountId) {
+			recipients[accountId] = MentionKindAccount
+		}
+	}
+
+	return recipients
+}
@@ -2,44 +2,182 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"messaging-engine/internal/util"
 	"time"
 )
 
+// ErrorMessageType frames report a failed client message back to its sender.
+const ErrorMessageType = "ERROR"
+
+// File references an uploaded attachment. Only AttachmentId is taken from
+// clients, the rest is filled in from the attachment.
 type File struct {
-	FileName string `json:"file_name" mapstructure:"file_name"`
-	FileType string `json:"file_type" mapstructure:"file_type"`
+	AttachmentId uuid.UUID `json:"attachment_id" mapstructure:"attachment_id"`
+	FileName     string    `json:"file_name"     mapstructure:"file_name"`
+	FileType     string    `json:"file_type"     mapstructure:"file_type"`
+	Size         int64     `json:"size"          mapstructure:"size"`
 }
 
 // Message this is the messages sending to messaging-engine, not exactly user communicated messages
 type Message struct {
-	Type    string                 `json:"type"    mapstructure:"type"`
-	SendTo  string                 `json:"send_to" mapstructure:"send_to"`
-	Payload map[string]interface{} `json:"payload" mapstructure:"payload"`
+	Version int                    `json:"version,omitempty"  mapstructure:"version"` // of the protocol, unset in version 1
+	Id      string                 `json:"id,omitempty"       mapstructure:"id"`
+	ReplyTo string                 `json:"reply_to,omitempty" mapstructure:"reply_to"` // the id of the frame an error frame is about
+	Type    string                 `json:"type"               mapstructure:"type"`
+	SendTo  string                 `json:"send_to"            mapstructure:"send_to"`
+	Payload map[string]interface{} `json:"payload"            mapstructure:"payload"`
+}
+
+// NewErrorMessage reports err to sendTo, with the id of the request the error
+// was logged under.
+func NewErrorMessage(sendTo, requestId string, err error) Message {
+	apiErr := *util.AsAPIError(err)
+	apiErr.RequestId = requestId
+
+	return Message{
+		Type:    ErrorMessageType,
+		SendTo:  sendTo,
+		Payload: map[string]interface{}{"error": apiErr},
+	}
 }
 
 type ChannelMessage struct {
-	MessageId        uuid.UUID         `bson:"message_id"         json:"message_id"                   mapstructure:"message_id"`
-	AuthorAccountId  uuid.UUID         `bson:"author_account_id"  json:"author_account_id"            mapstructure:"author_account_id"`
-	ChannelId        uuid.UUID         `bson:"channel_id"         json:"channel_id"                   mapstructure:"channel_id"`
-	DateCreated      time.Time         `bson:"date_created"       json:"date_created"                 mapstructure:"date_created"`
-	Content          uuid.UUID         `bson:"content"            json:"content"                      mapstructure:"content"`
-	Reactions        []MessageReaction `bson:"reactions"          json:"reactions,omitempty"          mapstructure:"reactions"`
-	Files            []File            `bson:"files"              json:"files,omitempty"              mapstructure:"files"`
-	AttachedThreadId uuid.UUID         `bson:"attached_thread_id" json:"attached_thread_id,omitempty" mapstructure:"attached_thread_id"`
+	MessageId        uuid.UUID         `bson:"message_id"          json:"message_id"                   mapstructure:"message_id"`
+	AuthorAccountId  uuid.UUID         `bson:"author_account_id"   json:"author_account_id"            mapstructure:"author_account_id"`
+	ChannelId        uuid.UUID         `bson:"channel_id"          json:"channel_id"                   mapstructure:"channel_id" schema:"required"`
+	DateCreated      time.Time         `bson:"date_created"        json:"date_created"                 mapstructure:"date_created"`
+	Content          Content           `bson:"content"             json:"content"                      mapstructure:"content"`
+	Reactions        []MessageReaction `bson:"reactions"           json:"reactions,omitempty"          mapstructure:"reactions"`
+	ReactionSummary  []ReactionSummary `bson:"-"                   json:"reaction_summary,omitempty"   mapstructure:"-"`
+	Files            []File            `bson:"files"               json:"files,omitempty"              mapstructure:"files"`
+	AttachedThreadId uuid.UUID         `bson:"attached_thread_id"  json:"attached_thread_id,omitempty" mapstructure:"attached_thread_id"`
+	EditedAt         *time.Time        `bson:"edited_at,omitempty" json:"edited_at,omitempty"          mapstructure:"edited_at"`
+	Deleted          *Tombstone        `bson:"deleted,omitempty"   json:"deleted,omitempty"            mapstructure:"-"`
 }
 
 type ThreadMessage struct {
-	MessageId       uuid.UUID         `bson:"message_id"        json:"message_id"          mapstructure:"message_id"`
-	RootMessageId   uuid.UUID         `bson:"root_message_id"   json:"root_message_id"     mapstructure:"root_message_id"`
-	AuthorAccountId uuid.UUID         `bson:"author_account_id" json:"author_account_id"   mapstructure:"author_account_id"`
-	ThreadId        uuid.UUID         `bson:"thread_id"         json:"thread_id"           mapstructure:"thread_id"`
-	DateCreated     time.Time         `bson:"date_created"      json:"date_created"        mapstructure:"date_created"`
-	Content         string            `bson:"content"           json:"content"             mapstructure:"content"`
-	Reactions       []MessageReaction `bson:"reactions"         json:"reactions,omitempty" mapstructure:"reactions"`
-	Files           []File            `bson:"files"             json:"files,omitempty"     mapstructure:"files"`
+	MessageId       uuid.UUID         `bson:"message_id"          json:"message_id"                 mapstructure:"message_id"`
+	RootMessageId   uuid.UUID         `bson:"root_message_id"     json:"root_message_id"            mapstructure:"root_message_id"`
+	AuthorAccountId uuid.UUID         `bson:"author_account_id"   json:"author_account_id"          mapstructure:"author_account_id"`
+	ThreadId        uuid.UUID         `bson:"thread_id"           json:"thread_id"                  mapstructure:"thread_id" schema:"required"`
+	DateCreated     time.Time         `bson:"date_created"        json:"date_created"               mapstructure:"date_created"`
+	Content         Content           `bson:"content"             json:"content"                    mapstructure:"content"`
+	Reactions       []MessageReaction `bson:"reactions"           json:"reactions,omitempty"        mapstructure:"reactions"`
+	ReactionSummary []ReactionSummary `bson:"-"                   json:"reaction_summary,omitempty" mapstructure:"-"`
+	Files           []File            `bson:"files"               json:"files,omitempty"            mapstructure:"files"`
+	EditedAt        *time.Time        `bson:"edited_at,omitempty" json:"edited_at,omitempty"        mapstructure:"edited_at"`
+	Deleted         *Tombstone        `bson:"deleted,omitempty"   json:"deleted,omitempty"          mapstructure:"-"`
+}
+
+// Tombstone marks a soft deleted message. The message is kept, hidden from
+// history, until the purge grace period elapses.
+type Tombstone struct {
+	DeletedAt time.Time `bson:"deleted_at" json:"deleted_at"`
+	DeletedBy uuid.UUID `bson:"deleted_by" json:"deleted_by"`
+	Reason    string    `bson:"reason"     json:"reason,omitempty"`
+}
+
+// ChannelMessageRevision is a superseded version of an edited channel message.
+type ChannelMessageRevision struct {
+	ChannelId    uuid.UUID `bson:"channel_id"    json:"channel_id"`
+	MessageId    uuid.UUID `bson:"message_id"    json:"message_id"`
+	Content      Content   `bson:"content"       json:"content"`
+	Files        []File    `bson:"files"         json:"files,omitempty"`
+	DateWritten  time.Time `bson:"date_written"  json:"date_written"` // when this version was posted or edited in
+	DateReplaced time.Time `bson:"date_replaced" json:"date_replaced"`
+}
+
+// ThreadMessageRevision is a superseded version of an edited thread message.
+type ThreadMessageRevision struct {
+	ThreadId     uuid.UUID `bson:"thread_id"     json:"thread_id"`
+	MessageId    uuid.UUID `bson:"message_id"    json:"message_id"`
+	Content      Content   `bson:"content"       json:"content"`
+	Files        []File    `bson:"files"         json:"files,omitempty"`
+	DateWritten  time.Time `bson:"date_written"  json:"date_written"` // when this version was posted or edited in
+	DateReplaced time.Time `bson:"date_replaced" json:"date_replaced"`
 }
 
 type MessageReaction struct {
 	ReactorAccountId uuid.UUID `bson:"reactor_account_id" json:"reactor_account_id" mapstructure:"reactor_account_id"`
-	EmojiUnifiedCode string    `bson:"emoji_unified_code" json:"emoji_unified_code" mapstructure:"emoji_unified_code"`
+	EmojiUnifiedCode string    `bson:"emoji_unified_code" json:"emoji_unified_code" mapstructure:"emoji_unified_code" schema:"required"`
+}
+
+// SameFiles reports whether two attachment lists are identical, treating nil
+// and empty as equal.
+func SameFiles(a, b []File) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writtenAt is when the current version of a message was written.
+func writtenAt(dateCreated time.Time, editedAt *time.Time) time.Time {
+	if editedAt != nil {
+		return *editedAt
+	}
+	return dateCreated
+}
+
+func (m ChannelMessage) WrittenAt() time.Time {
+	return writtenAt(m.DateCreated, m.EditedAt)
+}
+
+func (m ThreadMessage) WrittenAt() time.Time {
+	return writtenAt(m.DateCreated, m.EditedAt)
+}
+
+// Redacted renders a deleted message as a "message deleted" placeholder.
+func (m ChannelMessage) Redacted() ChannelMessage {
+	if m.Deleted != nil {
+		m.Content, m.Files, m.Reactions = Content{}, nil, nil
+	}
+	return m
+}
+
+// Redacted renders a deleted message as a "message deleted" placeholder.
+func (m ThreadMessage) Redacted() ThreadMessage {
+	if m.Deleted != nil {
+		m.Content, m.Files, m.Reactions = Content{}, nil, nil
+	}
+	return m
+}
+
+// Summarized replaces the raw reactions with their aggregate for the viewer.
+func (m ChannelMessage) Summarized(viewerId uuid.UUID, maxReactors int) ChannelMessage {
+	m.ReactionSummary = SummarizeReactions(m.Reactions, viewerId, maxReactors)
+	m.Reactions = nil
+	return m
+}
+
+// Summarized replaces the raw reactions with their aggregate for the viewer.
+func (m ThreadMessage) Summarized(viewerId uuid.UUID, maxReactors int) ThreadMessage {
+	m.ReactionSummary = SummarizeReactions(m.Reactions, viewerId, maxReactors)
+	m.Reactions = nil
+	return m
+}
+
+// Rendered adds the HTML and plaintext renderings of the content.
+func (m ChannelMessage) Rendered() ChannelMessage {
+	m.Content = m.Content.Rendered()
+	return m
+}
+
+// Rendered adds the HTML and plaintext renderings of the content.
+func (m ThreadMessage) Rendered() ThreadMessage {
+	m.Content = m.Content.Rendered()
+	return m
+}
+
+func (m ChannelMessage) PageCursor() MessageCursor {
+	return MessageCursor{DateCreated: m.DateCreated, MessageId: m.MessageId}
+}
+
+func (m ThreadMessage) PageCursor() MessageCursor {
+	return MessageCursor{DateCreated: m.DateCreated, MessageId: m.MessageId}
 }
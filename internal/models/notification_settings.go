@@ -0,0 +1,185 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type NotificationLevel string
+
+const (
+	NotifyAll      NotificationLevel = "all"      // every message, the default
+	NotifyMentions NotificationLevel = "mentions" // mentions and keyword alerts only
+	NotifyNone     NotificationLevel = "none"     // nothing is pushed, the channel is muted
+)
+
+// NotificationReason is why an account would be notified of a message.
+type NotificationReason string
+
+const (
+	NotifyForMessage NotificationReason = "message" // a direct recipient or a thread follower
+	NotifyForMention NotificationReason = "mention"
+	NotifyForKeyword NotificationReason = "keyword"
+)
+
+const (
+	MaxQuietHours    = 10
+	MaxKeywords      = 50
+	MaxKeywordLength = 50
+	MaxMutedThreads  = 1000
+	quietHoursLayout = "15:04"
+)
+
+// QuietHours is a daily do-not-disturb window in the account's time zone. A
+// window whose end is before its start runs over midnight.
+type QuietHours struct {
+	Start    string `bson:"start"     json:"start"`     // HH:MM
+	End      string `bson:"end"       json:"end"`       // HH:MM
+	TimeZone string `bson:"time_zone" json:"time_zone"` // an IANA name such as Europe/Paris
+}
+
+// NotificationSettings decide which messages an account is pushed
+// notifications of. An account that never saved any has the zero settings,
+// notified of everything.
+type NotificationSettings struct {
+	AccountId     string                       `bson:"account_id"     json:"account_id"`
+	DoNotDisturb  []QuietHours                 `bson:"do_not_disturb" json:"do_not_disturb"`
+	ChannelLevels map[string]NotificationLevel `bson:"channel_levels" json:"channel_levels"` // by channel id, all when missing
+	MutedThreads  []string                     `bson:"muted_threads"  json:"muted_threads"`
+	Keywords      []string                     `bson:"keywords"       json:"keywords"` // alert on messages of any channel that contain them
+	DateUpdated   time.Time                    `bson:"date_updated"   json:"date_updated"`
+}
+
+func IsNotificationLevel(level NotificationLevel) bool {
+	switch level {
+	case NotifyAll, NotifyMentions, NotifyNone:
+		return true
+	}
+	return false
+}
+
+// Validate returns a problem per invalid field, keyed by its json path.
+func (s NotificationSettings) Validate() map[string]string {
+	problems := map[string]string{}
+
+	if len(s.DoNotDisturb) > MaxQuietHours {
+		problems["do_not_disturb"] = fmt.Sprintf("at most %d windows", MaxQuietHours)
+	}
+	for i, window := range s.DoNotDisturb {
+		if _, err := time.Parse(quietHoursLayout, window.Start); err != nil {
+			problems[fmt.Sprintf("do_not_disturb[%d].start", i)] = "must be HH:MM"
+		}
+		if _, err := time.Parse(quietHoursLayout, window.End); err != nil {
+			problems[fmt.Sprintf("do_not_disturb[%d].end", i)] = "must be HH:MM"
+		}
+		if _, err := time.LoadLocation(window.TimeZone); err != nil || window.TimeZone == "" {
+			problems[fmt.Sprintf("do_not_disturb[%d].time_zone", i)] = "must be an IANA time zone"
+		}
+	}
+
+	for channelId, level := range s.ChannelLevels {
+		if !IsNotificationLevel(level) {
+			problems["channel_levels."+channelId] = "must be all, mentions or none"
+		}
+	}
+
+	if len(s.MutedThreads) > MaxMutedThreads {
+		problems["muted_threads"] = fmt.Sprintf("at most %d threads", MaxMutedThreads)
+	}
+
+	if len(s.Keywords) > MaxKeywords {
+		problems["keywords"] = fmt.Sprintf("at most %d keywords", MaxKeywords)
+	}
+	for i, keyword := range s.Keywords {
+		if strings.TrimSpace(keyword) == "" || len([]rune(keyword)) > MaxKeywordLength {
+			problems[fmt.Sprintf("keywords[%d]", i)] = fmt.Sprintf("must be 1 to %d characters", MaxKeywordLength)
+		}
+	}
+
+	return problems
+}
+
+// InDoNotDisturb tells whether now falls in any of the quiet hours.
+func (s NotificationSettings) InDoNotDisturb(now time.Time) bool {
+	for _, window := range s.DoNotDisturb {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q QuietHours) contains(now time.Time) bool {
+	location, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		return false
+	}
+	start, err := time.Parse(quietHoursLayout, q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(quietHoursLayout, q.End)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+func (s NotificationSettings) ChannelLevel(channelId string) NotificationLevel {
+	if level, ok := s.ChannelLevels[channelId]; ok {
+		return level
+	}
+	return NotifyAll
+}
+
+func (s NotificationSettings) MutesThread(threadId string) bool {
+	for _, muted := range s.MutedThreads {
+		if muted == threadId {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifies tells whether a message of channelId, and of threadId when it is a
+// reply, is pushed to the account for reason at now.
+func (s NotificationSettings) Notifies(reason NotificationReason, channelId, threadId string, now time.Time) bool {
+	if s.InDoNotDisturb(now) {
+		return false
+	}
+
+	switch s.ChannelLevel(channelId) {
+	case NotifyNone:
+		return false
+	case NotifyMentions:
+		if reason == NotifyForMessage {
+			return false
+		}
+	}
+
+	return reason != NotifyForMessage || threadId == "" || !s.MutesThread(threadId)
+}
+
+// MatchKeyword returns the first keyword found as a whole word in the
+// plaintext of content, ignoring case.
+func (s NotificationSettings) MatchKeyword(content Content) (string, bool) {
+	plaintext := content.Rendered().Plaintext
+	for _, keyword := range s.Keywords {
+		pattern := `(?i)(^|\W)` + regexp.QuoteMeta(strings.TrimSpace(keyword)) + `($|\W)`
+		if matched, _ := regexp.MatchString(pattern, plaintext); matched {
+			return keyword, true
+		}
+	}
+	return "", false
+}
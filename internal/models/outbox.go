@@ -0,0 +1,52 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"time"
+)
+
+// OutboxEvent is what a state change publishes, written in the same
+// transaction as the change and published by the outbox relay afterwards. Its
+// socket message and webhook data are kept as JSON, the form they are
+// published in, since documents decoded back into interface{} lose their
+// shape.
+type OutboxEvent struct {
+	Id          uuid.UUID  `bson:"id"`
+	Recipients  []string   `bson:"recipients,omitempty"`   // accounts Message is written to, on whichever node they are connected
+	Message     string     `bson:"message,omitempty"`      // the socket message
+	WebhookType string     `bson:"webhook_type,omitempty"` // set when the event is also delivered to webhooks
+	ScopeKey    string     `bson:"scope_key,omitempty"`
+	ScopeId     string     `bson:"scope_id,omitempty"` // the events of a scope are published one at a time, in order
+	WebhookData string     `bson:"webhook_data,omitempty"`
+	DateCreated time.Time  `bson:"date_created"`
+	PublishAt   time.Time  `bson:"publish_at"` // pushed into the future while a relay holds the event
+	Attempts    int        `bson:"attempts"`
+	PublishedAt *time.Time `bson:"published_at,omitempty"`
+}
+
+func NewOutboxEvent() (OutboxEvent, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+
+	now := time.Now().UTC()
+	return OutboxEvent{Id: id, DateCreated: now, PublishAt: now}, nil
+}
+
+// SocketMessage decodes the message the event writes to its recipients.
+func (e OutboxEvent) SocketMessage() (Message, error) {
+	var message Message
+	err := json.Unmarshal([]byte(e.Message), &message)
+	return message, err
+}
+
+// BusEvent is an outbox event on the inter-node bus, which every node reads to
+// deliver the socket messages of its own connections.
+type BusEvent struct {
+	Id          uuid.UUID `bson:"_id"`
+	Recipients  []string  `bson:"recipients"`
+	Message     string    `bson:"message"`
+	PublishedAt time.Time `bson:"published_at"`
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	DefaultMaxPageSize int64 = 100
+)
+
+// MessageCursor points at a message by its position in the history sort order.
+// Messages sharing a date_created are ordered by message_id, so no message is
+// skipped or repeated across pages.
+type MessageCursor struct {
+	DateCreated time.Time `json:"d"`
+	MessageId   uuid.UUID `json:"id"`
+}
+
+// Encode returns the opaque form of the cursor handed out to clients.
+func (c MessageCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeMessageCursor(encoded string) (MessageCursor, error) {
+	var c MessageCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return c, fmt.Errorf("malformed cursor: %v", err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("malformed cursor: %v", err)
+	}
+
+	return c, nil
+}
+
+type PageDirection string
+
+const (
+	PageBefore PageDirection = "before" // older than the cursor
+	PageAfter  PageDirection = "after"  // newer than the cursor
+	PageAround PageDirection = "around" // centered on a message, for jump-to-context
+)
+
+type PageQuery struct {
+	Direction       PageDirection
+	Cursor          *MessageCursor // nil pages back from the latest message
+	AroundMessageId uuid.UUID
+	Limit           int64
+}
+
+// NewPageQuery builds a query from the raw client parameters, of which at most
+// one of before, after and around may be set.
+func NewPageQuery(before, after, around string, limit int64) (PageQuery, error) {
+	query := PageQuery{Direction: PageBefore, Limit: limit}
+
+	set := 0
+	for _, p := range []string{before, after, around} {
+		if p != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return query, errors.New("only one of before, after and around can be set")
+	}
+
+	switch {
+	case before != "":
+		cursor, err := DecodeMessageCursor(before)
+		if err != nil {
+			return query, err
+		}
+		query.Cursor = &cursor
+
+	case after != "":
+		cursor, err := DecodeMessageCursor(after)
+		if err != nil {
+			return query, err
+		}
+		query.Direction = PageAfter
+		query.Cursor = &cursor
+
+	case around != "":
+		messageId, err := uuid.Parse(around)
+		if err != nil {
+			return query, fmt.Errorf("invalid around message id: %v", err)
+		}
+		query.Direction = PageAround
+		query.AroundMessageId = messageId
+	}
+
+	return query, nil
+}
+
+// MessagePage is one page of history, newest message first. Next pages further
+// back in time and Prev towards the present, each empty when there is nothing
+// more in that direction.
+type MessagePage[T any] struct {
+	Messages []T    `json:"messages"`
+	Next     string `json:"next,omitempty"`
+	Prev     string `json:"prev,omitempty"`
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+)
+
+// Versions of the wire protocol. Version 1 is the original untyped envelope,
+// checked only by the handlers. Version 2 frames carry their version and an
+// id, their payloads are checked against the published schema of their type,
+// and the message a payload is about is always under "message".
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	LatestProtocolVersion = ProtocolV2
+)
+
+// HelloMessageType is the first frame written to connections speaking version
+// 2 or later, telling them the version negotiated.
+const HelloMessageType = "HELLO"
+
+// protocolPayloadKeys maps, per message type, the payload keys of version 1
+// that later versions renamed. Handlers work with the version 1 names.
+var protocolPayloadKeys = map[string]map[string]string{
+	"NEW_CHANNEL_MESSAGE":    {"catache_channel_message": "message"},
+	"NEW_THREAD_MESSAGE":     {"catache_thread_message": "message"},
+	"UPDATE_CHANNEL_MESSAGE": {"new_catache_channel_message": "message"},
+	"UPDATE_THREAD_MESSAGE":  {"new_catache_thread_message": "message"},
+}
+
+// NegotiateProtocolVersion picks the latest version of a comma-separated list
+// offered by a client that the engine speaks. Clients offering none speak
+// version 1.
+func NegotiateProtocolVersion(offered string) (int, error) {
+	if strings.TrimSpace(offered) == "" {
+		return ProtocolV1, nil
+	}
+
+	negotiated := 0
+	for _, raw := range strings.Split(offered, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a protocol version", raw)
+		}
+		if version >= ProtocolV1 && version <= LatestProtocolVersion && version > negotiated {
+			negotiated = version
+		}
+	}
+	if negotiated == 0 {
+		return 0, fmt.Errorf("none of the versions offered is supported, the engine speaks 1 to %d", LatestProtocolVersion)
+	}
+	return negotiated, nil
+}
+
+// ProtocolPayloadKey returns the name a payload key of version 1 has in a
+// later version.
+func ProtocolPayloadKey(messageType, key string, version int) string {
+	if version >= ProtocolV2 {
+		if renamed, ok := protocolPayloadKeys[messageType][key]; ok {
+			return renamed
+		}
+	}
+	return key
+}
+
+// ForProtocol renders a message as written to a connection speaking version.
+func (m Message) ForProtocol(version int) Message {
+	if version < ProtocolV2 {
+		return m
+	}
+
+	m.Version = version
+	if m.Id == "" {
+		m.Id = uuid.New().String()
+	}
+	m.Payload = renamePayloadKeys(m.Payload, protocolPayloadKeys[m.Type])
+	return m
+}
+
+// FromProtocol renders a message read in its version as the handlers expect
+// it.
+func (m Message) FromProtocol() Message {
+	if m.Version < ProtocolV2 {
+		return m
+	}
+
+	fromLatest := map[string]string{}
+	for key, renamed := range protocolPayloadKeys[m.Type] {
+		fromLatest[renamed] = key
+	}
+	m.Payload = renamePayloadKeys(m.Payload, fromLatest)
+	return m
+}
+
+// renamePayloadKeys returns a copy of payload with the keys in names renamed,
+// leaving payload itself alone as it may be written to other connections.
+func renamePayloadKeys(payload map[string]interface{}, names map[string]string) map[string]interface{} {
+	if len(names) == 0 || payload == nil {
+		return payload
+	}
+
+	renamed := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		renamed[key] = value
+	}
+	return renamed
+}
+
+func NewHelloMessage(sendTo string, version int) Message {
+	return Message{
+		Type:    HelloMessageType,
+		SendTo:  sendTo,
+		Payload: map[string]interface{}{"protocol_version": version},
+	}
+}
@@ -0,0 +1,48 @@
+package models
+
+import "github.com/google/uuid"
+
+const DefaultReactionSummaryReactors = 3
+
+// ReactionSummary aggregates the reactions of one emoji on a message as seen by
+// a viewer.
+type ReactionSummary struct {
+	EmojiUnifiedCode string      `json:"emoji_unified_code"`
+	Count            int         `json:"count"`
+	ReactedByMe      bool        `json:"reacted_by_me"`
+	Reactors         []uuid.UUID `json:"reactors"` // the first few accounts to react
+}
+
+// SummarizeReactions groups reactions by emoji in the order each emoji was
+// first used. A reactor is only counted once per emoji, so duplicates stored
+// before reactions became a set do not inflate the counts.
+func SummarizeReactions(reactions []MessageReaction, viewerId uuid.UUID, maxReactors int) []ReactionSummary {
+	var summaries []ReactionSummary
+	byEmoji := map[string]int{}
+	seen := map[MessageReaction]bool{}
+
+	for _, reaction := range reactions {
+		if seen[reaction] {
+			continue
+		}
+		seen[reaction] = true
+
+		i, ok := byEmoji[reaction.EmojiUnifiedCode]
+		if !ok {
+			i = len(summaries)
+			byEmoji[reaction.EmojiUnifiedCode] = i
+			summaries = append(summaries, ReactionSummary{EmojiUnifiedCode: reaction.EmojiUnifiedCode})
+		}
+
+		summary := &summaries[i]
+		summary.Count++
+		if reaction.ReactorAccountId == viewerId {
+			summary.ReactedByMe = true
+		}
+		if len(summary.Reactors) < maxReactors {
+			summary.Reactors = append(summary.Reactors, reaction.ReactorAccountId)
+		}
+	}
+
+	return summaries
+}
@@ -1,7 +1,21 @@
 package models
 
+import "time"
+
 type Thread struct {
-	Id            string
-	ChannelId     string // the channel this thread belongs to
-	RootMessageId string // the message this thread spawned from
+	Id            string    `json:"id"`
+	ChannelId     string    `json:"channel_id"`      // the channel this thread belongs to
+	RootMessageId string    `json:"root_message_id"` // the message this thread spawned from
+	DateCreated   time.Time `json:"date_created"`
+	ReplyCount    int64     `json:"reply_count"`
+	LastReplyAt   time.Time `json:"last_reply_at"`
+	Participants  []string  `json:"participants"` // root author followed by every account that replied
+	Followers     []string  `json:"followers"`    // accounts notified of new replies
+}
+
+// ThreadUnread counts the replies a follower missed while offline.
+type ThreadUnread struct {
+	AccountId   string `bson:"account_id"   json:"account_id"`
+	ThreadId    string `bson:"thread_id"    json:"thread_id"`
+	UnreadCount int64  `bson:"unread_count" json:"unread_count"`
 }
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"time"
+)
+
+// webhook event types
+const (
+	WebhookMessageCreated  = "message.created"
+	WebhookMessageEdited   = "message.edited"
+	WebhookMessageDeleted  = "message.deleted"
+	WebhookMessageRestored = "message.restored"
+	WebhookReactionChanged = "reaction.changed"
+)
+
+func IsWebhookEventType(eventType string) bool {
+	switch eventType {
+	case WebhookMessageCreated, WebhookMessageEdited, WebhookMessageDeleted, WebhookMessageRestored, WebhookReactionChanged:
+		return true
+	}
+	return false
+}
+
+// WebhookSubscription posts the events it selects to Url. Empty filters select
+// everything.
+type WebhookSubscription struct {
+	Id          uuid.UUID `bson:"id"           json:"id"`
+	Url         string    `bson:"url"          json:"url"`
+	Secret      string    `bson:"secret"       json:"secret,omitempty"` // only shown when the subscription is created
+	EventTypes  []string  `bson:"event_types"  json:"event_types"`
+	ChannelIds  []string  `bson:"channel_ids"  json:"channel_ids"`
+	DateCreated time.Time `bson:"date_created" json:"date_created"`
+}
+
+func (s WebhookSubscription) Matches(eventType, channelId string) bool {
+	return matchesFilter(s.EventTypes, eventType) && matchesFilter(s.ChannelIds, channelId)
+}
+
+func matchesFilter(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, selected := range filter {
+		if selected == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the body of every delivery. Receivers tell retries and
+// replays apart from new events by Id.
+type WebhookEvent struct {
+	Id          uuid.UUID              `json:"id"`
+	Type        string                 `json:"type"`
+	DateCreated time.Time              `json:"date_created"`
+	Data        map[string]interface{} `json:"data"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed" // gave up retrying, can be replayed
+)
+
+// WebhookDelivery is one event queued for one subscription, and its log.
+type WebhookDelivery struct {
+	Id             uuid.UUID             `bson:"id"                        json:"id"`
+	SubscriptionId uuid.UUID             `bson:"subscription_id"           json:"subscription_id"`
+	EventId        uuid.UUID             `bson:"event_id"                  json:"event_id"`
+	EventType      string                `bson:"event_type"                json:"event_type"`
+	Body           string                `bson:"body"                      json:"body"` // the exact bytes posted, so replays are identical
+	Status         WebhookDeliveryStatus `bson:"status"                    json:"status"`
+	Attempts       int                   `bson:"attempts"                  json:"attempts"`
+	NextAttemptAt  time.Time             `bson:"next_attempt_at"           json:"next_attempt_at"`
+	LastAttemptAt  *time.Time            `bson:"last_attempt_at,omitempty" json:"last_attempt_at,omitempty"`
+	LastStatusCode int                   `bson:"last_status_code"          json:"last_status_code,omitempty"`
+	LastError      string                `bson:"last_error"                json:"last_error,omitempty"`
+	DateCreated    time.Time             `bson:"date_created"              json:"date_created"`
+}
+
+// NewWebhookDeliveries queues the event for every subscription.
+func NewWebhookDeliveries(event WebhookEvent, subscriptions []WebhookSubscription) ([]WebhookDelivery, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, WebhookDelivery{
+			Id:             id,
+			SubscriptionId: subscription.Id,
+			EventId:        event.Id,
+			EventType:      event.Type,
+			Body:           string(body),
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  event.DateCreated,
+			DateCreated:    event.DateCreated,
+		})
+	}
+	return deliveries, nil
+}
@@ -23,11 +23,35 @@ func makeUpgrader() websocket.Upgrader {
 }
 
 // UpgradeHTTPToWS upgrades the HTTP server connection to the WebSocket protocol.
-func UpgradeHTTPToWS(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+// responseHeader is added to the handshake response. The first subprotocol
+// the client offers that names a codec is negotiated, and CodecFor the
+// connection's Subprotocol encodes its frames; clients offering none speak
+// JSON.
+func UpgradeHTTPToWS(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	if subprotocol := negotiateSubprotocol(websocket.Subprotocols(r)); subprotocol != "" {
+		if responseHeader == nil {
+			responseHeader = http.Header{}
+		}
+		responseHeader.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
 	upgrader := makeUpgrader()
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		return nil, err
 	}
 	return conn, err
 }
+
+// negotiateSubprotocol picks the first subprotocol offered, in the client's
+// order of preference, that names a codec.
+func negotiateSubprotocol(offered []string) string {
+	for _, subprotocol := range offered {
+		for _, codec := range Codecs {
+			if codec.Name() == subprotocol {
+				return subprotocol
+			}
+		}
+	}
+	return ""
+}
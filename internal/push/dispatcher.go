@@ -0,0 +1,184 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers     = 4
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+
+	queueSize   = 1024
+	sendTimeout = 30 * time.Second
+)
+
+// Dispatcher queues notifications and sends them to every device of their
+// account through the provider of the device's platform. A notification still
+// queued or being retried is replaced by a newer one with the same account and
+// collapse key, so a burst of messages ends up as a single notification.
+type Dispatcher struct {
+	Devices     DeviceStore
+	Fallback    Provider // for platforms without a provider of their own
+	MaxAttempts int
+	Backoff     time.Duration // before the first retry, doubled for every next one
+
+	providers map[string]Provider
+	mu        sync.Mutex
+	pending   map[string]Notification // by collapse key, waiting for a worker
+	sequence  int64                   // keys notifications that do not collapse
+	queue     chan string
+}
+
+func NewDispatcher(devices DeviceStore) *Dispatcher {
+	return &Dispatcher{
+		Devices:     devices,
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		providers:   map[string]Provider{},
+		pending:     map[string]Notification{},
+		queue:       make(chan string, queueSize),
+	}
+}
+
+// Register makes provider deliver to the devices of platform.
+func (d *Dispatcher) Register(platform string, provider Provider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.providers[platform] = provider
+}
+
+func (d *Dispatcher) provider(platform string) Provider {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if provider, ok := d.providers[platform]; ok {
+		return provider
+	}
+	return d.Fallback
+}
+
+// Notify queues a notification without blocking.
+func (d *Dispatcher) Notify(notification Notification) {
+	d.mu.Lock()
+	var key string
+	if notification.CollapseKey != "" {
+		key = notification.AccountId + "|" + notification.CollapseKey
+	} else {
+		d.sequence++
+		key = "#" + strconv.FormatInt(d.sequence, 10)
+	}
+	_, queued := d.pending[key]
+	d.pending[key] = notification
+	d.mu.Unlock()
+
+	if queued {
+		// the queued key now sends the newer notification
+		return
+	}
+
+	select {
+	case d.queue <- key:
+	default:
+		go func() { d.queue <- key }()
+	}
+}
+
+// take removes the notification queued under key.
+func (d *Dispatcher) take(key string) (Notification, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	notification, ok := d.pending[key]
+	delete(d.pending, key)
+	return notification, ok
+}
+
+// superseded tells whether a newer notification was queued under key.
+func (d *Dispatcher) superseded(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.pending[key]
+	return ok
+}
+
+// Run sends queued notifications with the given number of workers. It never
+// returns.
+func (d *Dispatcher) Run(workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range d.queue {
+				if notification, ok := d.take(key); ok {
+					d.deliver(key, notification)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) deliver(key string, notification Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	devices, err := d.Devices.FindDevices(ctx, notification.AccountId)
+	cancel()
+	if err != nil {
+		logrus.Errorf("failed to find devices of %s: %v", notification.AccountId, err)
+		return
+	}
+
+	for _, device := range devices {
+		d.send(key, device, notification)
+	}
+}
+
+// send delivers to one device, retrying with exponential backoff until it
+// succeeds, fails for good, runs out of attempts or a newer notification
+// collapses this one.
+func (d *Dispatcher) send(key string, device models.Device, notification Notification) {
+	provider := d.provider(device.Platform)
+	if provider == nil {
+		logrus.Warnf("no push provider for platform %s, dropping notification to %s", device.Platform, device.AccountId)
+		return
+	}
+
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := provider.Send(ctx, device, notification)
+		cancel()
+
+		switch {
+		case err == nil:
+			return
+
+		case errors.Is(err, ErrUnregistered):
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			if err := d.Devices.ForgetDevice(ctx, device.Token); err != nil {
+				logrus.Errorf("failed to forget unregistered device of %s: %v", device.AccountId, err)
+			}
+			cancel()
+			return
+
+		case errors.Is(err, ErrRejected), attempt >= d.MaxAttempts:
+			logrus.Errorf("failed to push to %s device of %s after %d attempts: %v", device.Platform, device.AccountId, attempt, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if key[0] != '#' && d.superseded(key) {
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"messaging-engine/internal/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memDevices is a DeviceStore over a fixed set of devices.
+type memDevices struct {
+	mu        sync.Mutex
+	devices   []models.Device
+	forgotten []string
+}
+
+func (s *memDevices) FindDevices(ctx context.Context, accountId string) ([]models.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []models.Device
+	for _, device := range s.devices {
+		if device.AccountId == accountId {
+			found = append(found, device)
+		}
+	}
+	return found, nil
+}
+
+func (s *memDevices) ForgetDevice(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forgotten = append(s.forgotten, token)
+	return nil
+}
+
+func (s *memDevices) Forgotten() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.forgotten...)
+}
+
+func newTestDispatcher(devices ...models.Device) (*Dispatcher, *FakeProvider, *memDevices) {
+	store := &memDevices{devices: devices}
+	provider := &FakeProvider{}
+	dispatcher := NewDispatcher(store)
+	dispatcher.Fallback = provider
+	dispatcher.Backoff = time.Millisecond
+	return dispatcher, provider, store
+}
+
+// waitFor polls until done holds, failing the test after a second.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestDispatcherSendsToEveryDevice(t *testing.T) {
+	dispatcher, fallback, _ := newTestDispatcher(
+		models.Device{AccountId: "a", Token: "apns-token", Platform: models.DevicePlatformAPNs},
+		models.Device{AccountId: "a", Token: "webhook-token", Platform: models.DevicePlatformWebhook},
+		models.Device{AccountId: "b", Token: "other-token", Platform: models.DevicePlatformWebhook},
+	)
+	apns := &FakeProvider{}
+	dispatcher.Register(models.DevicePlatformAPNs, apns)
+	go dispatcher.Run(1)
+
+	dispatcher.Notify(Notification{AccountId: "a", Title: "New message"})
+
+	waitFor(t, "the notification", func() bool { return len(apns.Sent()) == 1 && len(fallback.Sent()) == 1 })
+	if token := apns.Sent()[0].Device.Token; token != "apns-token" {
+		t.Errorf("the apns provider sent to %s", token)
+	}
+	if token := fallback.Sent()[0].Device.Token; token != "webhook-token" {
+		t.Errorf("the fallback provider sent to %s", token)
+	}
+}
+
+func TestDispatcherCollapsesQueuedNotifications(t *testing.T) {
+	dispatcher, provider, _ := newTestDispatcher(
+		models.Device{AccountId: "a", Token: "token", Platform: models.DevicePlatformWebhook},
+	)
+
+	// queued before any worker runs, so the first ones are still pending
+	dispatcher.Notify(Notification{AccountId: "a", Body: "first", CollapseKey: "channel_id:1"})
+	dispatcher.Notify(Notification{AccountId: "a", Body: "second", CollapseKey: "channel_id:1"})
+	dispatcher.Notify(Notification{AccountId: "a", Body: "third", CollapseKey: "channel_id:1"})
+	dispatcher.Notify(Notification{AccountId: "a", Body: "other channel", CollapseKey: "channel_id:2"})
+	dispatcher.Notify(Notification{AccountId: "a", Body: "uncollapsed"})
+	dispatcher.Notify(Notification{AccountId: "a", Body: "uncollapsed"})
+	go dispatcher.Run(1)
+
+	waitFor(t, "the notifications", func() bool { return len(provider.Sent()) >= 4 })
+	time.Sleep(10 * time.Millisecond)
+
+	var bodies []string
+	for _, sent := range provider.Sent() {
+		bodies = append(bodies, sent.Notification.Body)
+	}
+	want := []string{"third", "other channel", "uncollapsed", "uncollapsed"}
+	if len(bodies) != len(want) {
+		t.Fatalf("sent %q, want %q", bodies, want)
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Fatalf("sent %q, want %q", bodies, want)
+		}
+	}
+}
+
+func TestDispatcherRetriesFailedSends(t *testing.T) {
+	dispatcher, provider, _ := newTestDispatcher(
+		models.Device{AccountId: "a", Token: "token", Platform: models.DevicePlatformWebhook},
+	)
+	var mu sync.Mutex
+	attempts := 0
+	provider.Fail = func(models.Device, Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("provider unavailable")
+		}
+		return nil
+	}
+	go dispatcher.Run(1)
+
+	dispatcher.Notify(Notification{AccountId: "a", Body: "retried"})
+
+	waitFor(t, "the retried notification", func() bool { return len(provider.Sent()) == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("sent after %d attempts, want 3", attempts)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		err          error
+		wantAttempts int
+	}{
+		{"after max attempts", errors.New("provider unavailable"), 3},
+		{"when rejected", ErrRejected, 1},
+		{"when unregistered", ErrUnregistered, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dispatcher, provider, store := newTestDispatcher(
+				models.Device{AccountId: "a", Token: "token", Platform: models.DevicePlatformWebhook},
+			)
+			dispatcher.MaxAttempts = 3
+
+			var mu sync.Mutex
+			attempts := 0
+			provider.Fail = func(models.Device, Notification) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				return test.err
+			}
+
+			// send is what a worker runs for every device, so it has returned
+			// once the dispatcher gave up
+			devices, _ := store.FindDevices(context.Background(), "a")
+			dispatcher.send("#1", devices[0], Notification{AccountId: "a"})
+
+			if attempts != test.wantAttempts {
+				t.Errorf("gave up after %d attempts, want %d", attempts, test.wantAttempts)
+			}
+			forgotten := store.Forgotten()
+			if unregistered := errors.Is(test.err, ErrUnregistered); unregistered != (len(forgotten) == 1) {
+				t.Errorf("forgot %q", forgotten)
+			}
+		})
+	}
+}
+
+func TestDispatcherStopsRetryingSupersededNotifications(t *testing.T) {
+	dispatcher, provider, _ := newTestDispatcher(
+		models.Device{AccountId: "a", Token: "token", Platform: models.DevicePlatformWebhook},
+	)
+	dispatcher.MaxAttempts = 100
+	dispatcher.Backoff = 5 * time.Millisecond
+
+	failing := make(chan struct{})
+	provider.Fail = func(device models.Device, notification Notification) error {
+		if notification.Body == "first" {
+			select {
+			case failing <- struct{}{}:
+			default:
+			}
+			return errors.New("provider unavailable")
+		}
+		return nil
+	}
+	go dispatcher.Run(1)
+
+	dispatcher.Notify(Notification{AccountId: "a", Body: "first", CollapseKey: "thread_id:1"})
+	<-failing
+	dispatcher.Notify(Notification{AccountId: "a", Body: "second", CollapseKey: "thread_id:1"})
+
+	// the single worker only gets to the second once it stopped retrying the first
+	waitFor(t, "the newer notification", func() bool { return len(provider.Sent()) == 1 })
+	if body := provider.Sent()[0].Notification.Body; body != "second" {
+		t.Errorf("sent %q, want the newer notification", body)
+	}
+}
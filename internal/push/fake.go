@@ -0,0 +1,43 @@
+package push
+
+import (
+	"context"
+	"messaging-engine/internal/models"
+	"sync"
+)
+
+// FakeProvider keeps notifications in memory instead of sending them.
+type FakeProvider struct {
+	// Fail, when set, decides the outcome of each send.
+	Fail func(device models.Device, notification Notification) error
+
+	mu   sync.Mutex
+	sent []FakeDelivery
+}
+
+type FakeDelivery struct {
+	Device       models.Device
+	Notification Notification
+}
+
+func (p *FakeProvider) Send(ctx context.Context, device models.Device, notification Notification) error {
+	if p.Fail != nil {
+		if err := p.Fail(device, notification); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sent = append(p.sent, FakeDelivery{Device: device, Notification: notification})
+	return nil
+}
+
+// Sent returns the notifications delivered so far.
+func (p *FakeProvider) Sent() []FakeDelivery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]FakeDelivery(nil), p.sent...)
+}
@@ -0,0 +1,41 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+var (
+	// ErrUnregistered means the token is no longer valid, as APNs answers with
+	// 410 and FCM with UNREGISTERED. The device is forgotten.
+	ErrUnregistered = errors.New("device token is unregistered")
+	// ErrRejected means the provider refused the notification for good, so it
+	// is not retried.
+	ErrRejected = errors.New("notification rejected")
+)
+
+// Notification is what an account is shown about something it missed, in the
+// shape APNs and FCM both accept.
+type Notification struct {
+	AccountId   string            `json:"account_id"`
+	Title       string            `json:"title"`
+	Body        string            `json:"body"`
+	CollapseKey string            `json:"collapse_key,omitempty"` // a newer notification with the same key replaces an undelivered one
+	Data        map[string]string `json:"data,omitempty"`         // lets the app open what the notification is about
+	DateCreated time.Time         `json:"date_created"`
+}
+
+// Provider delivers notifications to the devices of one or more platforms.
+// Errors other than ErrUnregistered and ErrRejected are retried.
+type Provider interface {
+	Send(ctx context.Context, device models.Device, notification Notification) error
+}
+
+// DeviceStore finds the devices notifications go to and forgets the ones
+// whose tokens stopped working.
+type DeviceStore interface {
+	FindDevices(ctx context.Context, accountId string) ([]models.Device, error)
+	ForgetDevice(ctx context.Context, token string) error
+}
@@ -0,0 +1,62 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"messaging-engine/internal/models"
+	"net/http"
+	"time"
+)
+
+// WebhookProvider posts every notification as JSON to a local endpoint, such
+// as a push gateway holding the APNs and FCM credentials, or a development
+// stand-in. The endpoint answers 410 for tokens it knows to be dead.
+type WebhookProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookProvider(url string) WebhookProvider {
+	return WebhookProvider{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type webhookDelivery struct {
+	Token        string       `json:"token"`
+	Platform     string       `json:"platform"`
+	Notification Notification `json:"notification"`
+}
+
+func (p WebhookProvider) Send(ctx context.Context, device models.Device, notification Notification) error {
+	body, err := json.Marshal(webhookDelivery{
+		Token:        device.Token,
+		Platform:     device.Platform,
+		Notification: notification,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return ErrUnregistered
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("push webhook answered %s", resp.Status)
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("%w: push webhook answered %s", ErrRejected, resp.Status)
+	}
+	return nil
+}
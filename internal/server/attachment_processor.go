@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/media"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/storage"
+	"sync"
+	"time"
+)
+
+const (
+	attachmentProcessors     = 4
+	attachmentQueueSize      = 1024
+	attachmentProcessTimeout = 2 * time.Minute
+)
+
+// attachmentJob processes an image carried by a message and tells the members
+// of the message's channel when it is done.
+type attachmentJob struct {
+	attachmentId uuid.UUID
+	scopeKey     string // channel_id or thread_id
+	scopeId      string
+	messageId    string
+}
+
+var attachmentJobs = make(chan attachmentJob, attachmentQueueSize)
+
+// processImageFiles queues the images among a message's files.
+func processImageFiles(scopeKey, scopeId string, messageId uuid.UUID, files []models.File) {
+	for _, file := range files {
+		if !models.IsImageType(file.FileType) {
+			continue
+		}
+
+		job := attachmentJob{
+			attachmentId: file.AttachmentId,
+			scopeKey:     scopeKey,
+			scopeId:      scopeId,
+			messageId:    messageId.String(),
+		}
+		select {
+		case attachmentJobs <- job:
+		default:
+			// never block the connection's read loop on a full queue
+			go func() { attachmentJobs <- job }()
+		}
+	}
+}
+
+// StartAttachmentProcessor runs the pool of workers that process queued images.
+func StartAttachmentProcessor(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var workers sync.WaitGroup
+	for i := 0; i < attachmentProcessors; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range attachmentJobs {
+				runAttachmentJob(job)
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+func runAttachmentJob(job attachmentJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentProcessTimeout)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, job.attachmentId.String())
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", job.attachmentId, err)
+		return
+	}
+
+	// an image shared in several messages is only processed once
+	if attachment.AwaitingProcessing() {
+		attachment, err = processImage(ctx, attachment)
+		if err != nil {
+			logrus.Errorf("error processing AttachmentId: %s : %v", attachment.Id, err)
+			return
+		}
+	}
+
+	recipients, err := scopeClients(ctx, job.scopeKey, job.scopeId)
+	if err != nil {
+		logrus.Errorf("error finding the clients of %s %s: %v", job.scopeKey, job.scopeId, err)
+		return
+	}
+	ClientPool.SendMsgToClients(recipients, attachmentProcessedEvent(job, attachment))
+}
+
+// scopeClients returns the clients of a channel, or of the channel a thread
+// belongs to.
+func scopeClients(ctx context.Context, scopeKey, scopeId string) ([]string, error) {
+	channelId := scopeId
+	if scopeKey == "thread_id" {
+		thread, err := mongo.FindThreadById(ctx, scopeId)
+		if err != nil {
+			return nil, err
+		}
+		channelId = thread.ChannelId
+	}
+
+	channel, err := mongo.FindChannelById(ctx, channelId)
+	if err != nil {
+		return nil, err
+	}
+	return channel.Clients, nil
+}
+
+// processImage strips the image's location metadata in place, then records
+// its dimensions and thumbnails. Downloads are refused until it is done.
+func processImage(ctx context.Context, attachment models.Attachment) (models.Attachment, error) {
+	blob, err := storage.Blobs.Get(ctx, attachment.StorageKey())
+	if err != nil {
+		return attachment, err
+	}
+	data, err := io.ReadAll(io.LimitReader(blob, maxAttachmentBytes()+1))
+	blob.Close()
+	if err != nil {
+		return attachment, fmt.Errorf("failed to read image: %v", err)
+	}
+
+	stripped, err := media.StripMetadata(attachment.ContentType, data)
+	if err != nil {
+		return attachment, err
+	}
+	if !bytes.Equal(stripped, data) {
+		err = storage.Blobs.Put(ctx, attachment.StorageKey(), bytes.NewReader(stripped), int64(len(stripped)))
+		if err != nil {
+			return attachment, err
+		}
+		checksum := sha256.Sum256(stripped)
+		attachment.Size = int64(len(stripped))
+		attachment.Sha256 = hex.EncodeToString(checksum[:])
+	}
+
+	attachment.Width, attachment.Height, err = media.Dimensions(stripped)
+	if err != nil {
+		return attachment, err
+	}
+
+	if attachment.Width*attachment.Height <= media.MaxPixels {
+		attachment.Thumbnails, err = writeThumbnails(ctx, attachment, stripped)
+		if err != nil {
+			return attachment, err
+		}
+	}
+
+	processedAt := time.Now().UTC()
+	attachment.ProcessedAt = &processedAt
+	return attachment, mongo.FinishAttachmentProcessing(ctx, attachment)
+}
+
+func writeThumbnails(ctx context.Context, attachment models.Attachment, data []byte) ([]models.Thumbnail, error) {
+	img, err := media.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var thumbnails []models.Thumbnail
+	for _, size := range media.ThumbnailSizes {
+		scaled, ok := media.Scale(img, size.MaxSide)
+		if !ok {
+			// no larger sizes will be smaller than the image either
+			break
+		}
+
+		encoded, contentType, err := media.Encode(scaled, attachment.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		err = storage.Blobs.Put(ctx, attachment.ThumbnailStorageKey(size.Name), bytes.NewReader(encoded), int64(len(encoded)))
+		if err != nil {
+			return nil, err
+		}
+
+		thumbnails = append(thumbnails, models.Thumbnail{
+			Name:        size.Name,
+			Width:       scaled.Bounds().Dx(),
+			Height:      scaled.Bounds().Dy(),
+			ContentType: contentType,
+			Size:        int64(len(encoded)),
+		})
+	}
+
+	return thumbnails, nil
+}
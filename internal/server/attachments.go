@@ -0,0 +1,704 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"io"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/storage"
+	"messaging-engine/internal/util"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxAttachmentBytes = 25 << 20
+	defaultDownloadUrlTTL     = 15 * time.Minute
+	attachmentUploadTimeout   = 10 * time.Minute
+	maxAttachmentParts        = 10000
+	multipartFieldsBytes      = 1 << 20 // allowance for the form fields around the file
+	attachmentChecksumHeader  = "X-Checksum-Sha256"
+)
+
+func maxAttachmentBytes() int64 {
+	if maxBytes := config.Config.Attachments.MaxBytes; maxBytes > 0 {
+		return maxBytes
+	}
+	return defaultMaxAttachmentBytes
+}
+
+func downloadUrlTTL() time.Duration {
+	if minutes := config.Config.Attachments.DownloadUrlTTLMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultDownloadUrlTTL
+}
+
+func attachmentTooLarge() error {
+	return util.NewAPIError(
+		http.StatusRequestEntityTooLarge,
+		util.CodeRequestTooLarge,
+		fmt.Sprintf("attachments must not be larger than %d bytes", maxAttachmentBytes()),
+	)
+}
+
+// attachmentProcessing refuses downloads of an image whose metadata has not
+// been stripped yet.
+func attachmentProcessing() error {
+	return util.NewAPIError(http.StatusConflict, util.CodeConflict, "attachment is still being processed")
+}
+
+// uploadReadError maps a failure to read an upload body to the response the
+// client gets.
+func uploadReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, storage.ErrTooLarge) || errors.As(err, &maxBytesErr) {
+		return attachmentTooLarge()
+	}
+	return util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "failed to read upload: "+err.Error())
+}
+
+// checksumMismatch reports an upload whose bytes do not hash to the checksum
+// the client sent along.
+func checksumMismatch(expected, actual string) error {
+	return util.NewAPIError(
+		http.StatusBadRequest,
+		util.CodeInvalidRequest,
+		"checksum mismatch",
+		util.FieldError{Field: "sha256", Message: fmt.Sprintf("expected %s, received bytes hash to %s", expected, actual)},
+	)
+}
+
+// uploaderId is the account the request is authenticated as, which owns the
+// attachments it uploads.
+func uploaderId(r *http.Request) (uuid.UUID, error) {
+	identity, _ := auth.FromContext(r.Context())
+	ownerId, err := uuid.Parse(identity.AccountId)
+	if err != nil {
+		return ownerId, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "attachments are uploaded by an account")
+	}
+	return ownerId, nil
+}
+
+// attachmentNotOwned refuses to continue an upload of another account.
+func attachmentNotOwned() error {
+	return util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "attachment belongs to another account")
+}
+
+// resolveAttachments checks that every file references a ready attachment
+// owned by ownerId and returns the files as the attachments describe them.
+func resolveAttachments(ctx context.Context, ownerId uuid.UUID, files []models.File) ([]models.File, error) {
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	attachmentIds := make([]uuid.UUID, 0, len(files))
+	for _, file := range files {
+		if file.AttachmentId == uuid.Nil {
+			return nil, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				"files must reference an uploaded attachment",
+				util.FieldError{Field: "attachment_id", Message: "is required"},
+			)
+		}
+		attachmentIds = append(attachmentIds, file.AttachmentId)
+	}
+
+	found, err := mongo.FindAttachmentsByIds(ctx, attachmentIds)
+	if err != nil {
+		return nil, err
+	}
+	byId := map[uuid.UUID]models.Attachment{}
+	for _, attachment := range found {
+		byId[attachment.Id] = attachment
+	}
+
+	resolved := make([]models.File, 0, len(files))
+	for _, file := range files {
+		attachment, ok := byId[file.AttachmentId]
+		if !ok || attachment.Status != models.AttachmentReady {
+			return nil, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				"attachment "+file.AttachmentId.String()+" does not exist or is still uploading",
+				util.FieldError{Field: "attachment_id", Message: "unknown attachment"},
+			)
+		}
+		if attachment.OwnerAccountId != ownerId {
+			return nil, util.NewAPIError(
+				http.StatusForbidden,
+				util.CodeForbidden,
+				"attachment "+file.AttachmentId.String()+" belongs to another account",
+			)
+		}
+		resolved = append(resolved, attachment.File())
+	}
+
+	return resolved, nil
+}
+
+// HandleUploadAttachment stores a file sent as multipart/form-data in one go.
+func HandleUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	ownerId, err := uploaderId(r)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes()+multipartFieldsBytes)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusUnsupportedMediaType,
+			util.CodeUnsupportedMediaType,
+			"Content-Type header is not multipart/form-data",
+		))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentUploadTimeout)
+	defer cancel()
+
+	// the file part has to come last, so the fields it depends on are known
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			util.WriteJSONError(w, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				"file is missing",
+				util.FieldError{Field: "file", Message: "is required"},
+			))
+			return
+		}
+		if err != nil {
+			logrus.Errorf("error reading multipart body when HandleUploadAttachment, %v", err)
+			util.WriteJSONError(w, uploadReadError(err))
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+				return
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		attachment, err := storeAttachment(ctx, ownerId, part.FileName(), part, fields["sha256"])
+		if err != nil {
+			util.WriteJSONError(w, err)
+			return
+		}
+
+		util.WriteJSONData(w, http.StatusCreated, attachment)
+		return
+	}
+}
+
+func storeAttachment(ctx context.Context, ownerId uuid.UUID, fileName string, body io.Reader, checksum string) (models.Attachment, error) {
+	spooled, err := storage.Spool(body, maxAttachmentBytes())
+	if err != nil {
+		logrus.Errorf("error storage.Spool: %v", err)
+		return models.Attachment{}, uploadReadError(err)
+	}
+	defer spooled.Close()
+
+	if checksum != "" && !strings.EqualFold(checksum, spooled.Sha256) {
+		return models.Attachment{}, checksumMismatch(checksum, spooled.Sha256)
+	}
+
+	attachment := models.Attachment{
+		Id:             uuid.New(),
+		OwnerAccountId: ownerId,
+		FileName:       fileName,
+		ContentType:    spooled.ContentType,
+		Size:           spooled.Size,
+		Sha256:         spooled.Sha256,
+		Status:         models.AttachmentReady,
+		DateCreated:    time.Now().UTC(),
+	}
+
+	err = storage.Blobs.Put(ctx, attachment.StorageKey(), spooled.File, spooled.Size)
+	if err != nil {
+		logrus.Errorf("error storage.Put for AttachmentId: %s : %v", attachment.Id, err)
+		return attachment, err
+	}
+
+	err = mongo.NewAttachment(ctx, attachment)
+	if err != nil {
+		logrus.Errorf("error db.NewAttachment: %v", err)
+		// nothing references the blob yet
+		if err := storage.Blobs.Delete(ctx, attachment.StorageKey()); err != nil {
+			logrus.Errorf("error storage.Delete for AttachmentId: %s : %v", attachment.Id, err)
+		}
+		return attachment, err
+	}
+
+	return attachment, nil
+}
+
+// HandleStartAttachmentUpload begins a resumable upload of a file of the
+// declared size, which is then sent as numbered parts.
+func HandleStartAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	type got struct {
+		FileName string `json:"file_name"`
+		Size     int64  `json:"size"`
+	}
+
+	ownerId, err := uploaderId(r)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var g got
+	err = util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		logrus.Errorf("error decoding JSON body when HandleStartAttachmentUpload, %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	if g.Size <= 0 {
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"invalid size",
+			util.FieldError{Field: "size", Message: "must be positive"},
+		))
+		return
+	}
+	if g.Size > maxAttachmentBytes() {
+		util.WriteJSONError(w, attachmentTooLarge())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	attachment := models.Attachment{
+		Id:             uuid.New(),
+		OwnerAccountId: ownerId,
+		FileName:       g.FileName,
+		Size:           g.Size,
+		Status:         models.AttachmentUploading,
+		DateCreated:    time.Now().UTC(),
+	}
+
+	err = mongo.NewAttachment(ctx, attachment)
+	if err != nil {
+		logrus.Errorf("error db.NewAttachment: %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusCreated, attachment)
+}
+
+// HandleUploadAttachmentPart stores one part of a resumable upload from the raw
+// request body. A part that failed midway is simply sent again.
+func HandleUploadAttachmentPart(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ownerId, err := uploaderId(r)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	partNumber, err := strconv.Atoi(vars["part_number"])
+	if err != nil || partNumber < 1 || partNumber > maxAttachmentParts {
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"invalid part number",
+			util.FieldError{Field: "part_number", Message: fmt.Sprintf("must be between 1 and %d", maxAttachmentParts)},
+		))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentUploadTimeout)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, vars["attachment_id"])
+	if errors.Is(err, mongo.ErrAttachmentNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", vars["attachment_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	if attachment.OwnerAccountId != ownerId {
+		util.WriteJSONError(w, attachmentNotOwned())
+		return
+	}
+	if attachment.Status != models.AttachmentUploading {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, mongo.ErrAttachmentNotUploading.Error()))
+		return
+	}
+
+	spooled, err := storage.Spool(r.Body, attachment.Size)
+	if err != nil {
+		logrus.Errorf("error storage.Spool: %v", err)
+		util.WriteJSONError(w, uploadReadError(err))
+		return
+	}
+	defer spooled.Close()
+
+	if checksum := r.Header.Get(attachmentChecksumHeader); checksum != "" && !strings.EqualFold(checksum, spooled.Sha256) {
+		util.WriteJSONError(w, checksumMismatch(checksum, spooled.Sha256))
+		return
+	}
+
+	err = storage.Blobs.Put(ctx, attachment.PartStorageKey(partNumber), spooled.File, spooled.Size)
+	if err != nil {
+		logrus.Errorf("error storage.Put for AttachmentId: %s, Part: %d : %v", attachment.Id, partNumber, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	attachment, err = mongo.RecordAttachmentPart(ctx, vars["attachment_id"], partNumber, spooled.Size)
+	if errors.Is(err, mongo.ErrAttachmentNotUploading) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.RecordAttachmentPart for AttachmentId: %s : %v", vars["attachment_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, attachment)
+}
+
+// HandleCompleteAttachmentUpload assembles the parts, numbered from 1 without
+// gaps, into the attachment.
+func HandleCompleteAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	type got struct {
+		Sha256 string `json:"sha256"` // optional checksum of the whole file
+	}
+
+	ownerId, err := uploaderId(r)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var g got
+	err = util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		logrus.Errorf("error decoding JSON body when HandleCompleteAttachmentUpload, %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	attachmentId := mux.Vars(r)["attachment_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentUploadTimeout)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, attachmentId)
+	if errors.Is(err, mongo.ErrAttachmentNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	if attachment.OwnerAccountId != ownerId {
+		util.WriteJSONError(w, attachmentNotOwned())
+		return
+	}
+	if attachment.Status != models.AttachmentUploading {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, mongo.ErrAttachmentNotUploading.Error()))
+		return
+	}
+
+	var received int64
+	for partNumber := 1; partNumber <= len(attachment.Parts); partNumber++ {
+		size, ok := attachment.Parts[strconv.Itoa(partNumber)]
+		if !ok {
+			util.WriteJSONError(w, util.NewAPIError(
+				http.StatusConflict,
+				util.CodeConflict,
+				fmt.Sprintf("part %d is missing", partNumber),
+			))
+			return
+		}
+		received += size
+	}
+	if received != attachment.Size {
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusConflict,
+			util.CodeConflict,
+			fmt.Sprintf("received %d of %d bytes", received, attachment.Size),
+		))
+		return
+	}
+
+	sha256, contentType, err := assembleAttachment(ctx, attachment, g.Sha256)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	attachment, err = mongo.CompleteAttachment(ctx, attachmentId, contentType, sha256)
+	if errors.Is(err, mongo.ErrAttachmentNotUploading) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.CompleteAttachment for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	for partNumber := 1; partNumber <= len(attachment.Parts); partNumber++ {
+		if err := storage.Blobs.Delete(ctx, attachment.PartStorageKey(partNumber)); err != nil {
+			logrus.Errorf("error storage.Delete for AttachmentId: %s, Part: %d : %v", attachmentId, partNumber, err)
+		}
+	}
+
+	util.WriteJSONData(w, http.StatusOK, attachment)
+}
+
+// assembleAttachment concatenates the parts into the final blob and returns
+// its checksum and sniffed content type. Parts are kept until the attachment
+// is marked complete.
+func assembleAttachment(ctx context.Context, attachment models.Attachment, checksum string) (string, string, error) {
+	var parts []io.Reader
+	for partNumber := 1; partNumber <= len(attachment.Parts); partNumber++ {
+		part, err := storage.Blobs.Get(ctx, attachment.PartStorageKey(partNumber))
+		if err != nil {
+			logrus.Errorf("error storage.Get for AttachmentId: %s, Part: %d : %v", attachment.Id, partNumber, err)
+			return "", "", err
+		}
+		defer part.Close()
+		parts = append(parts, part)
+	}
+
+	spooled, err := storage.Spool(io.MultiReader(parts...), attachment.Size)
+	if errors.Is(err, storage.ErrTooLarge) {
+		return "", "", attachmentTooLarge()
+	}
+	if err != nil {
+		logrus.Errorf("error storage.Spool: %v", err)
+		return "", "", err
+	}
+	defer spooled.Close()
+
+	if checksum != "" && !strings.EqualFold(checksum, spooled.Sha256) {
+		return "", "", checksumMismatch(checksum, spooled.Sha256)
+	}
+
+	err = storage.Blobs.Put(ctx, attachment.StorageKey(), spooled.File, spooled.Size)
+	if err != nil {
+		logrus.Errorf("error storage.Put for AttachmentId: %s : %v", attachment.Id, err)
+		return "", "", err
+	}
+
+	return spooled.Sha256, spooled.ContentType, nil
+}
+
+func HandleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentId := mux.Vars(r)["attachment_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, attachmentId)
+	if errors.Is(err, mongo.ErrAttachmentNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, attachment)
+}
+
+// requireAttachmentReader lets the owner of the attachment, the clients of a
+// channel it is posted in, admins and services read it.
+func requireAttachmentReader(ctx context.Context, identity auth.Identity, attachment models.Attachment) error {
+	if identity.AccountId == attachment.OwnerAccountId.String() || identity.HasRole(auth.RoleAdmin) || identity.HasRole(auth.RoleService) {
+		return nil
+	}
+
+	channelIds, threadIds, err := mongo.FindAttachmentPostings(ctx, attachment.Id)
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentPostings for AttachmentId: %s : %v", attachment.Id, err)
+		return err
+	}
+
+	scopes := make([]string, 0, len(channelIds)+len(threadIds))
+	for _, channelId := range channelIds {
+		scopes = append(scopes, channelId.String())
+	}
+	for _, threadId := range threadIds {
+		thread, err := mongo.FindThreadById(ctx, threadId.String())
+		if err != nil {
+			logrus.Errorf("error db.FindThreadById for ThreadId: %s : %v", threadId, err)
+			continue
+		}
+		scopes = append(scopes, thread.ChannelId)
+	}
+
+	for _, channelId := range scopes {
+		channel, err := mongo.FindChannelById(ctx, channelId)
+		if err != nil {
+			logrus.Errorf("error db.FindChannelById for ChannelId: %s : %v", channelId, err)
+			continue
+		}
+		if identity.AccountId != "" && channel.HasClient(identity.AccountId) {
+			return nil
+		}
+	}
+
+	return util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "not allowed to read attachment "+attachment.Id.String())
+}
+
+// HandleGetAttachmentDownloadUrl hands out a signed url the attachment can be
+// downloaded from until it expires.
+func HandleGetAttachmentDownloadUrl(w http.ResponseWriter, r *http.Request) {
+	attachmentId := mux.Vars(r)["attachment_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, attachmentId)
+	if errors.Is(err, mongo.ErrAttachmentNotFound) || (err == nil && attachment.Status != models.AttachmentReady) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, mongo.ErrAttachmentNotFound.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	identity, _ := auth.FromContext(r.Context())
+	if err := requireAttachmentReader(ctx, identity, attachment); err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+	if attachment.AwaitingProcessing() {
+		util.WriteJSONError(w, attachmentProcessing())
+		return
+	}
+
+	expires := time.Now().Add(downloadUrlTTL()).Truncate(time.Second)
+	thumbnails := map[string]string{}
+	for _, thumbnail := range attachment.Thumbnails {
+		thumbnails[thumbnail.Name] = signedDownloadUrl(attachment, thumbnail.Name, expires)
+	}
+
+	util.WriteJSONData(w, http.StatusOK, map[string]interface{}{
+		"url":        signedDownloadUrl(attachment, "", expires),
+		"thumbnails": thumbnails,
+		"expires_at": expires.UTC(),
+	})
+}
+
+// signedDownloadUrl signs the url of the attachment, or of one of its
+// thumbnails when thumbnail is set.
+func signedDownloadUrl(attachment models.Attachment, thumbnail string, expires time.Time) string {
+	key := attachment.StorageKey()
+	query := url.Values{}
+	if thumbnail != "" {
+		key = attachment.ThumbnailStorageKey(thumbnail)
+		query.Set("thumbnail", thumbnail)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", storage.SignDownload(key, expires))
+
+	return "/attachments/" + attachment.Id.String() + "/content?" + query.Encode()
+}
+
+// HandleDownloadAttachment streams the attachment, or the thumbnail named by
+// the thumbnail query param, to holders of a valid signed url.
+func HandleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentId := mux.Vars(r)["attachment_id"]
+	params := r.URL.Query()
+
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentUploadTimeout)
+	defer cancel()
+
+	attachment, err := mongo.FindAttachmentById(ctx, attachmentId)
+	if errors.Is(err, mongo.ErrAttachmentNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.FindAttachmentById for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	key, contentType, size := attachment.StorageKey(), attachment.ContentType, attachment.Size
+	fileName := attachment.FileName
+	if name := params.Get("thumbnail"); name != "" {
+		thumbnail, ok := attachment.Thumbnail(name)
+		if !ok {
+			util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, "thumbnail not found"))
+			return
+		}
+		key, contentType, size = attachment.ThumbnailStorageKey(name), thumbnail.ContentType, thumbnail.Size
+		fileName = name + "-" + fileName
+	}
+
+	expiresUnix, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil || !storage.VerifyDownload(key, time.Unix(expiresUnix, 0), params.Get("signature")) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "download url is invalid or expired"))
+		return
+	}
+	if attachment.AwaitingProcessing() {
+		util.WriteJSONError(w, attachmentProcessing())
+		return
+	}
+
+	blob, err := storage.Blobs.Get(ctx, key)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error storage.Get for AttachmentId: %s : %v", attachmentId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, blob)
+	if err != nil {
+		logrus.Errorf("error streaming AttachmentId: %s : %v", attachmentId, err)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/util"
+	"net/http"
+)
+
+// withRole lets through the protected requests of identities holding one of
+// the roles.
+func withRole(handler http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.FromContext(r.Context())
+		for _, role := range roles {
+			if identity.HasRole(role) {
+				handler(w, r)
+				return
+			}
+		}
+		util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "not allowed for this account"))
+	}
+}
+
+// accountOwner lets through the protected requests of the account named by the
+// account_id path var, and of admins.
+func accountOwner(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.FromContext(r.Context())
+		if identity.AccountId != mux.Vars(r)["account_id"] && !identity.HasRole(auth.RoleAdmin) {
+			util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "not allowed for this account"))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// messagesStream names the resume token of the messages change stream.
+const messagesStream = "messages"
+
+// changeStreamNamespace derives bus event ids from resume tokens, so that a
+// change published again after a restart keeps its id and is dropped by the
+// bus as a duplicate.
+var changeStreamNamespace = uuid.MustParse("6f1c0d2e-41a7-4b8e-9a55-2f3c8e7d1b90")
+
+// changedMessage holds the fields channel and thread messages have in common.
+type changedMessage struct {
+	MessageId uuid.UUID                `bson:"message_id"`
+	ChannelId uuid.UUID                `bson:"channel_id"`
+	ThreadId  uuid.UUID                `bson:"thread_id"`
+	Content   models.Content           `bson:"content"`
+	Reactions []models.MessageReaction `bson:"reactions"`
+	Files     []models.File            `bson:"files"`
+	EditedAt  *time.Time               `bson:"edited_at"`
+	Deleted   *models.Tombstone        `bson:"deleted"`
+}
+
+func (m changedMessage) scope() (string, uuid.UUID) {
+	if m.ThreadId != uuid.Nil {
+		return "thread_id", m.ThreadId
+	}
+	return "channel_id", m.ChannelId
+}
+
+// StartChangeStreamFanOut, when change streams are enabled, turns writes other
+// services make to the messages collection into the socket events the engine
+// sends for its own, published on the bus. The engine's own writes are left to
+// the outbox. Handled changes are remembered by resume token, so a restart
+// picks up where the last run stopped.
+func StartChangeStreamFanOut(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if !config.Config.ChangeStreams.Enabled {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := mongo.EnableMessagePreImages(ctx)
+	cancel()
+	if err != nil {
+		logrus.Warnf("messages deleted outside the engine are not fanned out: %v", err)
+	}
+
+	for {
+		err := watchMessageChanges()
+		if mongo.IsChangeStreamHistoryLost(err) {
+			logrus.Errorf("messages change stream fell off the oplog, changes since its resume token are skipped: %v", err)
+			err = mongo.DeleteResumeToken(context.Background(), messagesStream)
+		}
+		if err != nil {
+			logrus.Errorf("error watching messages: %v", err)
+		}
+		time.Sleep(outboxPollInterval)
+	}
+}
+
+func watchMessageChanges() error {
+	token, err := mongo.FindResumeToken(context.Background(), messagesStream)
+	if err != nil {
+		return err
+	}
+
+	return mongo.WatchMessages(context.Background(), token, func(change mongo.MessageChange) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// the outbox publishes the engine's own writes
+		if !change.ByEngine {
+			err := publishMessageChange(ctx, change)
+			if err != nil {
+				return err
+			}
+		}
+		return mongo.SaveResumeToken(ctx, messagesStream, change.Token)
+	})
+}
+
+func publishMessageChange(ctx context.Context, change mongo.MessageChange) error {
+	message, scopeKey, scopeId, err := messageChangeEvent(change)
+	if err != nil || message.Type == "" {
+		return err
+	}
+
+	recipients, err := scopeClients(ctx, scopeKey, scopeId.String())
+	if err != nil {
+		// there is no one to tell about a message of a channel that is gone
+		logrus.Errorf("error fanning out %s of a message in %s %s: %v", change.OperationType, scopeKey, scopeId, err)
+		return nil
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return mongo.PublishBusEvent(ctx, models.BusEvent{
+		Id:          uuid.NewSHA1(changeStreamNamespace, change.Token),
+		Recipients:  recipients,
+		Message:     string(body),
+		PublishedAt: time.Now().UTC(),
+	})
+}
+
+// messageChangeEvent returns the socket event of a change and the channel or
+// thread it is about, or a zero Message when the change tells clients nothing.
+func messageChangeEvent(change mongo.MessageChange) (models.Message, string, uuid.UUID, error) {
+	var after, before changedMessage
+	if change.Document != nil {
+		if err := bson.Unmarshal(change.Document, &after); err != nil {
+			return models.Message{}, "", uuid.Nil, err
+		}
+	}
+	if change.Before != nil {
+		if err := bson.Unmarshal(change.Before, &before); err != nil {
+			return models.Message{}, "", uuid.Nil, err
+		}
+	}
+
+	switch change.OperationType {
+	case "insert":
+		scopeKey, scopeId := after.scope()
+		stored, err := decodeChangedMessage(change.Document, scopeKey)
+		if err != nil {
+			return models.Message{}, "", uuid.Nil, err
+		}
+		event := models.Message{Type: NewChannelMessage, Payload: map[string]interface{}{"catache_channel_message": stored}}
+		if scopeKey == "thread_id" {
+			event = models.Message{Type: NewThreadMessage, Payload: map[string]interface{}{"catache_thread_message": stored}}
+		}
+		return event, scopeKey, scopeId, nil
+
+	case "delete":
+		// without a pre-image the message cannot be told apart, and purged
+		// tombstones were announced when they were deleted
+		if change.Before == nil || before.Deleted != nil {
+			return models.Message{}, "", uuid.Nil, nil
+		}
+		scopeKey, scopeId := before.scope()
+		tombstone := models.Tombstone{DeletedAt: time.Now().UTC()}
+		return messageDeletedEvent(scopeKey, scopeId.String(), before.MessageId.String(), tombstone), scopeKey, scopeId, nil
+	}
+
+	// an update or replace of a message deleted since has no document
+	if change.Document == nil {
+		return models.Message{}, "", uuid.Nil, nil
+	}
+	scopeKey, scopeId := after.scope()
+
+	changed := map[string]bool{}
+	for _, field := range change.ChangedFields {
+		changed[field] = true
+	}
+	if change.OperationType == "replace" {
+		if change.Before != nil {
+			changed["deleted"] = (before.Deleted == nil) != (after.Deleted == nil)
+			changed["content"] = !before.Content.Equal(after.Content)
+			changed["files"] = !models.SameFiles(before.Files, after.Files)
+			changed["reactions"] = !reflect.DeepEqual(before.Reactions, after.Reactions)
+		} else {
+			changed["content"], changed["files"] = true, true
+		}
+	}
+
+	switch {
+	case changed["deleted"] && after.Deleted != nil:
+		return messageDeletedEvent(scopeKey, scopeId.String(), after.MessageId.String(), *after.Deleted), scopeKey, scopeId, nil
+
+	case changed["deleted"]:
+		stored, err := decodeChangedMessage(change.Document, scopeKey)
+		if err != nil {
+			return models.Message{}, "", uuid.Nil, err
+		}
+		return messageRestoredEvent(stored), scopeKey, scopeId, nil
+
+	case changed["content"] || changed["files"]:
+		changes := map[string]interface{}{}
+		if changed["content"] {
+			changes["content"] = after.Content
+		}
+		if changed["files"] {
+			changes["files"] = after.Files
+		}
+		return messageEditedEvent("", scopeKey, scopeId, after.MessageId, after.EditedAt, changes), scopeKey, scopeId, nil
+
+	case changed["reactions"]:
+		event := reactionChangedEvent("", scopeKey, scopeId.String(), after.MessageId.String(), after.Reactions)
+		return event, scopeKey, scopeId, nil
+	}
+	return models.Message{}, "", uuid.Nil, nil
+}
+
+func decodeChangedMessage(document bson.Raw, scopeKey string) (interface{}, error) {
+	if scopeKey == "thread_id" {
+		var stored models.ThreadMessage
+		err := bson.Unmarshal(document, &stored)
+		return stored, err
+	}
+	var stored models.ChannelMessage
+	err := bson.Unmarshal(document, &stored)
+	return stored, err
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcceptConnectionAuthenticatesHandshake(t *testing.T) {
+	secret := "connect test secret"
+	config.Config.Auth.AuthMiddlewareSecretKey = secret
+	t.Cleanup(func() { config.Config.Auth.AuthMiddlewareSecretKey = "" })
+
+	ClientPool = models.NewClientPool()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go ClientPool.Start(&wg)
+
+	server := httptest.NewServer(http.HandlerFunc(AcceptConnection))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	token, err := auth.SignToken(auth.Identity{AccountId: "alice"}, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolToken, err := auth.SignToken(auth.Identity{AccountId: "carol"}, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := auth.SignToken(auth.Identity{AccountId: "alice"}, []byte("another secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		query      string
+		header     http.Header
+		wantStatus int
+		wantClient string
+	}{
+		{"no token", "?client_id=alice", nil, http.StatusUnauthorized, ""},
+		{"forged token", "?access_token=" + forged, nil, http.StatusUnauthorized, ""},
+		{"another account's client_id", "?client_id=bob&access_token=" + token, nil, http.StatusForbidden, ""},
+		{"token in the query", "?access_token=" + token, nil, http.StatusSwitchingProtocols, "alice"},
+		{"token in the header", "?client_id=carol", http.Header{"Authorization": {"Bearer " + carolToken}}, http.StatusSwitchingProtocols, "carol"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, resp, err := websocket.DefaultDialer.Dial(url+test.query, test.header)
+			if conn != nil {
+				defer conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("no handshake response: %v", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("handshake answered %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus != http.StatusSwitchingProtocols {
+				return
+			}
+
+			waitFor := time.Now().Add(time.Second)
+			for ClientPool.GetTheClient(test.wantClient) == nil {
+				if time.Now().After(waitFor) {
+					t.Fatal("the connection was not registered as the token's account")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
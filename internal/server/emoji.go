@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// validateReactionEmoji accepts a Unicode emoji or a :short_code: reference to
+// a registered custom emoji.
+func validateReactionEmoji(ctx context.Context, code string) error {
+	if models.IsUnicodeEmoji(code) {
+		return nil
+	}
+
+	shortCode, ok := models.CustomEmojiShortCode(code)
+	if ok {
+		found, err := mongo.FindCustomEmojiByNames(ctx, []string{shortCode})
+		if err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			return nil
+		}
+	}
+
+	return util.NewAPIError(
+		http.StatusBadRequest,
+		util.CodeInvalidRequest,
+		"unknown emoji "+code,
+		util.FieldError{Field: "emoji_unified_code", Message: "must be a Unicode emoji or a registered :short_code:"},
+	)
+}
+
+// validateContentEmoji rejects content referencing unregistered :short_code:
+// emoji. Unicode emoji need no checking.
+func validateContentEmoji(ctx context.Context, content models.Content) error {
+	shortCodes := content.CustomEmojiShortCodes()
+	if len(shortCodes) == 0 {
+		return nil
+	}
+
+	found, err := mongo.FindCustomEmojiByNames(ctx, shortCodes)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, emoji := range found {
+		for _, name := range emoji.Names() {
+			known[name] = true
+		}
+	}
+
+	var details []util.FieldError
+	for _, shortCode := range shortCodes {
+		if !known[shortCode] {
+			details = append(details, util.FieldError{Field: "content", Message: "unknown emoji :" + shortCode + ":"})
+		}
+	}
+	if len(details) > 0 {
+		return util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "content references unknown emoji", details...)
+	}
+	return nil
+}
+
+func HandleNewCustomEmoji(w http.ResponseWriter, r *http.Request) {
+	type got struct {
+		ShortCode        string   `json:"short_code"`
+		ImageUrl         string   `json:"image_url"`
+		CreatorAccountId string   `json:"creator_account_id"`
+		Aliases          []string `json:"aliases"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		logrus.Errorf("error decoding JSON body when HandleNewCustomEmoji, %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var details []util.FieldError
+	for _, name := range append([]string{g.ShortCode}, g.Aliases...) {
+		if !models.ShortCodePattern.MatchString(name) {
+			details = append(details, util.FieldError{Field: "short_code", Message: "invalid short code or alias " + name})
+		}
+	}
+	if g.ImageUrl == "" {
+		details = append(details, util.FieldError{Field: "image_url", Message: "is required"})
+	}
+	creatorId, err := uuid.Parse(g.CreatorAccountId)
+	if err != nil {
+		details = append(details, util.FieldError{Field: "creator_account_id", Message: "must be a uuid"})
+	}
+	if len(details) > 0 {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "invalid custom emoji", details...))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newEmoji := models.CustomEmoji{
+		ShortCode:        g.ShortCode,
+		ImageUrl:         g.ImageUrl,
+		CreatorAccountId: creatorId,
+		Aliases:          g.Aliases,
+		DateCreated:      time.Now().UTC(),
+	}
+
+	err = mongo.NewCustomEmoji(ctx, newEmoji)
+	if errors.Is(err, mongo.ErrEmojiTaken) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.NewCustomEmoji: %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	ClientPool.Broadcast(emojiAddedEvent(newEmoji))
+	util.WriteJSONData(w, http.StatusCreated, newEmoji)
+}
+
+func HandleGetCustomEmoji(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundEmoji, err := mongo.FindCustomEmoji(ctx)
+	if err != nil {
+		logrus.Errorf("error db.FindCustomEmoji: %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundEmoji)
+}
+
+func HandleDeleteCustomEmoji(w http.ResponseWriter, r *http.Request) {
+	type got struct {
+		AccountId string `json:"account_id"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		logrus.Errorf("error decoding JSON body when HandleDeleteCustomEmoji, %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	shortCode := strings.ToLower(mux.Vars(r)["short_code"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = mongo.DeleteCustomEmoji(ctx, shortCode, g.AccountId)
+	if errors.Is(err, mongo.ErrEmojiNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.DeleteCustomEmoji for ShortCode: %s : %v", shortCode, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	ClientPool.Broadcast(emojiRemovedEvent(shortCode))
+	util.WriteJSONData(w, http.StatusOK, map[string]string{"short_code": shortCode})
+}
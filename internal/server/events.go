@@ -0,0 +1,190 @@
+package server
+
+import (
+	"github.com/google/uuid"
+	"messaging-engine/internal/models"
+	"time"
+)
+
+// events pushed by the engine to clients
+const (
+	MessageAccepted = "MESSAGE_ACCEPTED"
+	MessageEdited   = "MESSAGE_EDITED"
+	MessageDeleted  = "MESSAGE_DELETED"
+	MessageRestored = "MESSAGE_RESTORED"
+	ReactionChanged = "REACTION_CHANGED"
+	EmojiAdded      = "EMOJI_ADDED"
+	EmojiRemoved    = "EMOJI_REMOVED"
+
+	AttachmentProcessed = "ATTACHMENT_PROCESSED"
+	Mentioned           = "MENTIONED"
+	KeywordAlert        = "KEYWORD_ALERT"
+
+	NotificationSettingsChanged = "NOTIFICATION_SETTINGS_CHANGED"
+)
+
+// messageAcceptedEvent acknowledges a new message to its sender with the stored
+// copy, whose id, author and date_created are the server's. The sender matches
+// it to its optimistic local copy by idempotency_key, or by client_message_id
+// when it sent one. A retried submission is acknowledged with the original
+// message.
+func messageAcceptedEvent(idempotencyKey string, clientMessageId uuid.UUID, duplicate bool, stored interface{}) models.Message {
+	payload := map[string]interface{}{
+		"idempotency_key": idempotencyKey,
+		"duplicate":       duplicate,
+		"message":         stored,
+	}
+	if clientMessageId != uuid.Nil {
+		payload["client_message_id"] = clientMessageId
+	}
+
+	return models.Message{
+		Type:    MessageAccepted,
+		Payload: payload,
+	}
+}
+
+// editChanges lists only the fields an edit changed.
+func editChanges(beforeContent, afterContent models.Content, beforeFiles, afterFiles []models.File) map[string]interface{} {
+	changes := map[string]interface{}{}
+	if !beforeContent.Equal(afterContent) {
+		changes["content"] = afterContent
+	}
+	if !models.SameFiles(beforeFiles, afterFiles) {
+		changes["files"] = afterFiles
+	}
+	return changes
+}
+
+func channelMessageEditedEvent(sendTo string, before, after models.ChannelMessage) models.Message {
+	changes := editChanges(before.Content, after.Content, before.Files, after.Files)
+	return messageEditedEvent(sendTo, "channel_id", after.ChannelId, after.MessageId, after.EditedAt, changes)
+}
+
+func threadMessageEditedEvent(sendTo string, before, after models.ThreadMessage) models.Message {
+	changes := editChanges(before.Content, after.Content, before.Files, after.Files)
+	return messageEditedEvent(sendTo, "thread_id", after.ThreadId, after.MessageId, after.EditedAt, changes)
+}
+
+// messageEditedEvent carries only the fields an edit changed. scopeKey is
+// channel_id or thread_id.
+func messageEditedEvent(
+	sendTo, scopeKey string,
+	scopeId, messageId uuid.UUID,
+	editedAt *time.Time,
+	changes map[string]interface{},
+) models.Message {
+	return models.Message{
+		Type:   MessageEdited,
+		SendTo: sendTo,
+		Payload: map[string]interface{}{
+			scopeKey:     scopeId,
+			"message_id": messageId,
+			"edited_at":  editedAt,
+			"changes":    changes,
+		},
+	}
+}
+
+// messageDeletedEvent tells clients to replace their cached copy of a message
+// with a tombstone. scopeKey is channel_id or thread_id.
+func messageDeletedEvent(scopeKey, scopeId, messageId string, tombstone models.Tombstone) models.Message {
+	return models.Message{
+		Type: MessageDeleted,
+		Payload: map[string]interface{}{
+			scopeKey:     scopeId,
+			"message_id": messageId,
+			"deleted":    tombstone,
+		},
+	}
+}
+
+// messageRestoredEvent carries the full restored message.
+func messageRestoredEvent(restored interface{}) models.Message {
+	return models.Message{
+		Type:    MessageRestored,
+		Payload: map[string]interface{}{"message": restored},
+	}
+}
+
+// reactionChangedEvent carries a message's new reaction aggregate as seen by the
+// recipient. scopeKey is channel_id or thread_id.
+func reactionChangedEvent(sendTo, scopeKey, scopeId, messageId string, reactions []models.MessageReaction) models.Message {
+	viewerId, _ := uuid.Parse(sendTo)
+
+	return models.Message{
+		Type:   ReactionChanged,
+		SendTo: sendTo,
+		Payload: map[string]interface{}{
+			scopeKey:     scopeId,
+			"message_id": messageId,
+			"reactions":  models.SummarizeReactions(reactions, viewerId, reactionSummaryReactors()),
+		},
+	}
+}
+
+// emojiAddedEvent and emojiRemovedEvent let clients refresh their emoji pickers.
+func emojiAddedEvent(emoji models.CustomEmoji) models.Message {
+	return models.Message{
+		Type:    EmojiAdded,
+		Payload: map[string]interface{}{"emoji": emoji},
+	}
+}
+
+func emojiRemovedEvent(shortCode string) models.Message {
+	return models.Message{
+		Type:    EmojiRemoved,
+		Payload: map[string]interface{}{"short_code": shortCode},
+	}
+}
+
+// attachmentProcessedEvent carries a processed image's dimensions and
+// thumbnails. The image can be downloaded from now on.
+func attachmentProcessedEvent(job attachmentJob, attachment models.Attachment) models.Message {
+	return models.Message{
+		Type: AttachmentProcessed,
+		Payload: map[string]interface{}{
+			job.scopeKey: job.scopeId,
+			"message_id": job.messageId,
+			"attachment": attachment,
+		},
+	}
+}
+
+// mentionedEvent tells an account it was mentioned, with the inbox entry and
+// the stored message.
+func mentionedEvent(mention models.Mention, stored interface{}) models.Message {
+	return models.Message{
+		Type:   Mentioned,
+		SendTo: mention.AccountId,
+		Payload: map[string]interface{}{
+			"mention": mention,
+			"message": stored,
+		},
+	}
+}
+
+func keywordAlertEvent(sendTo, keyword, channelId, threadId string, stored interface{}) models.Message {
+	payload := map[string]interface{}{
+		"keyword":    keyword,
+		"channel_id": channelId,
+		"message":    stored,
+	}
+	if threadId != "" {
+		payload["thread_id"] = threadId
+	}
+
+	return models.Message{
+		Type:    KeywordAlert,
+		SendTo:  sendTo,
+		Payload: payload,
+	}
+}
+
+func notificationSettingsChangedEvent(settings models.NotificationSettings) models.Message {
+	return models.Message{
+		Type:    NotificationSettingsChanged,
+		SendTo:  settings.AccountId,
+		Payload: map[string]interface{}{"settings": settings},
+	}
+}
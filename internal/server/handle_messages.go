@@ -2,13 +2,20 @@ package server
 
 import (
 	"context"
+	"errors"
+	"github.com/google/uuid"
 	"github.com/mitchellh/mapstructure"
-	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/config"
 	"messaging-engine/internal/db/mongo"
 	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"reflect"
 	"time"
 )
 
+const defaultDedupeWindow = time.Hour
+
 const (
 	NewChannelMessage            = "NEW_CHANNEL_MESSAGE"
 	NewThreadMessage             = "NEW_THREAD_MESSAGE"
@@ -20,275 +27,774 @@ const (
 	NewThreadMessageReaction     = "NEW_THREAD_MESSAGE_REACTION"
 	DeleteChannelMessageReaction = "DELETE_CHANNEL_MESSAGE_REACTION"
 	DeleteThreadMessageReaction  = "DELETE_THREAD_MESSAGE_REACTION"
+	ToggleChannelMessageReaction = "TOGGLE_CHANNEL_MESSAGE_REACTION"
+	ToggleThreadMessageReaction  = "TOGGLE_THREAD_MESSAGE_REACTION"
+	FollowThread                 = "FOLLOW_THREAD"
+	UnfollowThread               = "UNFOLLOW_THREAD"
+	ReadThread                   = "READ_THREAD"
+	ReadMentions                 = "READ_MENTIONS"
+	SetAppState                  = "SET_APP_STATE"
 )
 
-func HandleMessage(message models.Message) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// invalidPayload reports a payload that does not decode into the shape its
+// message type expects.
+func invalidPayload(err error) error {
+	return util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error())
+}
 
-	switch message.Type {
+// actingAccountId returns the account a message acts for. A connected client
+// always acts as the account it connected with, whatever the payload claims;
+// only server-side calls, which have no sender and are made with a service
+// token, may name the account.
+func actingAccountId(senderId, claimed string) (uuid.UUID, error) {
+	if senderId != "" {
+		claimed = senderId
+	}
 
-	case NewChannelMessage:
-		var got models.ChannelMessage
-		err := mapstructure.Decode(message.Payload["catache_channel_message"], &got)
-		if err != nil {
-			logrus.Errorf("error when handling NewChannelMessage: mapstructure.Decode: %v", err)
-			return err
-		}
+	accountId, err := uuid.Parse(claimed)
+	if err != nil {
+		return accountId, util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"invalid account id",
+			util.FieldError{Field: "account_id", Message: "must be a uuid"},
+		)
+	}
+	return accountId, nil
+}
 
-		got.DateCreated = time.Now().UTC()
+// requireChannelClient rejects a connected sender from a channel it is not a
+// client of. Server-side calls are trusted.
+func requireChannelClient(ctx context.Context, senderId, channelId string) error {
+	if senderId == "" {
+		return nil
+	}
 
-		err = mongo.InsertChannelMessage(ctx, got)
-		if err != nil {
-			logrus.Errorf("error when handling NewMessage: InsertChannelMessage: %v", err)
-			return err
-		}
+	channel, err := mongo.FindChannelById(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	if !channel.HasClient(senderId) {
+		return util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "not a client of channel "+channelId)
+	}
+	return nil
+}
 
-	case NewThreadMessage:
-		var got models.ThreadMessage
-		err := mapstructure.Decode(message.Payload["catache_thread_message"], &got)
-		if err != nil {
-			logrus.Errorf("error when handling NewThreadMessage: mapstructure.Decode: %v", err)
-			return err
-		}
+func requireThreadClient(ctx context.Context, senderId, threadId string) error {
+	if senderId == "" {
+		return nil
+	}
 
-		got.DateCreated = time.Now().UTC()
+	thread, err := mongo.FindThreadById(ctx, threadId)
+	if err != nil {
+		return err
+	}
+	return requireChannelClient(ctx, senderId, thread.ChannelId)
+}
 
-		err = mongo.InsertThreadMessage(ctx, got)
-		if err != nil {
-			logrus.Errorf("error when handling NewThreadMessage: InsertMessage: %v", err)
-			return err
-		}
+// decodePayload decodes a message payload, also accepting message content as
+// a bare string of text, and ids and timestamps as the strings JSON has them
+// as.
+func decodePayload(input interface{}, output interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+				if to == reflect.TypeOf(models.Content{}) && from.Kind() == reflect.String {
+					return models.Content{Text: data.(string)}, nil
+				}
+				return data, nil
+			},
+			mapstructure.TextUnmarshallerHookFunc(),
+		),
+		Result: output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
 
-	case UpdateChannelMessage:
-		type expected struct {
-			NewChannelMessage models.ChannelMessage `mapstructure:"new_catache_channel_message"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf("error when handling UpdateChannelMessage: mapstructure.Decode: %v", err)
-			return err
-		}
+// parseContent parses the text of a new or edited message into its content.
+func parseContent(ctx context.Context, content models.Content) (models.Content, error) {
+	maxLength := config.Config.MaxContentLength
+	if maxLength <= 0 {
+		maxLength = models.DefaultMaxContentLength
+	}
 
-		err = mongo.UpdateChannelMessage(
-			ctx,
-			got.NewChannelMessage.ChannelId.String(),
-			got.NewChannelMessage.MessageId.String(),
-			got.NewChannelMessage,
+	parsed, err := models.ParseContent(content.Text, maxLength)
+	if err != nil {
+		return parsed, util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			err.Error(),
+			util.FieldError{Field: "content", Message: err.Error()},
 		)
-		if err != nil {
-			logrus.Errorf(
-				"error when handling UpdateMessage: UpdateChannelMessage: %v",
-				err,
-			)
-			return err
-		}
+	}
+	return parsed, validateContentEmoji(ctx, parsed)
+}
 
-	case UpdateThreadMessage:
-		type expected struct {
-			NewThreadMessage models.ThreadMessage `mapstructure:"new_catache_thread_message"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf("error when handling UpdateThreadMessage: mapstructure.Decode: %v", err)
-			return err
-		}
+func dedupeWindow() time.Duration {
+	if minutes := config.Config.DedupeWindowMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultDedupeWindow
+}
+
+func init() {
+	RegisterMessageType(NewChannelMessage, handleNewChannelMessage)
+	RegisterMessageType(NewThreadMessage, handleNewThreadMessage)
+	RegisterMessageType(UpdateChannelMessage, handleUpdateChannelMessage)
+	RegisterMessageType(UpdateThreadMessage, handleUpdateThreadMessage)
+	RegisterMessageType(DeleteChannelMessage, handleDeleteChannelMessage)
+	RegisterMessageType(DeleteThreadMessage, handleDeleteThreadMessage)
+	RegisterMessageType(NewChannelMessageReaction, handleNewChannelMessageReaction)
+	RegisterMessageType(NewThreadMessageReaction, handleNewThreadMessageReaction)
+	RegisterMessageType(DeleteChannelMessageReaction, handleDeleteChannelMessageReaction)
+	RegisterMessageType(DeleteThreadMessageReaction, handleDeleteThreadMessageReaction)
+	RegisterMessageType(ToggleChannelMessageReaction, handleToggleChannelMessageReaction)
+	RegisterMessageType(ToggleThreadMessageReaction, handleToggleThreadMessageReaction)
+	RegisterMessageType(FollowThread, handleFollowThread)
+	RegisterMessageType(UnfollowThread, handleFollowThread)
+	RegisterMessageType(ReadThread, handleReadThread)
+	RegisterMessageType(ReadMentions, handleReadMentions)
+	RegisterMessageType(SetAppState, handleSetAppState, ConnectedOnly, Unlimited)
+}
 
-		err = mongo.UpdateThreadMessage(
-			ctx,
-			got.NewThreadMessage.ThreadId.String(),
-			got.NewThreadMessage.MessageId.String(),
-			got.NewThreadMessage,
+// idempotencyKey is the key clients attach to new messages so that their
+// retries are not stored twice.
+type idempotencyKey struct {
+	IdempotencyKey string `mapstructure:"idempotency_key" schema:"required"`
+}
+
+func (k idempotencyKey) Validate() error {
+	if k.IdempotencyKey == "" {
+		return util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"idempotency_key is required",
+			util.FieldError{Field: "idempotency_key", Message: "is required"},
 		)
-		if err != nil {
-			logrus.Errorf(
-				"error when handling UpdateMessage: UpdateChannelMessage: %v",
-				err,
-			)
-			return err
-		}
+	}
+	return nil
+}
 
-	case DeleteChannelMessage:
-		type expected struct {
-			MessageId       string `mapstructure:"message_id"`
-			AuthorAccountId string `mapstructure:"author_account_id"`
-			ChannelId       string `mapstructure:"channel_id"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf("error when handling DeleteChannelMessage: mapstructure.Decode: %v", err)
+// newMessageScope is what posting a message differs in between channels and
+// threads.
+type newMessageScope[M any] struct {
+	scopeKey   string // channel_id or thread_id
+	payloadKey string // of the stored message in the event delivered to the recipient
+	fields     func(m *M) newMessageFields
+	insert     func(ctx context.Context, m M, idempotencyKey string, window time.Duration) (M, bool, error)
+	notify     func(ctx context.Context, changes *changeSet, message models.Message, stored M) error
+}
+
+// newMessageFields points at the fields of a channel or thread message the
+// server fills in.
+type newMessageFields struct {
+	scopeId         uuid.UUID
+	messageId       *uuid.UUID
+	authorAccountId *uuid.UUID
+	dateCreated     *time.Time
+	content         *models.Content
+	files           *[]models.File
+}
+
+var channelMessageScope = newMessageScope[models.ChannelMessage]{
+	scopeKey:   "channel_id",
+	payloadKey: "catache_channel_message",
+	fields: func(m *models.ChannelMessage) newMessageFields {
+		return newMessageFields{m.ChannelId, &m.MessageId, &m.AuthorAccountId, &m.DateCreated, &m.Content, &m.Files}
+	},
+	insert: mongo.InsertChannelMessage,
+	notify: notifyChannelMessage,
+}
+
+var threadMessageScope = newMessageScope[models.ThreadMessage]{
+	scopeKey:   "thread_id",
+	payloadKey: "catache_thread_message",
+	fields: func(m *models.ThreadMessage) newMessageFields {
+		return newMessageFields{m.ThreadId, &m.MessageId, &m.AuthorAccountId, &m.DateCreated, &m.Content, &m.Files}
+	},
+	insert: mongo.InsertThreadMessage,
+	notify: notifyThreadMessage,
+}
+
+type newChannelMessagePayload struct {
+	idempotencyKey `mapstructure:",squash"`
+	Message        models.ChannelMessage `mapstructure:"catache_channel_message" schema:"required"`
+}
+
+func (p newChannelMessagePayload) Scope() (string, string) {
+	return "channel_id", p.Message.ChannelId.String()
+}
+
+func handleNewChannelMessage(req *MessageRequest, payload *newChannelMessagePayload) (models.Message, error) {
+	return postMessage(req, payload.IdempotencyKey, payload.Message, channelMessageScope)
+}
+
+type newThreadMessagePayload struct {
+	idempotencyKey `mapstructure:",squash"`
+	Message        models.ThreadMessage `mapstructure:"catache_thread_message" schema:"required"`
+}
+
+func (p newThreadMessagePayload) Scope() (string, string) {
+	return "thread_id", p.Message.ThreadId.String()
+}
+
+func handleNewThreadMessage(req *MessageRequest, payload *newThreadMessagePayload) (models.Message, error) {
+	return postMessage(req, payload.IdempotencyKey, payload.Message, threadMessageScope)
+}
+
+// postMessage stores a new channel or thread message, acknowledges it to its
+// sender and delivers it. The sender is a client of the channel or thread, as
+// authorizeMessages checked.
+func postMessage[M any](req *MessageRequest, idempotencyKey string, got M, scope newMessageScope[M]) (models.Message, error) {
+	ctx, senderId, message, fields := req.Context, req.SenderId, req.Message, scope.fields(&got)
+
+	// ids, authorship and timestamps are the server's, the id the client
+	// sent only lets it match the acknowledgement to its local copy
+	clientMessageId := *fields.messageId
+	var err error
+	*fields.messageId, err = uuid.NewV7()
+	if err != nil {
+		return models.Message{}, err
+	}
+	*fields.authorAccountId, err = actingAccountId(senderId, fields.authorAccountId.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+	*fields.dateCreated = time.Now().UTC()
+
+	*fields.content, err = parseContent(ctx, *fields.content)
+	if err != nil {
+		return models.Message{}, err
+	}
+	*fields.files, err = resolveAttachments(ctx, *fields.authorAccountId, *fields.files)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	var stored M
+	var duplicate bool
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		var err error
+		stored, duplicate, err = scope.insert(txCtx, got, idempotencyKey, dedupeWindow())
+		if err != nil || duplicate {
 			return err
 		}
 
-		err = mongo.DeleteChannelMessage(
-			ctx,
-			got.ChannelId,
-			got.MessageId,
-			got.AuthorAccountId,
+		message.Payload[scope.payloadKey] = stored
+		changes.send([]string{senderId}, messageAcceptedEvent(idempotencyKey, clientMessageId, false, stored))
+		changes.send([]string{message.SendTo}, message)
+		changes.webhook(models.WebhookMessageCreated, scope.scopeKey, fields.scopeId.String(), map[string]interface{}{"message": stored})
+		return scope.notify(txCtx, changes, message, stored)
+	})
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	if duplicate {
+		// already delivered the first time around, only the sender is told
+		ClientPool.SendMsgToClients([]string{senderId}, messageAcceptedEvent(idempotencyKey, clientMessageId, true, stored))
+		return models.Message{}, nil
+	}
+	storedFields := scope.fields(&stored)
+	processImageFiles(scope.scopeKey, storedFields.scopeId.String(), *storedFields.messageId, *storedFields.files)
+	return models.Message{}, nil
+}
+
+type updateChannelMessagePayload struct {
+	NewChannelMessage models.ChannelMessage `mapstructure:"new_catache_channel_message" schema:"required"`
+}
+
+func (p updateChannelMessagePayload) Scope() (string, string) {
+	return "channel_id", p.NewChannelMessage.ChannelId.String()
+}
+
+func handleUpdateChannelMessage(req *MessageRequest, payload *updateChannelMessagePayload) (models.Message, error) {
+	ctx, message, got := req.Context, req.Message, payload.NewChannelMessage
+
+	editorId, err := actingAccountId(req.SenderId, got.AuthorAccountId.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+	got.Files, err = resolveAttachments(ctx, editorId, got.Files)
+	if err != nil {
+		return models.Message{}, err
+	}
+	got.Content, err = parseContent(ctx, got.Content)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	var after models.ChannelMessage
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		before, edited, err := mongo.EditChannelMessage(
+			txCtx,
+			got.ChannelId.String(),
+			got.MessageId.String(),
+			editorId.String(),
+			got.Content,
+			got.Files,
 		)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteChannelMessage: DeleteChannelMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	case DeleteThreadMessage:
-		type expected struct {
-			MessageId       string `mapstructure:"message_id"`
-			AuthorAccountId string `mapstructure:"author_account_id"`
-			ThreadId        string `mapstructure:"thread_id"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf("error when handling DeleteThreadMessage: mapstructure.Decode: %v", err)
-			return err
-		}
+		after = edited
+		changes.send([]string{message.SendTo}, channelMessageEditedEvent(message.SendTo, before, after))
+		changes.webhook(models.WebhookMessageEdited, "channel_id", after.ChannelId.String(), map[string]interface{}{
+			"message": after,
+			"changes": editChanges(before.Content, after.Content, before.Files, after.Files),
+		})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotEditable) {
+		return models.Message{}, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
 
-		err = mongo.DeleteThreadMessage(
-			ctx,
-			got.ThreadId,
-			got.MessageId,
-			got.AuthorAccountId,
+	processImageFiles("channel_id", after.ChannelId.String(), after.MessageId, after.Files)
+	return models.Message{}, nil
+}
+
+type updateThreadMessagePayload struct {
+	NewThreadMessage models.ThreadMessage `mapstructure:"new_catache_thread_message" schema:"required"`
+}
+
+func (p updateThreadMessagePayload) Scope() (string, string) {
+	return "thread_id", p.NewThreadMessage.ThreadId.String()
+}
+
+func handleUpdateThreadMessage(req *MessageRequest, payload *updateThreadMessagePayload) (models.Message, error) {
+	ctx, message, got := req.Context, req.Message, payload.NewThreadMessage
+
+	editorId, err := actingAccountId(req.SenderId, got.AuthorAccountId.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+	got.Files, err = resolveAttachments(ctx, editorId, got.Files)
+	if err != nil {
+		return models.Message{}, err
+	}
+	got.Content, err = parseContent(ctx, got.Content)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	var after models.ThreadMessage
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		before, edited, err := mongo.EditThreadMessage(
+			txCtx,
+			got.ThreadId.String(),
+			got.MessageId.String(),
+			editorId.String(),
+			got.Content,
+			got.Files,
 		)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteThreadMessage: DeleteThreadMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	case NewChannelMessageReaction:
-		type expected struct {
-			MessageId string                 `mapstructure:"message_id"`
-			ChannelId string                 `mapstructure:"channel_id"`
-			Reaction  models.MessageReaction `mapstructure:"reaction"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf(
-				"error when handling NewChannelMessageReaction: mapstructure.Decode: %v",
-				err,
-			)
-			return err
-		}
+		after = edited
+		changes.send([]string{message.SendTo}, threadMessageEditedEvent(message.SendTo, before, after))
+		changes.webhook(models.WebhookMessageEdited, "thread_id", after.ThreadId.String(), map[string]interface{}{
+			"message": after,
+			"changes": editChanges(before.Content, after.Content, before.Files, after.Files),
+		})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotEditable) {
+		return models.Message{}, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	processImageFiles("thread_id", after.ThreadId.String(), after.MessageId, after.Files)
+	return models.Message{}, nil
+}
+
+type deleteChannelMessagePayload struct {
+	MessageId       string `mapstructure:"message_id"        schema:"required,format=uuid"`
+	AuthorAccountId string `mapstructure:"author_account_id" schema:"format=uuid"` // the account deleting the message, taken from the sender when connected
+	ChannelId       string `mapstructure:"channel_id"        schema:"required,format=uuid"`
+	Reason          string `mapstructure:"reason"`
+}
+
+func (p deleteChannelMessagePayload) Scope() (string, string) {
+	return "channel_id", p.ChannelId
+}
 
-		err = mongo.AddReactionToChannelMessage(
-			ctx,
+func handleDeleteChannelMessage(req *MessageRequest, got *deleteChannelMessagePayload) (models.Message, error) {
+	ctx := req.Context
+
+	deletedBy, err := actingAccountId(req.SenderId, got.AuthorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+	byModerator, err := isChannelModerator(ctx, got.ChannelId, deletedBy.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	tombstone := models.Tombstone{
+		DeletedAt: time.Now().UTC(),
+		DeletedBy: deletedBy,
+		Reason:    got.Reason,
+	}
+	// every client of the channel drops the message, as they all get it back on restore
+	recipients, err := scopeClients(ctx, "channel_id", got.ChannelId)
+	if err != nil {
+		return models.Message{}, err
+	}
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		err := mongo.DeleteChannelMessage(
+			txCtx,
 			got.ChannelId,
 			got.MessageId,
-			got.Reaction,
+			tombstone,
+			byModerator,
 		)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling NewChannelMessageReaction: AddReactionToChannelMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	case NewThreadMessageReaction:
-		type expected struct {
-			MessageId string                 `mapstructure:"message_id"`
-			ThreadId  string                 `mapstructure:"thread_id"`
-			Reaction  models.MessageReaction `mapstructure:"reaction"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
-		if err != nil {
-			logrus.Errorf(
-				"error when handling NewThreadMessageReaction: mapstructure.Decode: %v",
-				err,
-			)
-			return err
-		}
+		changes.send(recipients, messageDeletedEvent("channel_id", got.ChannelId, got.MessageId, tombstone))
+		changes.webhook(models.WebhookMessageDeleted, "channel_id", got.ChannelId, map[string]interface{}{
+			"message_id": got.MessageId,
+			"tombstone":  tombstone,
+		})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotDeletable) {
+		return models.Message{}, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error())
+	}
+	return models.Message{}, err
+}
+
+type deleteThreadMessagePayload struct {
+	MessageId       string `mapstructure:"message_id"        schema:"required,format=uuid"`
+	AuthorAccountId string `mapstructure:"author_account_id" schema:"format=uuid"` // the account deleting the message, taken from the sender when connected
+	ThreadId        string `mapstructure:"thread_id"         schema:"required,format=uuid"`
+	Reason          string `mapstructure:"reason"`
+}
+
+func (p deleteThreadMessagePayload) Scope() (string, string) {
+	return "thread_id", p.ThreadId
+}
 
-		err = mongo.AddReactionToThreadMessage(
-			ctx,
+func handleDeleteThreadMessage(req *MessageRequest, got *deleteThreadMessagePayload) (models.Message, error) {
+	ctx := req.Context
+
+	deletedBy, err := actingAccountId(req.SenderId, got.AuthorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+	byModerator, err := isThreadModerator(ctx, got.ThreadId, deletedBy.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	tombstone := models.Tombstone{
+		DeletedAt: time.Now().UTC(),
+		DeletedBy: deletedBy,
+		Reason:    got.Reason,
+	}
+	recipients, err := scopeClients(ctx, "thread_id", got.ThreadId)
+	if err != nil {
+		return models.Message{}, err
+	}
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		err := mongo.DeleteThreadMessage(
+			txCtx,
 			got.ThreadId,
 			got.MessageId,
-			got.Reaction,
+			tombstone,
+			byModerator,
 		)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling NewThreadMessageReaction: AddReactionToThreadMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	case DeleteChannelMessageReaction:
-		type expected struct {
-			MessageId        string `mapstructure:"message_id"`
-			ReactorAccountId string `mapstructure:"reactor_account_id"`
-			ChannelId        string `mapstructure:"channel_id"`
-			EmojiUnifiedCode string `mapstructure:"emoji_unified_code"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
+		changes.send(recipients, messageDeletedEvent("thread_id", got.ThreadId, got.MessageId, tombstone))
+		changes.webhook(models.WebhookMessageDeleted, "thread_id", got.ThreadId, map[string]interface{}{
+			"message_id": got.MessageId,
+			"tombstone":  tombstone,
+		})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotDeletable) {
+		return models.Message{}, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error())
+	}
+	return models.Message{}, err
+}
+
+// commitReactionChange stores a reaction change made by change and publishes
+// the message's new reactions.
+func commitReactionChange(
+	req *MessageRequest,
+	scopeKey, scopeId, messageId string,
+	change func(txCtx context.Context) ([]models.MessageReaction, error),
+) (models.Message, error) {
+	sendTo := req.Message.SendTo
+
+	err := commitChange(req.Context, func(txCtx context.Context, changes *changeSet) error {
+		reactions, err := change(txCtx)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteChannelMessageReaction: mapstructure.Decode: %v",
-				err,
-			)
 			return err
 		}
 
-		err = mongo.RemoveReactionFromChannelMessage(
-			ctx,
-			got.ChannelId,
-			got.MessageId,
-			got.ReactorAccountId,
-			got.EmojiUnifiedCode,
-		)
+		changes.send([]string{sendTo}, reactionChangedEvent(sendTo, scopeKey, scopeId, messageId, reactions))
+		changes.webhook(models.WebhookReactionChanged, scopeKey, scopeId, map[string]interface{}{
+			"message_id": messageId,
+			"reactions":  reactions,
+		})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrReactionTargetMissing) {
+		return models.Message{}, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error())
+	}
+	return models.Message{}, err
+}
+
+type newChannelMessageReactionPayload struct {
+	MessageId string                 `mapstructure:"message_id" schema:"required,format=uuid"`
+	ChannelId string                 `mapstructure:"channel_id" schema:"required,format=uuid"`
+	Reaction  models.MessageReaction `mapstructure:"reaction"   schema:"required"`
+}
+
+func (p newChannelMessageReactionPayload) Scope() (string, string) {
+	return "channel_id", p.ChannelId
+}
+
+func handleNewChannelMessageReaction(req *MessageRequest, got *newChannelMessageReactionPayload) (models.Message, error) {
+	var err error
+	got.Reaction.ReactorAccountId, err = actingAccountId(req.SenderId, got.Reaction.ReactorAccountId.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = validateReactionEmoji(req.Context, got.Reaction.EmojiUnifiedCode)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return commitReactionChange(req, "channel_id", got.ChannelId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		return mongo.AddReactionToChannelMessage(txCtx, got.ChannelId, got.MessageId, got.Reaction)
+	})
+}
+
+type newThreadMessageReactionPayload struct {
+	MessageId string                 `mapstructure:"message_id" schema:"required,format=uuid"`
+	ThreadId  string                 `mapstructure:"thread_id"  schema:"required,format=uuid"`
+	Reaction  models.MessageReaction `mapstructure:"reaction"   schema:"required"`
+}
+
+func (p newThreadMessageReactionPayload) Scope() (string, string) {
+	return "thread_id", p.ThreadId
+}
+
+func handleNewThreadMessageReaction(req *MessageRequest, got *newThreadMessageReactionPayload) (models.Message, error) {
+	var err error
+	got.Reaction.ReactorAccountId, err = actingAccountId(req.SenderId, got.Reaction.ReactorAccountId.String())
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = validateReactionEmoji(req.Context, got.Reaction.EmojiUnifiedCode)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return commitReactionChange(req, "thread_id", got.ThreadId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		return mongo.AddReactionToThreadMessage(txCtx, got.ThreadId, got.MessageId, got.Reaction)
+	})
+}
+
+type channelMessageReactionPayload struct {
+	MessageId        string `mapstructure:"message_id"         schema:"required,format=uuid"`
+	ReactorAccountId string `mapstructure:"reactor_account_id" schema:"format=uuid"`
+	ChannelId        string `mapstructure:"channel_id"         schema:"required,format=uuid"`
+	EmojiUnifiedCode string `mapstructure:"emoji_unified_code" schema:"required"`
+}
+
+func (p channelMessageReactionPayload) Scope() (string, string) {
+	return "channel_id", p.ChannelId
+}
+
+func handleDeleteChannelMessageReaction(req *MessageRequest, got *channelMessageReactionPayload) (models.Message, error) {
+	reactorId, err := actingAccountId(req.SenderId, got.ReactorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return commitReactionChange(req, "channel_id", got.ChannelId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		return mongo.RemoveReactionFromChannelMessage(txCtx, got.ChannelId, got.MessageId, reactorId.String(), got.EmojiUnifiedCode)
+	})
+}
+
+func handleToggleChannelMessageReaction(req *MessageRequest, got *channelMessageReactionPayload) (models.Message, error) {
+	reactorId, err := actingAccountId(req.SenderId, got.ReactorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = validateReactionEmoji(req.Context, got.EmojiUnifiedCode)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	reaction := models.MessageReaction{ReactorAccountId: reactorId, EmojiUnifiedCode: got.EmojiUnifiedCode}
+	return commitReactionChange(req, "channel_id", got.ChannelId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		reactions, _, err := mongo.ToggleChannelMessageReaction(txCtx, got.ChannelId, got.MessageId, reaction)
+		return reactions, err
+	})
+}
+
+type threadMessageReactionPayload struct {
+	MessageId        string `mapstructure:"message_id"         schema:"required,format=uuid"`
+	ReactorAccountId string `mapstructure:"reactor_account_id" schema:"format=uuid"`
+	ThreadId         string `mapstructure:"thread_id"          schema:"required,format=uuid"`
+	EmojiUnifiedCode string `mapstructure:"emoji_unified_code" schema:"required"`
+}
+
+func (p threadMessageReactionPayload) Scope() (string, string) {
+	return "thread_id", p.ThreadId
+}
+
+func handleDeleteThreadMessageReaction(req *MessageRequest, got *threadMessageReactionPayload) (models.Message, error) {
+	reactorId, err := actingAccountId(req.SenderId, got.ReactorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return commitReactionChange(req, "thread_id", got.ThreadId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		return mongo.RemoveReactionFromThreadMessage(txCtx, got.ThreadId, got.MessageId, reactorId.String(), got.EmojiUnifiedCode)
+	})
+}
+
+func handleToggleThreadMessageReaction(req *MessageRequest, got *threadMessageReactionPayload) (models.Message, error) {
+	reactorId, err := actingAccountId(req.SenderId, got.ReactorAccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = validateReactionEmoji(req.Context, got.EmojiUnifiedCode)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	reaction := models.MessageReaction{ReactorAccountId: reactorId, EmojiUnifiedCode: got.EmojiUnifiedCode}
+	return commitReactionChange(req, "thread_id", got.ThreadId, got.MessageId, func(txCtx context.Context) ([]models.MessageReaction, error) {
+		reactions, _, err := mongo.ToggleThreadMessageReaction(txCtx, got.ThreadId, got.MessageId, reaction)
+		return reactions, err
+	})
+}
+
+type threadAccountPayload struct {
+	ThreadId  string `mapstructure:"thread_id"  schema:"required,format=uuid"`
+	AccountId string `mapstructure:"account_id" schema:"format=uuid"`
+}
+
+func (p threadAccountPayload) Scope() (string, string) {
+	return "thread_id", p.ThreadId
+}
+
+// handleFollowThread handles both FOLLOW_THREAD and UNFOLLOW_THREAD.
+func handleFollowThread(req *MessageRequest, got *threadAccountPayload) (models.Message, error) {
+	message := req.Message
+
+	accountId, err := actingAccountId(req.SenderId, got.AccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = commitChange(req.Context, func(txCtx context.Context, changes *changeSet) error {
+		var err error
+		if message.Type == FollowThread {
+			err = mongo.FollowThread(txCtx, got.ThreadId, accountId.String())
+		} else {
+			err = mongo.UnfollowThread(txCtx, got.ThreadId, accountId.String())
+		}
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteChannelMessageReaction: RemoveReactionFromChannelMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	case DeleteThreadMessageReaction:
-		type expected struct {
-			MessageId        string `mapstructure:"message_id"`
-			ReactorAccountId string `mapstructure:"reactor_account_id"`
-			ThreadId         string `mapstructure:"thread_id"`
-			EmojiUnifiedCode string `mapstructure:"emoji_unified_code"`
-		}
-		var got expected
-		err := mapstructure.Decode(message.Payload, &got)
+		changes.send([]string{message.SendTo}, message)
+		return nil
+	})
+	return models.Message{}, err
+}
+
+func handleReadThread(req *MessageRequest, got *threadAccountPayload) (models.Message, error) {
+	message := req.Message
+
+	accountId, err := actingAccountId(req.SenderId, got.AccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = commitChange(req.Context, func(txCtx context.Context, changes *changeSet) error {
+		err := mongo.ClearThreadUnread(txCtx, got.ThreadId, accountId.String())
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteThreadMessageReaction: mapstructure.Decode: %v",
-				err,
-			)
 			return err
 		}
 
-		err = mongo.RemoveReactionFromThreadMessage(
-			ctx,
-			got.ThreadId,
-			got.MessageId,
-			got.ReactorAccountId,
-			got.EmojiUnifiedCode,
-		)
+		changes.send([]string{message.SendTo}, message)
+		return nil
+	})
+	return models.Message{}, err
+}
+
+type readMentionsPayload struct {
+	AccountId  string   `mapstructure:"account_id" schema:"format=uuid"`
+	MessageIds []string `mapstructure:"message_ids"` // none marks the whole inbox read
+}
+
+func handleReadMentions(req *MessageRequest, got *readMentionsPayload) (models.Message, error) {
+	message := req.Message
+
+	accountId, err := actingAccountId(req.SenderId, got.AccountId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	err = commitChange(req.Context, func(txCtx context.Context, changes *changeSet) error {
+		_, err := mongo.MarkMentionsRead(txCtx, accountId.String(), got.MessageIds)
 		if err != nil {
-			logrus.Errorf(
-				"error when handling DeleteThreadMessageReaction: RemoveReactionFromThreadMessage: %v",
-				err,
-			)
 			return err
 		}
 
-	}
+		changes.send([]string{message.SendTo}, message)
+		return nil
+	})
+	return models.Message{}, err
+}
 
+type appStatePayload struct {
+	State string `mapstructure:"state" schema:"required,enum=foreground|background"`
+}
+
+func (p appStatePayload) Validate() error {
+	if p.State != "foreground" && p.State != "background" {
+		return util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"state must be foreground or background",
+			util.FieldError{Field: "state", Message: "must be foreground or background"},
+		)
+	}
 	return nil
 }
+
+// handleSetAppState records whether the sender's app is in the background,
+// where it is pushed notifications on top of its messages.
+func handleSetAppState(req *MessageRequest, got *appStatePayload) (models.Message, error) {
+	if client := ClientPool.GetTheClient(req.SenderId); client != nil {
+		client.SetBackgrounded(got.State == "background")
+	}
+	return models.Message{}, nil
+}
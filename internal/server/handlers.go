@@ -2,39 +2,107 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
 	"messaging-engine/internal/db/mongo"
 	"messaging-engine/internal/models"
 	"messaging-engine/internal/util"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 var ClientPool *models.ClientPool
 
+// pageLimit clamps a requested page size to the configured maximum, which is
+// also used when no size is requested.
+func pageLimit(requested int64) int64 {
+	maxPageSize := config.Config.MaxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = models.DefaultMaxPageSize
+	}
+
+	if requested <= 0 || requested > maxPageSize {
+		return maxPageSize
+	}
+	return requested
+}
+
+func reactionSummaryReactors() int {
+	if reactors := config.Config.ReactionSummaryReactors; reactors > 0 {
+		return reactors
+	}
+	return models.DefaultReactionSummaryReactors
+}
+
+// viewerFromURL reads the optional viewer_account_id query param that reaction
+// summaries report reacted_by_me for.
+func viewerFromURL(r *http.Request) (uuid.UUID, error) {
+	rawViewer := r.URL.Query().Get("viewer_account_id")
+	if rawViewer == "" {
+		return uuid.Nil, nil
+	}
+
+	viewerId, err := uuid.Parse(rawViewer)
+	if err != nil {
+		return uuid.Nil, errors.New("viewer_account_id must be a uuid")
+	}
+	return viewerId, nil
+}
+
+// AcceptConnection connects the account the handshake's token was issued to.
+// client_id may still be sent, by clients written before tokens were
+// required, but must name that account.
 func AcceptConnection(w http.ResponseWriter, r *http.Request) {
-	clientId, ok := r.URL.Query()["client_id"]
+	identity, err := auth.AuthenticateHandshake(r, []byte(config.Config.Auth.AuthMiddlewareSecretKey), time.Now())
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusUnauthorized, util.CodeUnauthorized, err.Error()))
+		return
+	}
+
+	clientId := identity.AccountId
+	if claimed := r.URL.Query().Get("client_id"); claimed != "" && claimed != clientId {
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusForbidden,
+			util.CodeForbidden,
+			"client_id is not the account of the token",
+			util.FieldError{Field: "client_id", Message: "must be the token's account"},
+		))
+		return
+	}
 
-	if !ok || len(clientId[0]) < 1 {
-		util.WriteJSONResponse(
-			w,
+	protocolVersion, err := models.NegotiateProtocolVersion(r.URL.Query().Get("protocol_version"))
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(
 			http.StatusBadRequest,
-			[]byte("client_id query param is missing"),
-		)
+			util.CodeInvalidRequest,
+			"protocol version cannot be negotiated",
+			util.FieldError{Field: "protocol_version", Message: err.Error()},
+		))
 		return
 	}
 
-	wsConnection, err := models.UpgradeHTTPToWS(w, r)
+	responseHeader := http.Header{}
+	responseHeader.Set(ProtocolVersionHeader, strconv.Itoa(protocolVersion))
+	wsConnection, err := models.UpgradeHTTPToWS(w, r, responseHeader)
 	if err != nil {
 		logrus.Errorf("error accepting connection, %v", err)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error connecting"))
+		util.WriteJSONError(w, err)
 		return
 	}
 
 	// create a new client
-	client := models.NewClient(clientId[0], wsConnection, ClientPool, HandleMessage)
+	client := models.NewClient(clientId, wsConnection, ClientPool, HandleMessage, protocolVersion)
+
+	// browsers cannot read the handshake response, later versions are told
+	// the version in the first frame
+	if protocolVersion >= models.ProtocolV2 {
+		client.Write(models.NewHelloMessage(client.ID, protocolVersion))
+	}
 
 	// register client into pool
 	ClientPool.Register <- client
@@ -53,130 +121,144 @@ func HandleSendMessageToClient(w http.ResponseWriter, r *http.Request) {
 	err := util.DecodeJSONBody(w, r, &g)
 	if err != nil {
 		logrus.Errorf("error decoding JSON body when HandleSendMessageToClient, %v", err)
-		util.WriteJSONResponse(w, http.StatusBadRequest, []byte("error"))
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	// server handles the message whether or not the client is online, an
+	// offline client is pushed a notification of it instead
+	if g.Message.SendTo == "" {
+		g.Message.SendTo = g.ClientId
+	}
+	identity, _ := auth.FromContext(r.Context())
+	outgoing, err := HandleServiceMessage(identity, w.Header().Get(util.RequestIdHeader), g.Message)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	if ClientPool.GetTheClient(g.ClientId) == nil {
+		util.WriteJSONData(w, http.StatusAccepted, map[string]bool{"delivered": false})
 		return
 	}
 
-	// check the client we are sending to is existing
-	clientId := g.ClientId
-	foundClient := ClientPool.GetTheClient(clientId)
-	if foundClient != nil {
-		// server handles the message
-		err := HandleMessage(g.Message)
+	// state changes reach the client through the outbox relay
+	if outgoing.SendTo != "" {
+		ClientPool.SendMsgToClient(outgoing)
+	}
+	util.WriteJSONData(w, http.StatusOK, map[string]bool{"delivered": true})
+}
+
+// limitFromURL reads the limit query param, clamped by pageLimit.
+func limitFromURL(r *http.Request) (int64, error) {
+	var limit int64
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.ParseInt(rawLimit, 10, 64)
 		if err != nil {
-			util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
-			return
-		} else {
-			// ready to send to another end client
-			ClientPool.SendMsgToClient(g.Message)
-			util.WriteJSONResponse(w, http.StatusOK, []byte("OK"))
-			return
+			return 0, errors.New("limit must be an integer")
 		}
 	}
 
-	util.WriteJSONResponse(w, http.StatusAccepted, []byte("Client not online."))
+	return pageLimit(limit), nil
 }
 
-func HandleGetChannelMessages(w http.ResponseWriter, r *http.Request) {
-	type got struct {
-		ChannelId      string    `json:"channel_id"`
-		DatetimeAnchor time.Time `json:"datetime_anchor"`
-		Pagination     int64     `json:"pagination"`
+// pageQueryFromURL reads the before, after, around and limit query params.
+func pageQueryFromURL(r *http.Request) (models.PageQuery, error) {
+	limit, err := limitFromURL(r)
+	if err != nil {
+		return models.PageQuery{}, err
 	}
 
-	var g got
-	err := util.DecodeJSONBody(w, r, &g)
+	params := r.URL.Query()
+	return models.NewPageQuery(params.Get("before"), params.Get("after"), params.Get("around"), limit)
+}
+
+func HandleGetChannelMessages(w http.ResponseWriter, r *http.Request) {
+	channelId := mux.Vars(r)["channel_id"]
+
+	query, err := pageQueryFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+	viewerId, err := viewerFromURL(r)
 	if err != nil {
-		logrus.Errorf("error decoding JSON body when HandleGetChannelMessages, %v", err)
-		util.WriteJSONResponse(w, http.StatusBadRequest, []byte("error"))
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	foundMessages, err := mongo.FindChannelMessagesByChannelId(
-		ctx,
-		g.ChannelId,
-		g.DatetimeAnchor,
-		g.Pagination,
-	)
+	foundPage, err := mongo.FindChannelMessagesByChannelId(ctx, channelId, query)
 	if err != nil {
 		logrus.Errorf(
-			"error db.FindChannelMessagesByChannelId for ChannelId: %s, DatetimeAnchor: %s, Pagination: %d : %v",
-			g.ChannelId,
-			g.DatetimeAnchor,
-			g.Pagination,
+			"error db.FindChannelMessagesByChannelId for ChannelId: %s, Direction: %s, Limit: %d : %v",
+			channelId,
+			query.Direction,
+			query.Limit,
 			err,
 		)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
+		util.WriteJSONError(w, err)
+		return
 	}
 
-	byteFoundMessages, err := json.Marshal(foundMessages)
-	if err != nil {
-		logrus.Errorf("error json.Marshal foundMessages, %v", err)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
-		return
+	for i := range foundPage.Messages {
+		foundPage.Messages[i] = foundPage.Messages[i].Summarized(viewerId, reactionSummaryReactors()).Rendered()
 	}
 
-	util.WriteJSONResponse(w, http.StatusOK, byteFoundMessages)
+	util.WriteJSONData(w, http.StatusOK, foundPage)
 }
 
 func HandleGetThreadMessages(w http.ResponseWriter, r *http.Request) {
-	type got struct {
-		ThreadId       string    `json:"thread_id"`
-		DatetimeAnchor time.Time `json:"datetime_anchor"`
-		Pagination     int64     `json:"pagination"`
-	}
+	threadId := mux.Vars(r)["thread_id"]
 
-	var g got
-	err := util.DecodeJSONBody(w, r, &g)
+	query, err := pageQueryFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+	viewerId, err := viewerFromURL(r)
 	if err != nil {
-		logrus.Errorf("error decoding JSON body when HandleGetThreadMessages, %v", err)
-		util.WriteJSONResponse(w, http.StatusBadRequest, []byte("error"))
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	foundMessages, err := mongo.FindThreadMessagesByThreadId(
-		ctx,
-		g.ThreadId,
-		g.DatetimeAnchor,
-		g.Pagination,
-	)
+	foundPage, err := mongo.FindThreadMessagesByThreadId(ctx, threadId, query)
 	if err != nil {
 		logrus.Errorf(
-			"error db.FindThreadMessagesByThreadId for ThreadId: %s, DatetimeAnchor: %s, Pagination: %d : %v",
-			g.ThreadId,
-			g.DatetimeAnchor,
-			g.Pagination,
+			"error db.FindThreadMessagesByThreadId for ThreadId: %s, Direction: %s, Limit: %d : %v",
+			threadId,
+			query.Direction,
+			query.Limit,
 			err,
 		)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
+		util.WriteJSONError(w, err)
+		return
 	}
 
-	byteFoundMessages, err := json.Marshal(foundMessages)
-	if err != nil {
-		logrus.Errorf("error json.Marshal foundMessages, %v", err)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
-		return
+	for i := range foundPage.Messages {
+		foundPage.Messages[i] = foundPage.Messages[i].Summarized(viewerId, reactionSummaryReactors()).Rendered()
 	}
 
-	util.WriteJSONResponse(w, http.StatusOK, byteFoundMessages)
+	util.WriteJSONData(w, http.StatusOK, foundPage)
 }
 
 func HandleMakeNewChannel(w http.ResponseWriter, r *http.Request) {
 	type got struct {
-		ChannelClients []string `json:"channel_clients"`
+		ChannelClients    []string `json:"channel_clients"`
+		ChannelModerators []string `json:"channel_moderators"`
 	}
 
 	var g got
 	err := util.DecodeJSONBody(w, r, &g)
 	if err != nil {
 		logrus.Errorf("error decoding JSON body when HandleMakeNewChannel, %v", err)
-		util.WriteJSONResponse(w, http.StatusBadRequest, []byte("error"))
+		util.WriteJSONError(w, err)
 		return
 	}
 
@@ -186,8 +268,9 @@ func HandleMakeNewChannel(w http.ResponseWriter, r *http.Request) {
 	ChannelId := uuid.New()
 
 	newChannel := models.Channel{
-		Id:      ChannelId.String(),
-		Clients: g.ChannelClients,
+		Id:         ChannelId.String(),
+		Clients:    g.ChannelClients,
+		Moderators: g.ChannelModerators,
 	}
 
 	err = mongo.NewChannel(
@@ -198,13 +281,15 @@ func HandleMakeNewChannel(w http.ResponseWriter, r *http.Request) {
 		logrus.Errorf(
 			"error db.NewChannel: %v", err,
 		)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
+		util.WriteJSONError(w, err)
+		return
 	}
+
+	util.WriteJSONData(w, http.StatusCreated, newChannel)
 }
 
 func HandleMakeNewThread(w http.ResponseWriter, r *http.Request) {
 	type got struct {
-		ChannelId     string `json:"channel_id"`
 		RootMessageId string `json:"root_message_id"`
 	}
 
@@ -212,7 +297,7 @@ func HandleMakeNewThread(w http.ResponseWriter, r *http.Request) {
 	err := util.DecodeJSONBody(w, r, &g)
 	if err != nil {
 		logrus.Errorf("error decoding JSON body when HandleMakeNewThread, %v", err)
-		util.WriteJSONResponse(w, http.StatusBadRequest, []byte("error"))
+		util.WriteJSONError(w, err)
 		return
 	}
 
@@ -223,18 +308,146 @@ func HandleMakeNewThread(w http.ResponseWriter, r *http.Request) {
 
 	newThread := models.Thread{
 		Id:            threadId.String(),
-		ChannelId:     g.ChannelId,
+		ChannelId:     mux.Vars(r)["channel_id"],
 		RootMessageId: g.RootMessageId,
+		DateCreated:   time.Now().UTC(),
 	}
 
-	err = mongo.NewThread(
+	newThread, err = mongo.NewThread(
 		ctx,
 		newThread,
 	)
+	if errors.Is(err, mongo.ErrThreadRootUnavailable) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
 	if err != nil {
 		logrus.Errorf(
 			"error db.NewThread: %v", err,
 		)
-		util.WriteJSONResponse(w, http.StatusInternalServerError, []byte("error"))
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusCreated, newThread)
+}
+
+func HandleGetChannelThreads(w http.ResponseWriter, r *http.Request) {
+	channelId := mux.Vars(r)["channel_id"]
+
+	limit, err := limitFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundThreads, err := mongo.FindActiveThreadsByChannelId(ctx, channelId, limit)
+	if err != nil {
+		logrus.Errorf(
+			"error db.FindActiveThreadsByChannelId for ChannelId: %s, Limit: %d : %v",
+			channelId,
+			limit,
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundThreads)
+}
+
+func HandleGetAccountThreads(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	limit, err := limitFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundThreads, err := mongo.FindThreadsByParticipant(ctx, accountId, limit)
+	if err != nil {
+		logrus.Errorf(
+			"error db.FindThreadsByParticipant for AccountId: %s, Limit: %d : %v",
+			accountId,
+			limit,
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundThreads)
+}
+
+func HandleGetThreadUnreads(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundUnreads, err := mongo.FindThreadUnreadsByAccountId(ctx, accountId)
+	if err != nil {
+		logrus.Errorf("error db.FindThreadUnreadsByAccountId for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundUnreads)
+}
+
+func HandleGetChannelMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundRevisions, err := mongo.FindChannelMessageRevisions(ctx, vars["channel_id"], vars["message_id"])
+	if errors.Is(err, mongo.ErrMessageNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf(
+			"error db.FindChannelMessageRevisions for ChannelId: %s, MessageId: %s : %v",
+			vars["channel_id"],
+			vars["message_id"],
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundRevisions)
+}
+
+func HandleGetThreadMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundRevisions, err := mongo.FindThreadMessageRevisions(ctx, vars["thread_id"], vars["message_id"])
+	if errors.Is(err, mongo.ErrMessageNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf(
+			"error db.FindThreadMessageRevisions for ThreadId: %s, MessageId: %s : %v",
+			vars["thread_id"],
+			vars["message_id"],
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
 	}
+
+	util.WriteJSONData(w, http.StatusOK, foundRevisions)
 }
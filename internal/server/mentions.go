@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// notifyMentions stores an inbox entry for every mentioned account, sends them
+// MENTIONED and returns the accounts it stored entries for.
+// Mentions are always delivered, whatever else the account has silenced for
+// the channel.
+func notifyMentions(ctx context.Context, changes *changeSet, channel models.Channel, content models.Content, mention models.Mention, stored interface{}) ([]string, error) {
+	isOnline := func(accountId string) bool { return ClientPool.GetTheClient(accountId) != nil }
+	recipients := models.ResolveMentions(content, channel, mention.AuthorAccountId.String(), isOnline)
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	mentions := make([]models.Mention, 0, len(recipients))
+	mentioned := make([]string, 0, len(recipients))
+	for accountId, kind := range recipients {
+		mention.AccountId = accountId
+		mention.Kind = kind
+		mentions = append(mentions, mention)
+		mentioned = append(mentioned, accountId)
+	}
+
+	err := mongo.InsertMentions(ctx, mentions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mention := range mentions {
+		changes.send([]string{mention.AccountId}, mentionedEvent(mention, stored))
+	}
+	return mentioned, nil
+}
+
+func HandleGetMentions(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	query, err := pageQueryFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	var unreadOnly bool
+	if rawUnread := r.URL.Query().Get("unread"); rawUnread != "" {
+		unreadOnly, err = strconv.ParseBool(rawUnread)
+		if err != nil {
+			util.WriteJSONError(w, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				"unread must be a boolean",
+				util.FieldError{Field: "unread", Message: "must be true or false"},
+			))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundPage, err := mongo.FindMentionsByAccountId(ctx, accountId, unreadOnly, query)
+	if err != nil {
+		logrus.Errorf("error db.FindMentionsByAccountId for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundPage)
+}
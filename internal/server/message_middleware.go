@@ -0,0 +1,236 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMessagesPerSecond = 20
+	defaultMessageBurst      = 40
+
+	maxIdleRateLimits = 10000 // buckets kept before the full ones are dropped
+)
+
+// logMessages logs failed messages under their request id, server errors with
+// their cause since the error frame hides it.
+func logMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		outgoing, err := next(req)
+		if err != nil {
+			apiErr := util.AsAPIError(err)
+			if apiErr.Status >= http.StatusInternalServerError {
+				logrus.Errorf("error when handling %s from %q, request %s: %v", req.Message.Type, req.SenderId, req.RequestId, err)
+			} else {
+				logrus.Debugf("rejected %s from %q, request %s: %v", req.Message.Type, req.SenderId, req.RequestId, err)
+			}
+		}
+		return outgoing, err
+	}
+}
+
+// MessageTypeMetrics counts how the messages of a type fared.
+type MessageTypeMetrics struct {
+	Handled     int64   `json:"handled"`
+	Rejected    int64   `json:"rejected"` // client errors
+	Failed      int64   `json:"failed"`   // server errors
+	TotalMillis float64 `json:"total_millis"`
+	MaxMillis   float64 `json:"max_millis"`
+}
+
+var messageMetrics = struct {
+	sync.Mutex
+	byType map[string]*MessageTypeMetrics
+}{byType: map[string]*MessageTypeMetrics{}}
+
+func measureMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		start := time.Now()
+		outgoing, err := next(req)
+		millis := float64(time.Since(start).Microseconds()) / 1000
+
+		messageMetrics.Lock()
+		defer messageMetrics.Unlock()
+
+		metrics := messageMetrics.byType[req.Message.Type]
+		if metrics == nil {
+			metrics = &MessageTypeMetrics{}
+			messageMetrics.byType[req.Message.Type] = metrics
+		}
+		switch {
+		case err == nil:
+			metrics.Handled++
+		case util.AsAPIError(err).Status >= http.StatusInternalServerError:
+			metrics.Failed++
+		default:
+			metrics.Rejected++
+		}
+		metrics.TotalMillis += millis
+		if millis > metrics.MaxMillis {
+			metrics.MaxMillis = millis
+		}
+		return outgoing, err
+	}
+}
+
+// HandleGetMessageMetrics returns the metrics of every message type handled
+// since the engine started.
+func HandleGetMessageMetrics(w http.ResponseWriter, r *http.Request) {
+	type typeMetrics struct {
+		Type string `json:"type"`
+		MessageTypeMetrics
+	}
+
+	messageMetrics.Lock()
+	metrics := make([]typeMetrics, 0, len(messageMetrics.byType))
+	for messageType, m := range messageMetrics.byType {
+		metrics = append(metrics, typeMetrics{Type: messageType, MessageTypeMetrics: *m})
+	}
+	messageMetrics.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Type < metrics[j].Type })
+	util.WriteJSONData(w, http.StatusOK, metrics)
+}
+
+// authenticateMessages makes sure every message has a sender. Connected
+// clients are the account of the token their handshake was authenticated
+// with, server-side calls must be made with a service token. The identity is added to the request context, as the
+// HTTP middleware does, and types about the sender's own connection are
+// rejected from services.
+func authenticateMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		if req.Identity.AccountId == "" {
+			return models.Message{}, util.NewAPIError(http.StatusUnauthorized, util.CodeUnauthorized, "authentication is required")
+		}
+		if req.SenderId == "" && !req.Identity.HasRole(auth.RoleService) {
+			return models.Message{}, util.NewAPIError(
+				http.StatusForbidden,
+				util.CodeForbidden,
+				"messages can only be sent by a connected client or a service",
+			)
+		}
+		if req.handler.connectedOnly && req.SenderId == "" {
+			return models.Message{}, util.NewAPIError(
+				http.StatusForbidden,
+				util.CodeForbidden,
+				req.Message.Type+" can only be sent by a connected client",
+			)
+		}
+
+		req.Context = auth.WithIdentity(req.Context, req.Identity)
+		return next(req)
+	}
+}
+
+// authorizeMessages rejects connected senders from the channels and threads
+// they are not a client of, once the payload says which one it is about.
+// Services act for the system and may address any.
+func authorizeMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		scoped, ok := req.Payload.(ScopedPayload)
+		if !ok || req.SenderId == "" {
+			return next(req)
+		}
+
+		var err error
+		switch scopeKey, scopeId := scoped.Scope(); scopeKey {
+		case "channel_id":
+			err = requireChannelClient(req.Context, req.SenderId, scopeId)
+		case "thread_id":
+			err = requireThreadClient(req.Context, req.SenderId, scopeId)
+		}
+		if err != nil {
+			return models.Message{}, err
+		}
+		return next(req)
+	}
+}
+
+// tokenBucket allows bursts of up to burst messages, refilled at rate per
+// second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var messageRateLimits = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}{buckets: map[string]*tokenBucket{}}
+
+// rateLimitMessages holds every connected sender to the configured rate.
+// Server-side calls are trusted and not limited.
+func rateLimitMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		if req.SenderId != "" && !req.handler.unlimited && !allowMessage(req.SenderId, time.Now()) {
+			return models.Message{}, util.NewAPIError(http.StatusTooManyRequests, util.CodeRateLimited, "too many messages, slow down")
+		}
+		return next(req)
+	}
+}
+
+func allowMessage(senderId string, now time.Time) bool {
+	rate, burst := config.Config.MessageRateLimit.PerSecond, float64(config.Config.MessageRateLimit.Burst)
+	if rate <= 0 {
+		rate = defaultMessagesPerSecond
+	}
+	if burst <= 0 {
+		burst = defaultMessageBurst
+	}
+
+	messageRateLimits.Lock()
+	defer messageRateLimits.Unlock()
+
+	if len(messageRateLimits.buckets) > maxIdleRateLimits {
+		// a bucket that would be full again is the same as none
+		for id, bucket := range messageRateLimits.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= burst {
+				delete(messageRateLimits.buckets, id)
+			}
+		}
+	}
+
+	bucket := messageRateLimits.buckets[senderId]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		messageRateLimits.buckets[senderId] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// validateMessages decodes the payload into the handler's payload type and
+// lets it validate itself.
+func validateMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		payload := req.handler.newPayload()
+		if err := decodePayload(req.Message.Payload, payload); err != nil {
+			return models.Message{}, invalidPayload(err)
+		}
+		if validator, ok := payload.(PayloadValidator); ok {
+			if err := validator.Validate(); err != nil {
+				return models.Message{}, err
+			}
+		}
+
+		req.Payload = payload
+		return next(req)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"testing"
+)
+
+func TestAuthenticateMessages(t *testing.T) {
+	service := auth.Identity{AccountId: "billing", Roles: []string{auth.RoleService}}
+
+	for _, test := range []struct {
+		name          string
+		senderId      string
+		identity      auth.Identity
+		connectedOnly bool
+		wantStatus    int
+	}{
+		{"connected client", "a", auth.Identity{AccountId: "a"}, false, 0},
+		{"service", "", service, false, 0},
+		{"no identity", "", auth.Identity{}, false, http.StatusUnauthorized},
+		{"token without the service role", "", auth.Identity{AccountId: "a"}, false, http.StatusForbidden},
+		{"service sending a connected only type", "", service, true, http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var handled context.Context
+			handle := authenticateMessages(func(req *MessageRequest) (models.Message, error) {
+				handled = req.Context
+				return models.Message{}, nil
+			})
+
+			_, err := handle(&MessageRequest{
+				Context:  context.Background(),
+				SenderId: test.senderId,
+				Identity: test.identity,
+				Message:  models.Message{Type: SetAppState},
+				handler:  &messageHandler{connectedOnly: test.connectedOnly},
+			})
+
+			if test.wantStatus != 0 {
+				if err == nil || util.AsAPIError(err).Status != test.wantStatus {
+					t.Fatalf("got %v, want a %d", err, test.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity, ok := auth.FromContext(handled); !ok || identity.AccountId != test.identity.AccountId {
+				t.Errorf("the handler runs as %+v, want %+v", identity, test.identity)
+			}
+		})
+	}
+}
+
+func TestAuthorizeMessagesTrustsServices(t *testing.T) {
+	handled := false
+	handle := authorizeMessages(func(req *MessageRequest) (models.Message, error) {
+		handled = true
+		return models.Message{}, nil
+	})
+
+	// a service is not looked up as a client of the channel
+	_, err := handle(&MessageRequest{
+		Context: context.Background(),
+		Payload: &deleteChannelMessagePayload{ChannelId: "0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11"},
+	})
+	if err != nil || !handled {
+		t.Errorf("a service message was not handled: %v", err)
+	}
+}
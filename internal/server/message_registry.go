@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// MessageRequest is a message on its way through the middleware pipeline to
+// the handler of its type.
+type MessageRequest struct {
+	Context   context.Context
+	SenderId  string        // the connected account that sent the message, empty for server-side calls
+	Identity  auth.Identity // who sent the message, the connected account or the service calling the engine
+	RequestId string        // logged with the error the message fails with, and sent back with it
+	Message   models.Message
+	Payload   interface{} // the payload decoded into the handler's payload type, set by the validation step
+	handler   *messageHandler
+}
+
+// MessageHandlerFunc handles a request and returns the message to deliver to
+// its SendTo recipient right away, or a zero Message when there is none.
+type MessageHandlerFunc func(req *MessageRequest) (models.Message, error)
+
+// MessageMiddleware wraps the handling of every message type.
+type MessageMiddleware func(next MessageHandlerFunc) MessageHandlerFunc
+
+// ScopedPayload is implemented by payloads about a channel or a thread, which
+// connected senders must be a client of. scopeKey is channel_id or thread_id.
+type ScopedPayload interface {
+	Scope() (scopeKey, scopeId string)
+}
+
+// PayloadValidator is implemented by payloads checking themselves once
+// decoded. The error is sent back as is, so it should be an APIError.
+type PayloadValidator interface {
+	Validate() error
+}
+
+// MessageTypeOption tunes how a registered message type is handled.
+type MessageTypeOption func(handler *messageHandler)
+
+// ConnectedOnly rejects server-side calls of a type that is about the
+// sender's own connection.
+func ConnectedOnly(handler *messageHandler) {
+	handler.connectedOnly = true
+}
+
+// Unlimited exempts a type from rate limiting.
+func Unlimited(handler *messageHandler) {
+	handler.unlimited = true
+}
+
+type messageHandler struct {
+	messageType   string
+	newPayload    func() interface{}
+	schema        *util.Schema // of the payload in the latest protocol version
+	handle        MessageHandlerFunc
+	connectedOnly bool
+	unlimited     bool
+}
+
+var messageRegistry = struct {
+	sync.RWMutex
+	handlers    map[string]*messageHandler
+	middlewares []MessageMiddleware
+}{handlers: map[string]*messageHandler{}}
+
+// RegisterMessageType routes messages of messageType to handle, with their
+// payload decoded into a P, from which the schema the type publishes is
+// generated. Types can be registered by other packages, before the engine
+// starts accepting connections; registering a type twice panics.
+func RegisterMessageType[P any](messageType string, handle func(req *MessageRequest, payload *P) (models.Message, error), options ...MessageTypeOption) {
+	handler := &messageHandler{
+		messageType: messageType,
+		newPayload:  func() interface{} { return new(P) },
+		schema:      payloadSchema(messageType, reflect.TypeOf((*P)(nil)).Elem()),
+		handle: func(req *MessageRequest) (models.Message, error) {
+			return handle(req, req.Payload.(*P))
+		},
+	}
+	for _, option := range options {
+		option(handler)
+	}
+
+	messageRegistry.Lock()
+	defer messageRegistry.Unlock()
+
+	if _, ok := messageRegistry.handlers[messageType]; ok {
+		panic(fmt.Sprintf("message type %s registered twice", messageType))
+	}
+	messageRegistry.handlers[messageType] = handler
+}
+
+// UseMessageMiddleware adds middleware to the pipeline. It runs after the
+// engine's own, so it sees authenticated, rate limited and decoded requests,
+// in the order it was added.
+func UseMessageMiddleware(middlewares ...MessageMiddleware) {
+	messageRegistry.Lock()
+	defer messageRegistry.Unlock()
+
+	messageRegistry.middlewares = append(messageRegistry.middlewares, middlewares...)
+}
+
+// builtinMessageMiddlewares run first, outermost first.
+var builtinMessageMiddlewares = []MessageMiddleware{
+	logMessages,
+	measureMessages,
+	authenticateMessages,
+	rateLimitMessages,
+	validateSchemas,
+	validateMessages,
+	authorizeMessages,
+}
+
+// HandleMessage processes a message sent by the connected client senderId
+// through the middleware pipeline and the handler registered for its type.
+// Messages of unregistered types are rejected. A message is handled under a
+// new request id, which the APIError it fails with carries.
+func HandleMessage(senderId string, message models.Message) (models.Message, error) {
+	return handleMessage(senderId, auth.Identity{AccountId: senderId}, uuid.New().String(), message)
+}
+
+// HandleServiceMessage processes a message a service sent through the API, as
+// the identity its token was authenticated as, under the id of its request.
+func HandleServiceMessage(identity auth.Identity, requestId string, message models.Message) (models.Message, error) {
+	return handleMessage("", identity, requestId, message)
+}
+
+func handleMessage(senderId string, identity auth.Identity, requestId string, message models.Message) (models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	messageRegistry.RLock()
+	handler := messageRegistry.handlers[message.Type]
+	middlewares := append(append([]MessageMiddleware{}, builtinMessageMiddlewares...), messageRegistry.middlewares...)
+	messageRegistry.RUnlock()
+
+	if handler == nil {
+		err := util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeUnknownMessageType,
+			"unknown message type",
+			util.FieldError{Field: "type", Message: fmt.Sprintf("%q is not a message type", message.Type)},
+		)
+		logrus.Debugf("rejected %s from %q, request %s: %v", message.Type, senderId, requestId, err)
+		return models.Message{}, withRequestId(err, requestId)
+	}
+
+	handle := handler.handle
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handle = middlewares[i](handle)
+	}
+
+	outgoing, err := handle(&MessageRequest{
+		Context:   ctx,
+		SenderId:  senderId,
+		Identity:  identity,
+		RequestId: requestId,
+		Message:   message,
+		handler:   handler,
+	})
+	if err != nil {
+		return models.Message{}, withRequestId(err, requestId)
+	}
+	return outgoing, nil
+}
+
+// withRequestId returns err as the APIError sent back, tagged with the id of
+// the request it was logged under.
+func withRequestId(err error, requestId string) error {
+	apiErr := *util.AsAPIError(err)
+	apiErr.RequestId = requestId
+	return &apiErr
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"testing"
+)
+
+func TestHandleMessageTagsErrorsWithRequestId(t *testing.T) {
+	unknown := models.Message{Type: "NOT_A_MESSAGE_TYPE"}
+
+	_, err := HandleMessage("a", unknown)
+	first := util.AsAPIError(err).RequestId
+	_, err = HandleMessage("a", unknown)
+	second := util.AsAPIError(err).RequestId
+	if first == "" || first == second {
+		t.Errorf("failed messages have request ids %q and %q, want two new ones", first, second)
+	}
+
+	service := auth.Identity{AccountId: "billing", Roles: []string{auth.RoleService}}
+	_, err = HandleServiceMessage(service, "http-request-id", unknown)
+	if requestId := util.AsAPIError(err).RequestId; requestId != "http-request-id" {
+		t.Errorf("a service message failed with request id %q, want the one of its HTTP request", requestId)
+	}
+}
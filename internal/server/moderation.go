@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRestoreWindow = 24 * time.Hour
+	defaultPurgeAfter    = 30 * 24 * time.Hour
+	purgeInterval        = 10 * time.Minute
+	purgeBatchSize       = 500
+)
+
+func restoreWindow() time.Duration {
+	if minutes := config.Config.DeletedMessages.RestoreWindowMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultRestoreWindow
+}
+
+func purgeAfter() time.Duration {
+	if hours := config.Config.DeletedMessages.PurgeAfterHours; hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultPurgeAfter
+}
+
+func isChannelModerator(ctx context.Context, channelId, accountId string) (bool, error) {
+	channel, err := mongo.FindChannelById(ctx, channelId)
+	if err != nil {
+		return false, err
+	}
+	return channel.IsModerator(accountId), nil
+}
+
+// isThreadModerator reports whether the account moderates the thread's channel.
+func isThreadModerator(ctx context.Context, threadId, accountId string) (bool, error) {
+	thread, err := mongo.FindThreadById(ctx, threadId)
+	if err != nil {
+		return false, err
+	}
+	return isChannelModerator(ctx, thread.ChannelId, accountId)
+}
+
+func HandleRestoreChannelMessage(w http.ResponseWriter, r *http.Request) {
+	// the moderator is the account the request was authenticated as
+	moderator, _ := auth.FromContext(r.Context())
+
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	channel, err := mongo.FindChannelById(ctx, vars["channel_id"])
+	if err != nil {
+		logrus.Errorf("error db.FindChannelById for ChannelId: %s : %v", vars["channel_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	if !channel.IsModerator(moderator.AccountId) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "only moderators can restore messages"))
+		return
+	}
+
+	var restored models.ChannelMessage
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		var err error
+		restored, err = mongo.RestoreChannelMessage(txCtx, vars["channel_id"], vars["message_id"], restoreWindow())
+		if err != nil {
+			return err
+		}
+
+		changes.send(channel.Clients, messageRestoredEvent(restored))
+		changes.webhook(models.WebhookMessageRestored, "channel_id", channel.Id, map[string]interface{}{"message": restored})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotRestorable) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.RestoreChannelMessage for MessageId: %s : %v", vars["message_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, restored)
+}
+
+func HandleRestoreThreadMessage(w http.ResponseWriter, r *http.Request) {
+	// the moderator is the account the request was authenticated as
+	moderator, _ := auth.FromContext(r.Context())
+
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	thread, err := mongo.FindThreadById(ctx, vars["thread_id"])
+	if err != nil {
+		logrus.Errorf("error db.FindThreadById for ThreadId: %s : %v", vars["thread_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	channel, err := mongo.FindChannelById(ctx, thread.ChannelId)
+	if err != nil {
+		logrus.Errorf("error db.FindChannelById for ChannelId: %s : %v", thread.ChannelId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+	if !channel.IsModerator(moderator.AccountId) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusForbidden, util.CodeForbidden, "only moderators can restore messages"))
+		return
+	}
+
+	var restored models.ThreadMessage
+	err = commitChange(ctx, func(txCtx context.Context, changes *changeSet) error {
+		var err error
+		restored, err = mongo.RestoreThreadMessage(txCtx, vars["thread_id"], vars["message_id"], restoreWindow())
+		if err != nil {
+			return err
+		}
+
+		changes.send(channel.Clients, messageRestoredEvent(restored))
+		changes.webhook(models.WebhookMessageRestored, "thread_id", thread.Id, map[string]interface{}{"message": restored})
+		return nil
+	})
+	if errors.Is(err, mongo.ErrMessageNotRestorable) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusConflict, util.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.RestoreThreadMessage for MessageId: %s : %v", vars["message_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, restored)
+}
+
+// StartTombstonePurger hard-deletes soft deleted messages once their purge
+// grace period has elapsed, checking every purgeInterval.
+func StartTombstonePurger(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purgeTombstones()
+	}
+}
+
+func purgeTombstones() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cutoff := time.Now().UTC().Add(-purgeAfter())
+	for {
+		purged, err := mongo.PurgeDeletedMessages(ctx, cutoff, purgeBatchSize)
+		if err != nil {
+			logrus.Errorf("error purging deleted messages: %v", err)
+			return
+		}
+		if purged > 0 {
+			logrus.Infof("purged %d deleted messages", purged)
+		}
+		if purged < purgeBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// invalidNotificationSettings reports the problems Validate found, one field
+// error each.
+func invalidNotificationSettings(problems map[string]string) error {
+	fields := make([]string, 0, len(problems))
+	for field := range problems {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	fieldErrors := make([]util.FieldError, 0, len(fields))
+	for _, field := range fields {
+		fieldErrors = append(fieldErrors, util.FieldError{Field: field, Message: problems[field]})
+	}
+	return util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "invalid notification settings", fieldErrors...)
+}
+
+// syncNotificationSettings sends the account's saved settings to its
+// connection so that its other devices pick them up.
+func syncNotificationSettings(settings models.NotificationSettings) {
+	ClientPool.SendMsgToClients([]string{settings.AccountId}, notificationSettingsChangedEvent(settings))
+}
+
+func HandleGetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	settings, err := mongo.FindNotificationSettings(ctx, accountId)
+	if err != nil {
+		logrus.Errorf("error db.FindNotificationSettings for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, settings)
+}
+
+// HandlePutNotificationSettings replaces all of an account's settings.
+func HandlePutNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	var settings models.NotificationSettings
+	err := util.DecodeJSONBody(w, r, &settings)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+	settings.AccountId = accountId
+
+	problems := settings.Validate()
+	for channelId := range settings.ChannelLevels {
+		if _, err := uuid.Parse(channelId); err != nil {
+			problems["channel_levels."+channelId] = "must be keyed by channel id"
+		}
+	}
+	if len(problems) > 0 {
+		util.WriteJSONError(w, invalidNotificationSettings(problems))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	saved, err := mongo.ReplaceNotificationSettings(ctx, settings)
+	if err != nil {
+		logrus.Errorf("error db.ReplaceNotificationSettings for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	syncNotificationSettings(saved)
+	util.WriteJSONData(w, http.StatusOK, saved)
+}
+
+// HandlePutChannelNotificationLevel changes the level of a single channel.
+func HandlePutChannelNotificationLevel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	type got struct {
+		Level models.NotificationLevel `json:"level"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var problems = map[string]string{}
+	if _, err := uuid.Parse(vars["channel_id"]); err != nil {
+		problems["channel_id"] = "must be a uuid"
+	}
+	if !models.IsNotificationLevel(g.Level) {
+		problems["level"] = "must be all, mentions or none"
+	}
+	if len(problems) > 0 {
+		util.WriteJSONError(w, invalidNotificationSettings(problems))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	saved, err := mongo.SetChannelNotificationLevel(ctx, vars["account_id"], vars["channel_id"], g.Level)
+	if err != nil {
+		logrus.Errorf(
+			"error db.SetChannelNotificationLevel for AccountId: %s, ChannelId: %s : %v",
+			vars["account_id"],
+			vars["channel_id"],
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	syncNotificationSettings(saved)
+	util.WriteJSONData(w, http.StatusOK, saved)
+}
+
+// HandlePutThreadMute mutes or unmutes a single thread.
+func HandlePutThreadMute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	type got struct {
+		Muted bool `json:"muted"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	saved, err := mongo.SetThreadMuted(ctx, vars["account_id"], vars["thread_id"], g.Muted)
+	if err != nil {
+		logrus.Errorf(
+			"error db.SetThreadMuted for AccountId: %s, ThreadId: %s : %v",
+			vars["account_id"],
+			vars["thread_id"],
+			err,
+		)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	syncNotificationSettings(saved)
+	util.WriteJSONData(w, http.StatusOK, saved)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+)
+
+// notifyChannelMessage tells the accounts concerned by a new channel message
+// about it: the direct recipient, the mentioned accounts and the ones whose
+// keywords it contains. Pushes are sent once the message is committed.
+func notifyChannelMessage(ctx context.Context, changes *changeSet, message models.Message, stored models.ChannelMessage) error {
+	channel, err := mongo.FindChannelById(ctx, stored.ChannelId.String())
+	if err != nil {
+		return err
+	}
+
+	authorId := stored.AuthorAccountId.String()
+	if message.SendTo != "" && message.SendTo != authorId {
+		changes.then(func(ctx context.Context) {
+			pushChannelMessage(ctx, []string{message.SendTo}, models.NotifyForMessage, stored)
+		})
+	}
+
+	mention := models.Mention{
+		MessageId:       stored.MessageId,
+		ChannelId:       channel.Id,
+		AuthorAccountId: stored.AuthorAccountId,
+		Excerpt:         stored.Content.Excerpt(),
+		DateCreated:     stored.DateCreated,
+	}
+	mentioned, err := notifyMentions(ctx, changes, channel, stored.Content, mention, stored)
+	if err != nil {
+		return err
+	}
+
+	alerted, err := notifyKeywordAlerts(ctx, changes, channel, "", authorId, stored.Content, mentioned, stored)
+	if err != nil {
+		return err
+	}
+
+	changes.then(func(ctx context.Context) {
+		pushChannelMessage(ctx, mentioned, models.NotifyForMention, stored)
+		pushChannelMessage(ctx, alerted, models.NotifyForKeyword, stored)
+	})
+	return nil
+}
+
+// notifyThreadMessage tells the accounts concerned by a new reply about it: the
+// direct recipient, the thread's followers, the mentioned accounts and the ones
+// whose keywords it contains. Pushes are sent once the reply is committed.
+func notifyThreadMessage(ctx context.Context, changes *changeSet, message models.Message, reply models.ThreadMessage) error {
+	thread, err := mongo.FindThreadById(ctx, reply.ThreadId.String())
+	if err != nil {
+		return err
+	}
+	channel, err := mongo.FindChannelById(ctx, thread.ChannelId)
+	if err != nil {
+		return err
+	}
+
+	authorId := reply.AuthorAccountId.String()
+	if message.SendTo != "" && message.SendTo != authorId {
+		changes.then(func(ctx context.Context) {
+			pushThreadMessage(ctx, []string{message.SendTo}, models.NotifyForMessage, channel.Id, reply)
+		})
+	}
+
+	err = notifyThreadFollowers(ctx, changes, message, thread, channel, reply)
+	if err != nil {
+		return err
+	}
+
+	mention := models.Mention{
+		MessageId:       reply.MessageId,
+		ChannelId:       channel.Id,
+		ThreadId:        thread.Id,
+		AuthorAccountId: reply.AuthorAccountId,
+		Excerpt:         reply.Content.Excerpt(),
+		DateCreated:     reply.DateCreated,
+	}
+	// @channel and @here in a reply reach the clients of its channel
+	mentioned, err := notifyMentions(ctx, changes, channel, reply.Content, mention, reply)
+	if err != nil {
+		return err
+	}
+
+	alerted, err := notifyKeywordAlerts(ctx, changes, channel, thread.Id, authorId, reply.Content, mentioned, reply)
+	if err != nil {
+		return err
+	}
+
+	changes.then(func(ctx context.Context) {
+		pushThreadMessage(ctx, mentioned, models.NotifyForMention, channel.Id, reply)
+		pushThreadMessage(ctx, alerted, models.NotifyForKeyword, channel.Id, reply)
+	})
+	return nil
+}
+
+// notifyThreadFollowers fans a new reply out to the thread's followers and
+// records an unread for the ones offline. The author is skipped, and so are
+// followers who muted the thread and an online direct recipient since the
+// caller already delivers to it.
+func notifyThreadFollowers(
+	ctx context.Context,
+	changes *changeSet,
+	message models.Message,
+	thread models.Thread,
+	channel models.Channel,
+	reply models.ThreadMessage,
+) error {
+	settings, err := mongo.FindNotificationSettingsOf(ctx, thread.Followers)
+	if err != nil {
+		return err
+	}
+
+	var recipients, offline []string
+	for _, follower := range thread.Followers {
+		if follower == reply.AuthorAccountId.String() {
+			continue
+		}
+		if settings[follower].MutesThread(thread.Id) {
+			continue
+		}
+		if follower == message.SendTo && ClientPool.GetTheClient(follower) != nil {
+			continue
+		}
+		recipients = append(recipients, follower)
+		if ClientPool.GetTheClient(follower) == nil {
+			offline = append(offline, follower)
+		}
+	}
+
+	changes.send(recipients, message)
+	changes.then(func(ctx context.Context) {
+		pushThreadMessage(ctx, recipients, models.NotifyForMessage, channel.Id, reply)
+	})
+
+	return mongo.IncrementThreadUnreads(ctx, thread.Id, offline)
+}
+
+// notifyKeywordAlerts sends KEYWORD_ALERT to the clients of the channel
+// whose keywords the content contains and returns every account alerted. The
+// author, the accounts in skip and the ones that muted the channel are left
+// out.
+func notifyKeywordAlerts(
+	ctx context.Context,
+	changes *changeSet,
+	channel models.Channel,
+	threadId, authorId string,
+	content models.Content,
+	skip []string,
+	stored interface{},
+) ([]string, error) {
+	settings, err := mongo.FindKeywordSettingsOf(ctx, channel.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := map[string]bool{authorId: true}
+	for _, accountId := range skip {
+		skipped[accountId] = true
+	}
+
+	var alerted []string
+	for accountId, s := range settings {
+		if skipped[accountId] || s.ChannelLevel(channel.Id) == models.NotifyNone {
+			continue
+		}
+		keyword, ok := s.MatchKeyword(content)
+		if !ok {
+			continue
+		}
+
+		alerted = append(alerted, accountId)
+		changes.send([]string{accountId}, keywordAlertEvent(accountId, keyword, channel.Id, threadId, stored))
+	}
+
+	return alerted, nil
+}
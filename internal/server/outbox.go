@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutboxWorkers = 2
+	defaultBusSizeMB     = 64
+	defaultOutboxBackoff = time.Second
+
+	maxOutboxBackoff   = time.Minute
+	outboxLease        = 30 * time.Second // a claimed event is published again after this if its relay dies
+	outboxPollInterval = time.Second
+	busResumeMargin    = time.Minute // read again when a lost bus cursor is reopened, covers clock skew between nodes
+	busSeenIds         = 10000
+)
+
+// changeSet collects what a state change publishes. Its events are written to
+// the outbox in the transaction of the change, so they are published exactly
+// when the change commits. Work queued with then runs once it has committed;
+// it is lost if the node dies, which suits local side effects like pushes.
+type changeSet struct {
+	events      []models.OutboxEvent
+	afterCommit []func(ctx context.Context)
+	err         error
+}
+
+// send writes message to the connections of the recipients, wherever they are.
+func (c *changeSet) send(recipients []string, message models.Message) {
+	var to []string
+	for _, recipient := range recipients {
+		if recipient != "" {
+			to = append(to, recipient)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.add(func(event *models.OutboxEvent) {
+		event.Recipients, event.Message = to, string(body)
+	})
+}
+
+// webhook delivers an event to the webhook subscriptions selecting it.
+func (c *changeSet) webhook(eventType, scopeKey, scopeId string, data map[string]interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.add(func(event *models.OutboxEvent) {
+		event.WebhookType, event.ScopeKey, event.ScopeId, event.WebhookData = eventType, scopeKey, scopeId, string(body)
+	})
+}
+
+func (c *changeSet) then(fn func(ctx context.Context)) {
+	c.afterCommit = append(c.afterCommit, fn)
+}
+
+func (c *changeSet) add(fill func(event *models.OutboxEvent)) {
+	event, err := models.NewOutboxEvent()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	fill(&event)
+	c.events = append(c.events, event)
+}
+
+// scopeEvents puts every event of the change in the scope of its channel or
+// thread, which its webhook event names. Changes about neither are a scope of
+// their own.
+func (c *changeSet) scopeEvents() {
+	if len(c.events) == 0 {
+		return
+	}
+
+	scopeKey, scopeId := "change", c.events[0].Id.String()
+	for _, event := range c.events {
+		if event.ScopeId != "" {
+			scopeKey, scopeId = event.ScopeKey, event.ScopeId
+			break
+		}
+	}
+	for i := range c.events {
+		if c.events[i].ScopeId == "" {
+			c.events[i].ScopeKey, c.events[i].ScopeId = scopeKey, scopeId
+		}
+	}
+}
+
+func (c *changeSet) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// commitChange runs change in a transaction together with writing the events
+// it collects to the outbox.
+func commitChange(ctx context.Context, change func(txCtx context.Context, changes *changeSet) error) error {
+	var changes *changeSet
+	err := mongo.RunInTransaction(ctx, func(txCtx context.Context) error {
+		// a retried transaction starts over
+		changes = &changeSet{}
+		if err := change(txCtx, changes); err != nil {
+			return err
+		}
+		if changes.err != nil {
+			return changes.err
+		}
+		changes.scopeEvents()
+		return mongo.InsertOutboxEvents(txCtx, changes.events)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(changes.events) > 0 {
+		nudgeOutboxRelay()
+	}
+	for _, fn := range changes.afterCommit {
+		fn(ctx)
+	}
+	return nil
+}
+
+var outboxNudge = make(chan struct{}, 1)
+
+// nudgeOutboxRelay wakes an idle relay of this node, so that events committed
+// here do not wait for the next poll.
+func nudgeOutboxRelay() {
+	select {
+	case outboxNudge <- struct{}{}:
+	default:
+	}
+}
+
+// StartOutboxRelay publishes the outbox: socket messages go on the inter-node
+// bus and webhook events are queued for their subscriptions. An event is only
+// marked published once all of it was, and is published again otherwise, so
+// consumers see every event at least once. Relays only claim the oldest
+// unpublished event of a scope, so the events of a channel or thread are
+// published in order even while one of them is retried.
+func StartOutboxRelay(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	workers := config.Config.Outbox.Workers
+	if workers <= 0 {
+		workers = defaultOutboxWorkers
+	}
+
+	var relays sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			for {
+				if relayNext() {
+					continue
+				}
+				select {
+				case <-outboxNudge:
+				case <-time.After(outboxPollInterval):
+				}
+			}
+		}()
+	}
+	relays.Wait()
+}
+
+// relayNext publishes the next due event and tells whether there was one.
+func relayNext() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxLease)
+	defer cancel()
+
+	event, ok, err := mongo.ClaimDueOutboxEvent(ctx, time.Now().UTC(), outboxLease)
+	if err != nil {
+		logrus.Errorf("error claiming outbox event: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	err = publishOutboxEvent(ctx, event)
+	if err != nil {
+		logrus.Errorf("error publishing outbox event %s: %v", event.Id, err)
+		retryAt := time.Now().UTC().Add(outboxBackoff(event.Attempts + 1))
+		if err := mongo.RetryOutboxEvent(ctx, event, retryAt); err != nil {
+			// the lease runs out and the event is claimed again
+			logrus.Errorf("error retrying outbox event %s: %v", event.Id, err)
+		}
+		return true
+	}
+
+	err = mongo.MarkOutboxEventPublished(ctx, event, time.Now().UTC())
+	if err != nil {
+		logrus.Errorf("error marking outbox event %s published: %v", event.Id, err)
+	}
+	return true
+}
+
+// publishOutboxEvent publishes every part of an event. Both parts are
+// idempotent, so a republished event is not delivered twice to webhooks or
+// put on the bus twice.
+func publishOutboxEvent(ctx context.Context, event models.OutboxEvent) error {
+	if event.Message != "" {
+		err := mongo.PublishBusEvent(ctx, models.BusEvent{
+			Id:          event.Id,
+			Recipients:  event.Recipients,
+			Message:     event.Message,
+			PublishedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if event.WebhookType != "" {
+		var data map[string]interface{}
+		err := json.Unmarshal([]byte(event.WebhookData), &data)
+		if err != nil {
+			return err
+		}
+		return queueWebhookEvent(ctx, event.Id, event.DateCreated, event.WebhookType, event.ScopeKey, event.ScopeId, data)
+	}
+	return nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := defaultOutboxBackoff
+	if millis := config.Config.Outbox.BackoffMillis; millis > 0 {
+		backoff = time.Duration(millis) * time.Millisecond
+	}
+	for i := 1; i < attempts && backoff < maxOutboxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
+
+// StartBusSubscriber writes the socket messages published on the bus to the
+// connections of this node. A lost cursor is reopened a little before the
+// last event read, skipping the events already written.
+func StartBusSubscriber(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	sizeMB := config.Config.Outbox.BusSizeMB
+	if sizeMB <= 0 {
+		sizeMB = defaultBusSizeMB
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := mongo.EnsureBus(ctx, sizeMB<<20)
+		cancel()
+		if err == nil {
+			break
+		}
+		logrus.Errorf("error ensuring bus: %v", err)
+		time.Sleep(outboxPollInterval)
+	}
+
+	seen := newRecentIds(busSeenIds)
+	since := time.Now().UTC()
+	latest := since
+	for {
+		err := mongo.TailBusEvents(context.Background(), since, func(event models.BusEvent) {
+			if !seen.add(event.Id) {
+				return
+			}
+			if event.PublishedAt.After(latest) {
+				latest = event.PublishedAt
+			}
+
+			var message models.Message
+			if err := json.Unmarshal([]byte(event.Message), &message); err != nil {
+				logrus.Errorf("error decoding bus event %s: %v", event.Id, err)
+				return
+			}
+			ClientPool.SendMsgToClients(event.Recipients, message)
+		})
+		logrus.Warnf("reopening bus cursor: %v", err)
+		time.Sleep(outboxPollInterval)
+		since = latest.Add(-busResumeMargin)
+	}
+}
+
+// recentIds remembers the last ids added to it.
+type recentIds struct {
+	ids  map[uuid.UUID]bool
+	ring []uuid.UUID
+	next int
+}
+
+func newRecentIds(size int) *recentIds {
+	return &recentIds{ids: make(map[uuid.UUID]bool, size), ring: make([]uuid.UUID, size)}
+}
+
+// add tells whether id is new, and remembers it in place of the oldest id.
+func (r *recentIds) add(id uuid.UUID) bool {
+	if r.ids[id] {
+		return false
+	}
+	delete(r.ids, r.ring[r.next])
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.ids[id] = true
+	return true
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"messaging-engine/internal/models"
+	"testing"
+)
+
+func TestChangeEventsShareTheScopeOfTheChange(t *testing.T) {
+	changes := &changeSet{}
+	changes.send([]string{"author"}, models.Message{Type: "MESSAGE_ACCEPTED"})
+	changes.send([]string{"channel"}, models.Message{Type: NewChannelMessage})
+	changes.webhook(models.WebhookMessageCreated, "channel_id", "c1", map[string]interface{}{})
+	changes.scopeEvents()
+
+	for _, event := range changes.events {
+		if event.ScopeKey != "channel_id" || event.ScopeId != "c1" {
+			t.Errorf("event is in scope %s %s, want channel_id c1", event.ScopeKey, event.ScopeId)
+		}
+	}
+}
+
+func TestChangesWithoutChannelOrThreadAreTheirOwnScope(t *testing.T) {
+	var scopes []string
+	for i := 0; i < 2; i++ {
+		changes := &changeSet{}
+		changes.send([]string{"account"}, models.Message{Type: FollowThread})
+		changes.send([]string{"account"}, models.Message{Type: FollowThread})
+		changes.scopeEvents()
+
+		first, second := changes.events[0], changes.events[1]
+		if first.ScopeId == "" || first.ScopeId != second.ScopeId {
+			t.Fatalf("the events of a change are in scopes %q and %q", first.ScopeId, second.ScopeId)
+		}
+		scopes = append(scopes, first.ScopeId)
+	}
+	if scopes[0] == scopes[1] {
+		t.Error("two changes share a scope")
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// ProtocolVersionHeader tells, in the handshake response of /connect, the
+// protocol version negotiated from the protocol_version query param.
+const ProtocolVersionHeader = "Catache-Protocol-Version"
+
+// schemasPath is where the schemas are published, and the base of their ids.
+const schemasPath = "/protocol/schemas"
+
+// payloadSchema generates the schema of a payload type, with its keys named as
+// in the latest protocol version.
+func payloadSchema(messageType string, payloadType reflect.Type) *util.Schema {
+	schema := util.SchemaOf(payloadType)
+
+	properties := make(map[string]*util.Schema, len(schema.Properties))
+	for key, property := range schema.Properties {
+		properties[models.ProtocolPayloadKey(messageType, key, models.LatestProtocolVersion)] = property
+	}
+	schema.Properties = properties
+	for i, key := range schema.Required {
+		schema.Required[i] = models.ProtocolPayloadKey(messageType, key, models.LatestProtocolVersion)
+	}
+	sort.Strings(schema.Required)
+
+	schema.Dialect = util.SchemaDialect
+	schema.Id = schemasPath + "/" + messageType
+	schema.Title = messageType
+	return schema
+}
+
+// envelopeSchema describes the frames of the latest protocol version, around
+// the payload of their type.
+func envelopeSchema(messageTypes []string) *util.Schema {
+	types := make([]interface{}, len(messageTypes))
+	for i, messageType := range messageTypes {
+		types[i] = messageType
+	}
+
+	return &util.Schema{
+		Dialect: util.SchemaDialect,
+		Id:      schemasPath + "/envelope",
+		Title:   "envelope",
+		Type:    "object",
+		Properties: map[string]*util.Schema{
+			"version":  {Type: "integer", Const: models.LatestProtocolVersion},
+			"id":       {Type: "string", Description: "chosen by the sender, error frames about the frame carry it as reply_to"},
+			"reply_to": {Type: "string"},
+			"type":     {Type: "string", Enum: types},
+			"send_to":  {Type: "string"},
+			"payload":  {Type: "object", Description: "validated against the schema of the type"},
+		},
+		Required:             []string{"id", "payload", "type", "version"},
+		AdditionalProperties: new(bool),
+	}
+}
+
+// validateSchemas checks the envelope and payload of frames of version 2 and
+// later against the published schemas, reporting every field that does not
+// conform, and hands them on as the handlers expect them. Version 1 frames are
+// only checked by their handlers.
+func validateSchemas(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(req *MessageRequest) (models.Message, error) {
+		message := req.Message
+		if message.Version < models.ProtocolV2 {
+			return next(req)
+		}
+
+		var errs []util.FieldError
+		if message.Version > models.LatestProtocolVersion {
+			errs = append(errs, util.FieldError{Field: "version", Message: "is not a supported protocol version"})
+		}
+		if message.Id == "" {
+			errs = append(errs, util.FieldError{Field: "id", Message: "is required"})
+		}
+		if message.Payload == nil {
+			errs = append(errs, util.FieldError{Field: "payload", Message: "is required"})
+		} else {
+			// codecs decode payloads to the plain types encoding/json does,
+			// which are the types the schema knows
+			errs = append(errs, req.handler.schema.Validate("payload", message.Payload)...)
+		}
+		if len(errs) > 0 {
+			return models.Message{}, util.NewAPIError(
+				http.StatusBadRequest,
+				util.CodeInvalidRequest,
+				message.Type+" does not match its schema",
+				errs...,
+			)
+		}
+
+		req.Message = message.FromProtocol()
+		return next(req)
+	}
+}
+
+// HandleGetProtocolSchemas publishes the envelope schema and the payload schema
+// of every message type.
+func HandleGetProtocolSchemas(w http.ResponseWriter, r *http.Request) {
+	messageRegistry.RLock()
+	messageTypes := make([]string, 0, len(messageRegistry.handlers))
+	payloads := make(map[string]*util.Schema, len(messageRegistry.handlers))
+	for messageType, handler := range messageRegistry.handlers {
+		messageTypes = append(messageTypes, messageType)
+		payloads[messageType] = handler.schema
+	}
+	messageRegistry.RUnlock()
+
+	sort.Strings(messageTypes)
+	util.WriteJSONData(w, http.StatusOK, map[string]interface{}{
+		"protocol_version": models.LatestProtocolVersion,
+		"envelope":         envelopeSchema(messageTypes),
+		"payloads":         payloads,
+	})
+}
+
+// HandleGetProtocolSchema publishes the payload schema of one message type.
+func HandleGetProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	messageType := mux.Vars(r)["message_type"]
+
+	messageRegistry.RLock()
+	handler := messageRegistry.handlers[messageType]
+	messageRegistry.RUnlock()
+
+	if handler == nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeUnknownMessageType, "unknown message type"))
+		return
+	}
+	util.WriteJSONData(w, http.StatusOK, handler.schema)
+}
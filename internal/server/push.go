@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/push"
+	"messaging-engine/internal/util"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// devices adapts the device collection to the push dispatcher.
+type devices struct{}
+
+func (devices) FindDevices(ctx context.Context, accountId string) ([]models.Device, error) {
+	return mongo.FindDevicesByAccountId(ctx, accountId)
+}
+
+func (devices) ForgetDevice(ctx context.Context, token string) error {
+	return mongo.DeleteDeviceByToken(ctx, token)
+}
+
+var pushDispatcher = push.NewDispatcher(devices{})
+
+// StartPushDispatcher configures the push providers and sends the queued
+// notifications. Native APNs and FCM providers are registered on
+// pushDispatcher; until then their devices go through the webhook.
+func StartPushDispatcher(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	cfg := config.Config.Push
+	if cfg.WebhookURL != "" {
+		pushDispatcher.Fallback = push.NewWebhookProvider(cfg.WebhookURL)
+	} else {
+		logrus.Warn("no push webhook_url configured, notifications to offline accounts are dropped")
+	}
+	if cfg.MaxAttempts > 0 {
+		pushDispatcher.MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BackoffMillis > 0 {
+		pushDispatcher.Backoff = time.Duration(cfg.BackoffMillis) * time.Millisecond
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = push.DefaultWorkers
+	}
+	pushDispatcher.Run(workers)
+}
+
+// needsPush tells whether accountId would miss a message written to its
+// connection, because it has none or its app is in the background.
+func needsPush(accountId string) bool {
+	client := ClientPool.GetTheClient(accountId)
+	return client == nil || client.Backgrounded()
+}
+
+// pushMessage notifies the recipients that need it of a new message, unless
+// their notification settings hold it back. scopeKey and scopeId collapse the
+// notifications of one channel or thread.
+func pushMessage(
+	ctx context.Context,
+	recipients []string,
+	reason models.NotificationReason,
+	channelId, threadId, messageId string,
+	content models.Content,
+) {
+	var pushed []string
+	for _, accountId := range recipients {
+		if needsPush(accountId) {
+			pushed = append(pushed, accountId)
+		}
+	}
+	if len(pushed) == 0 {
+		return
+	}
+
+	settings, err := mongo.FindNotificationSettingsOf(ctx, pushed)
+	if err != nil {
+		// pushing too much beats pushing nothing
+		logrus.Errorf("error pushing message %s: FindNotificationSettingsOf: %v", messageId, err)
+	}
+
+	scopeKey, scopeId, title := "channel_id", channelId, "New message"
+	if threadId != "" {
+		scopeKey, scopeId, title = "thread_id", threadId, "New reply"
+	}
+	switch reason {
+	case models.NotifyForMention:
+		title = "You were mentioned"
+	case models.NotifyForKeyword:
+		title = "Keyword alert"
+	}
+
+	now := time.Now().UTC()
+	for _, accountId := range pushed {
+		if !settings[accountId].Notifies(reason, channelId, threadId, now) {
+			continue
+		}
+
+		pushDispatcher.Notify(push.Notification{
+			AccountId:   accountId,
+			Title:       title,
+			Body:        content.Excerpt(),
+			CollapseKey: scopeKey + ":" + scopeId,
+			Data: map[string]string{
+				scopeKey:     scopeId,
+				"message_id": messageId,
+				"reason":     string(reason),
+			},
+			DateCreated: now,
+		})
+	}
+}
+
+func pushChannelMessage(ctx context.Context, recipients []string, reason models.NotificationReason, stored models.ChannelMessage) {
+	pushMessage(ctx, recipients, reason, stored.ChannelId.String(), "", stored.MessageId.String(), stored.Content)
+}
+
+func pushThreadMessage(ctx context.Context, recipients []string, reason models.NotificationReason, channelId string, stored models.ThreadMessage) {
+	pushMessage(ctx, recipients, reason, channelId, stored.ThreadId.String(), stored.MessageId.String(), stored.Content)
+}
+
+func HandleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	type got struct {
+		Token    string `json:"token"`
+		Platform string `json:"platform"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var fieldErrors []util.FieldError
+	if g.Token == "" {
+		fieldErrors = append(fieldErrors, util.FieldError{Field: "token", Message: "is required"})
+	}
+	if !models.IsDevicePlatform(g.Platform) {
+		fieldErrors = append(fieldErrors, util.FieldError{Field: "platform", Message: "must be apns, fcm or webhook"})
+	}
+	if len(fieldErrors) > 0 {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "invalid device", fieldErrors...))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device, err := mongo.RegisterDevice(ctx, models.Device{AccountId: accountId, Token: g.Token, Platform: g.Platform})
+	if err != nil {
+		logrus.Errorf("error db.RegisterDevice for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusCreated, device)
+}
+
+func HandleGetDevices(w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["account_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	foundDevices, err := mongo.FindDevicesByAccountId(ctx, accountId)
+	if err != nil {
+		logrus.Errorf("error db.FindDevicesByAccountId for AccountId: %s : %v", accountId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, foundDevices)
+}
+
+func HandleDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := mongo.DeleteDevice(ctx, vars["account_id"], vars["token"])
+	if errors.Is(err, mongo.ErrDeviceNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.DeleteDevice for AccountId: %s : %v", vars["account_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, map[string]string{"token": vars["token"]})
+}
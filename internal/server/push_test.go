@@ -0,0 +1,30 @@
+package server
+
+import (
+	"messaging-engine/internal/models"
+	"testing"
+)
+
+func TestNeedsPush(t *testing.T) {
+	ClientPool = models.NewClientPool()
+	foreground := &models.Client{ID: "foreground"}
+	background := &models.Client{ID: "background"}
+	background.SetBackgrounded(true)
+	ClientPool.Clients[foreground.ID] = foreground
+	ClientPool.Clients[background.ID] = background
+
+	for accountId, want := range map[string]bool{
+		"foreground": false,
+		"background": true,
+		"offline":    true,
+	} {
+		if got := needsPush(accountId); got != want {
+			t.Errorf("needsPush(%q) = %v, want %v", accountId, got, want)
+		}
+	}
+
+	foreground.SetBackgrounded(true)
+	if !needsPush("foreground") {
+		t.Error("a connection that went to the background is not pushed to")
+	}
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"messaging-engine/internal/config"
+	"messaging-engine/internal/util"
 	"net/http"
 	"strings"
 )
@@ -15,13 +17,15 @@ func NewRouter(authMiddleware AuthMiddleware) *mux.Router {
 	// CORS config
 	c := cors.New(cors.Options{
 		AllowedOrigins:   strings.Split(config.Config.AllowedOrigins, ","),
-		ExposedHeaders:   []string{config.Config.Auth.CsrfHeaderName},
+		ExposedHeaders:   []string{config.Config.Auth.CsrfHeaderName, util.RequestIdHeader},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodHead, http.MethodPut, http.MethodDelete},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 	})
 
 	r := mux.NewRouter().StrictSlash(true)
 	r.Use(c.Handler)
+	r.Use(requestIdMiddleware)
 
 	probingRoutes := []Route{
 		{
@@ -73,3 +77,17 @@ func NewRouter(authMiddleware AuthMiddleware) *mux.Router {
 
 	return r
 }
+
+// requestIdMiddleware tags every response with a request id, reusing the one
+// sent by the caller if any, so that error bodies can be matched to logs.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(util.RequestIdHeader)
+		if requestId == "" {
+			requestId = uuid.New().String()
+		}
+
+		w.Header().Set(util.RequestIdHeader, requestId)
+		next.ServeHTTP(w, r)
+	})
+}
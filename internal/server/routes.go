@@ -1,6 +1,7 @@
 package server
 
 import (
+	"messaging-engine/internal/auth"
 	"net/http"
 )
 
@@ -14,7 +15,197 @@ type Route struct {
 
 type Routes []Route
 
-var MessagingEngineProtectedRoutes = Routes{}
+// MessagingEngineProtectedRoutes are authenticated by the auth middleware.
+var MessagingEngineProtectedRoutes = Routes{
+	// server-side calls act for the system, with any sender and author
+	Route{
+		Name:        "send message to a client",
+		Method:      "POST",
+		Pattern:     "/client/send",
+		HandlerFunc: withRole(HandleSendMessageToClient, auth.RoleService),
+	},
+
+	// restored by the moderator the request is authenticated as
+	Route{
+		Name:        "restore a deleted channel message",
+		Method:      "POST",
+		Pattern:     "/channels/{channel_id}/messages/{message_id}/restore",
+		HandlerFunc: HandleRestoreChannelMessage,
+	},
+
+	Route{
+		Name:        "restore a deleted thread message",
+		Method:      "POST",
+		Pattern:     "/threads/{thread_id}/messages/{message_id}/restore",
+		HandlerFunc: HandleRestoreThreadMessage,
+	},
+
+	// ---------- state of an account, read by it or an admin ----------
+	Route{
+		Name:        "find unread thread replies of an account",
+		Method:      "GET",
+		Pattern:     "/accounts/{account_id}/thread-unreads",
+		HandlerFunc: accountOwner(HandleGetThreadUnreads),
+	},
+
+	Route{
+		Name:        "find threads an account participates in",
+		Method:      "GET",
+		Pattern:     "/accounts/{account_id}/threads",
+		HandlerFunc: accountOwner(HandleGetAccountThreads),
+	},
+
+	Route{
+		Name:        "find the mentions of an account",
+		Method:      "GET",
+		Pattern:     "/accounts/{account_id}/mentions",
+		HandlerFunc: accountOwner(HandleGetMentions),
+	},
+
+	// ---------- settings of an account, changed by it or an admin ----------
+	Route{
+		Name:        "register a push device of an account",
+		Method:      "POST",
+		Pattern:     "/accounts/{account_id}/devices",
+		HandlerFunc: accountOwner(HandleRegisterDevice),
+	},
+
+	Route{
+		Name:        "find the push devices of an account",
+		Method:      "GET",
+		Pattern:     "/accounts/{account_id}/devices",
+		HandlerFunc: accountOwner(HandleGetDevices),
+	},
+
+	Route{
+		Name:        "unregister a push device of an account",
+		Method:      "DELETE",
+		Pattern:     "/accounts/{account_id}/devices/{token}",
+		HandlerFunc: accountOwner(HandleDeleteDevice),
+	},
+
+	Route{
+		Name:        "find the notification settings of an account",
+		Method:      "GET",
+		Pattern:     "/accounts/{account_id}/notification-settings",
+		HandlerFunc: accountOwner(HandleGetNotificationSettings),
+	},
+
+	Route{
+		Name:        "replace the notification settings of an account",
+		Method:      "PUT",
+		Pattern:     "/accounts/{account_id}/notification-settings",
+		HandlerFunc: accountOwner(HandlePutNotificationSettings),
+	},
+
+	Route{
+		Name:        "set the notification level of a channel for an account",
+		Method:      "PUT",
+		Pattern:     "/accounts/{account_id}/notification-settings/channels/{channel_id}",
+		HandlerFunc: accountOwner(HandlePutChannelNotificationLevel),
+	},
+
+	Route{
+		Name:        "mute or unmute a thread for an account",
+		Method:      "PUT",
+		Pattern:     "/accounts/{account_id}/notification-settings/threads/{thread_id}",
+		HandlerFunc: accountOwner(HandlePutThreadMute),
+	},
+
+	// ---------- attachments, owned by the account uploading them ----------
+	Route{
+		Name:        "upload an attachment",
+		Method:      "POST",
+		Pattern:     "/attachments",
+		HandlerFunc: HandleUploadAttachment,
+	},
+
+	Route{
+		Name:        "start a resumable attachment upload",
+		Method:      "POST",
+		Pattern:     "/attachments/uploads",
+		HandlerFunc: HandleStartAttachmentUpload,
+	},
+
+	Route{
+		Name:        "upload a part of a resumable attachment upload",
+		Method:      "PUT",
+		Pattern:     "/attachments/{attachment_id}/parts/{part_number}",
+		HandlerFunc: HandleUploadAttachmentPart,
+	},
+
+	Route{
+		Name:        "complete a resumable attachment upload",
+		Method:      "POST",
+		Pattern:     "/attachments/{attachment_id}/complete",
+		HandlerFunc: HandleCompleteAttachmentUpload,
+	},
+
+	// signed for the owner and the clients of the channels it is posted in
+	Route{
+		Name:        "sign a download url for an attachment",
+		Method:      "GET",
+		Pattern:     "/attachments/{attachment_id}/download-url",
+		HandlerFunc: HandleGetAttachmentDownloadUrl,
+	},
+
+	// ---------- platform administration ----------
+	Route{
+		Name:        "subscribe a webhook to message events",
+		Method:      "POST",
+		Pattern:     "/webhooks",
+		HandlerFunc: withRole(HandleNewWebhook, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "list the webhook subscriptions",
+		Method:      "GET",
+		Pattern:     "/webhooks",
+		HandlerFunc: withRole(HandleGetWebhooks, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "delete a webhook subscription",
+		Method:      "DELETE",
+		Pattern:     "/webhooks/{webhook_id}",
+		HandlerFunc: withRole(HandleDeleteWebhook, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "find the delivery log of a webhook",
+		Method:      "GET",
+		Pattern:     "/webhooks/{webhook_id}/deliveries",
+		HandlerFunc: withRole(HandleGetWebhookDeliveries, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "replay every failed delivery of a webhook",
+		Method:      "POST",
+		Pattern:     "/webhooks/{webhook_id}/deliveries/replay",
+		HandlerFunc: withRole(HandleReplayWebhookDeliveries, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "replay a failed delivery of a webhook",
+		Method:      "POST",
+		Pattern:     "/webhooks/{webhook_id}/deliveries/{delivery_id}/replay",
+		HandlerFunc: withRole(HandleReplayWebhookDeliveries, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "register a custom emoji",
+		Method:      "POST",
+		Pattern:     "/emoji",
+		HandlerFunc: withRole(HandleNewCustomEmoji, auth.RoleAdmin),
+	},
+
+	Route{
+		Name:        "delete a custom emoji",
+		Method:      "DELETE",
+		Pattern:     "/emoji/{short_code}",
+		HandlerFunc: withRole(HandleDeleteCustomEmoji, auth.RoleAdmin),
+	},
+}
 
 var MessagingEngineOpenRoutes = Routes{
 	// ---------- probing ----------
@@ -30,6 +221,12 @@ var MessagingEngineOpenRoutes = Routes{
 			}
 		},
 	},
+	Route{
+		Name:        "message handler metrics",
+		Method:      "GET",
+		Pattern:     "/metrics/messages",
+		HandlerFunc: HandleGetMessageMetrics,
+	},
 
 	// ---------- messaging engine ----------
 
@@ -41,37 +238,86 @@ var MessagingEngineOpenRoutes = Routes{
 	},
 
 	Route{
-		Name:        "send message to a client",
-		Method:      "POST",
-		Pattern:     "/client/send",
-		HandlerFunc: HandleSendMessageToClient,
+		Name:        "protocol schemas",
+		Method:      "GET",
+		Pattern:     "/protocol/schemas",
+		HandlerFunc: HandleGetProtocolSchemas,
 	},
 
 	Route{
-		Name:        "find messages in a channel",
+		Name:        "protocol schema of a message type",
 		Method:      "GET",
-		Pattern:     "/messages/channel",
-		HandlerFunc: HandleGetChannelMessages,
+		Pattern:     "/protocol/schemas/{message_type}",
+		HandlerFunc: HandleGetProtocolSchema,
+	},
+
+	Route{
+		Name:        "initialise a new channel",
+		Method:      "POST",
+		Pattern:     "/channels",
+		HandlerFunc: HandleMakeNewChannel,
 	},
 
 	Route{
 		Name:        "find messages in a channel",
 		Method:      "GET",
-		Pattern:     "/messages/thread",
-		HandlerFunc: HandleGetThreadMessages,
+		Pattern:     "/channels/{channel_id}/messages",
+		HandlerFunc: HandleGetChannelMessages,
 	},
 
 	Route{
-		Name:        "initialise a new channel",
-		Method:      "POST",
-		Pattern:     "/channel/new",
-		HandlerFunc: HandleMakeNewChannel,
+		Name:        "find the edit history of a channel message",
+		Method:      "GET",
+		Pattern:     "/channels/{channel_id}/messages/{message_id}/revisions",
+		HandlerFunc: HandleGetChannelMessageRevisions,
 	},
 
 	Route{
 		Name:        "initialise a new thread",
 		Method:      "POST",
-		Pattern:     "/thread/new",
+		Pattern:     "/channels/{channel_id}/threads",
 		HandlerFunc: HandleMakeNewThread,
 	},
+
+	Route{
+		Name:        "find active threads in a channel",
+		Method:      "GET",
+		Pattern:     "/channels/{channel_id}/threads",
+		HandlerFunc: HandleGetChannelThreads,
+	},
+
+	Route{
+		Name:        "find messages in a thread",
+		Method:      "GET",
+		Pattern:     "/threads/{thread_id}/messages",
+		HandlerFunc: HandleGetThreadMessages,
+	},
+
+	Route{
+		Name:        "find the edit history of a thread message",
+		Method:      "GET",
+		Pattern:     "/threads/{thread_id}/messages/{message_id}/revisions",
+		HandlerFunc: HandleGetThreadMessageRevisions,
+	},
+
+	Route{
+		Name:        "list the custom emoji",
+		Method:      "GET",
+		Pattern:     "/emoji",
+		HandlerFunc: HandleGetCustomEmoji,
+	},
+
+	Route{
+		Name:        "find an attachment",
+		Method:      "GET",
+		Pattern:     "/attachments/{attachment_id}",
+		HandlerFunc: HandleGetAttachment,
+	},
+
+	Route{
+		Name:        "download an attachment through a signed url",
+		Method:      "GET",
+		Pattern:     "/attachments/{attachment_id}/content",
+		HandlerFunc: HandleDownloadAttachment,
+	},
 }
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"messaging-engine/internal/auth"
+	"messaging-engine/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// accountRoutes are read by their account or an admin only.
+var accountRoutes = []string{
+	"/accounts/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/threads",
+	"/accounts/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/thread-unreads",
+	"/accounts/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/mentions",
+}
+
+// uploadRoutes create attachments owned by the account of the request.
+var uploadRoutes = map[string]string{
+	"/attachments":         http.MethodPost,
+	"/attachments/uploads": http.MethodPost,
+	"/attachments/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/parts/1":  http.MethodPut,
+	"/attachments/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/complete": http.MethodPost,
+}
+
+func TestUploadRoutesRequireAnAccount(t *testing.T) {
+	secret := "routes test secret"
+	config.Config.Auth.AuthMiddlewareSecretKey = secret
+	t.Cleanup(func() { config.Config.Auth.AuthMiddlewareSecretKey = "" })
+	router := NewRouter(auth.Middleware)
+
+	service, err := auth.SignToken(auth.Identity{AccountId: "billing", Roles: []string{auth.RoleService}}, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, method := range uploadRoutes {
+		for token, want := range map[string]int{"": http.StatusUnauthorized, service: http.StatusForbidden} {
+			r := httptest.NewRequest(method, path, nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != want {
+				t.Errorf("%s %s with token %q answered %d, want %d", method, path, token, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestSigningDownloadUrlsRequiresAToken(t *testing.T) {
+	config.Config.Auth.AuthMiddlewareSecretKey = "routes test secret"
+	t.Cleanup(func() { config.Config.Auth.AuthMiddlewareSecretKey = "" })
+	router := NewRouter(auth.Middleware)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/attachments/0190a4c2-7b1e-7c3e-9a4d-2f0c1b9e8a11/download-url", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("signing a download url without a token answered %d", w.Code)
+	}
+}
+
+func TestAccountRoutesRequireTheirAccount(t *testing.T) {
+	secret := "routes test secret"
+	config.Config.Auth.AuthMiddlewareSecretKey = secret
+	t.Cleanup(func() { config.Config.Auth.AuthMiddlewareSecretKey = "" })
+	router := NewRouter(auth.Middleware)
+
+	other, err := auth.SignToken(auth.Identity{AccountId: "another-account"}, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range accountRoutes {
+		for token, want := range map[string]int{"": http.StatusUnauthorized, other: http.StatusForbidden} {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != want {
+				t.Errorf("GET %s with token %q answered %d, want %d", path, token, w.Code, want)
+			}
+		}
+	}
+}
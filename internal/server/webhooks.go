@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
+	"messaging-engine/internal/models"
+	"messaging-engine/internal/util"
+	"messaging-engine/internal/webhooks"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// webhookStore adapts the delivery collection to the webhook dispatcher.
+type webhookStore struct{}
+
+func (webhookStore) ClaimDueDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.WebhookDelivery, bool, error) {
+	return mongo.ClaimDueWebhookDelivery(ctx, now, lease)
+}
+
+func (webhookStore) FindSubscription(ctx context.Context, subscriptionId string) (models.WebhookSubscription, error) {
+	return mongo.FindWebhookSubscription(ctx, subscriptionId)
+}
+
+func (webhookStore) RecordAttempt(ctx context.Context, delivery models.WebhookDelivery) error {
+	return mongo.RecordWebhookDeliveryAttempt(ctx, delivery)
+}
+
+// StartWebhookDispatcher delivers the queued webhook events.
+func StartWebhookDispatcher(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	dispatcher := webhooks.NewDispatcher(webhookStore{})
+
+	cfg := config.Config.Webhooks
+	if cfg.MaxAttempts > 0 {
+		dispatcher.MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BackoffSeconds > 0 {
+		dispatcher.Backoff = time.Duration(cfg.BackoffSeconds) * time.Second
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = webhooks.DefaultWorkers
+	}
+	dispatcher.Run(workers)
+}
+
+// queueWebhookEvent queues an outbox event for the subscriptions selecting it.
+// The event keeps the outbox event's id and date, so queueing it again after a
+// failed publish adds nothing.
+func queueWebhookEvent(
+	ctx context.Context,
+	eventId uuid.UUID,
+	dateCreated time.Time,
+	eventType, scopeKey, scopeId string,
+	data map[string]interface{},
+) error {
+	subscriptions, err := mongo.FindWebhookSubscriptionsFor(ctx, eventType)
+	if err != nil || len(subscriptions) == 0 {
+		return err
+	}
+
+	// channel filters apply to thread replies through the thread's channel
+	data[scopeKey] = scopeId
+	channelId := scopeId
+	if scopeKey == "thread_id" {
+		thread, err := mongo.FindThreadById(ctx, scopeId)
+		if err != nil {
+			return err
+		}
+		channelId = thread.ChannelId
+		data["channel_id"] = channelId
+	}
+
+	var matching []models.WebhookSubscription
+	for _, subscription := range subscriptions {
+		if subscription.Matches(eventType, channelId) {
+			matching = append(matching, subscription)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+
+	event := models.WebhookEvent{
+		Id:          eventId,
+		Type:        eventType,
+		DateCreated: dateCreated,
+		Data:        data,
+	}
+
+	deliveries, err := models.NewWebhookDeliveries(event, matching)
+	if err != nil {
+		return err
+	}
+	return mongo.InsertWebhookDeliveries(ctx, deliveries)
+}
+
+func webhookNotFound(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, mongo.ErrWebhookNotFound) || errors.Is(err, mongo.ErrWebhookDeliveryNotFound) {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusNotFound, util.CodeNotFound, err.Error()))
+		return true
+	}
+	return false
+}
+
+func HandleNewWebhook(w http.ResponseWriter, r *http.Request) {
+	type got struct {
+		Url        string   `json:"url"`
+		Secret     string   `json:"secret"` // generated when empty
+		EventTypes []string `json:"event_types"`
+		ChannelIds []string `json:"channel_ids"`
+	}
+
+	var g got
+	err := util.DecodeJSONBody(w, r, &g)
+	if err != nil {
+		logrus.Errorf("error decoding JSON body when HandleNewWebhook, %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	var fieldErrors []util.FieldError
+	if u, err := url.Parse(g.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fieldErrors = append(fieldErrors, util.FieldError{Field: "url", Message: "must be an absolute http or https url"})
+	}
+	for i, eventType := range g.EventTypes {
+		if !models.IsWebhookEventType(eventType) {
+			fieldErrors = append(fieldErrors, util.FieldError{Field: fmt.Sprintf("event_types[%d]", i), Message: "unknown event type"})
+		}
+	}
+	for i, channelId := range g.ChannelIds {
+		if _, err := uuid.Parse(channelId); err != nil {
+			fieldErrors = append(fieldErrors, util.FieldError{Field: fmt.Sprintf("channel_ids[%d]", i), Message: "must be a uuid"})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, "invalid webhook", fieldErrors...))
+		return
+	}
+
+	if g.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			util.WriteJSONError(w, err)
+			return
+		}
+		g.Secret = hex.EncodeToString(secret)
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+	subscription := models.WebhookSubscription{
+		Id:          id,
+		Url:         g.Url,
+		Secret:      g.Secret,
+		EventTypes:  append([]string{}, g.EventTypes...),
+		ChannelIds:  append([]string{}, g.ChannelIds...),
+		DateCreated: time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = mongo.NewWebhookSubscription(ctx, subscription)
+	if err != nil {
+		logrus.Errorf("error db.NewWebhookSubscription for Url: %s : %v", g.Url, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	// the only time the secret is handed out
+	util.WriteJSONData(w, http.StatusCreated, subscription)
+}
+
+func HandleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	subscriptions, err := mongo.FindWebhookSubscriptions(ctx)
+	if err != nil {
+		logrus.Errorf("error db.FindWebhookSubscriptions: %v", err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	util.WriteJSONData(w, http.StatusOK, subscriptions)
+}
+
+func HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookId := mux.Vars(r)["webhook_id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := mongo.DeleteWebhookSubscription(ctx, webhookId)
+	if webhookNotFound(w, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.DeleteWebhookSubscription for WebhookId: %s : %v", webhookId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, map[string]string{"id": webhookId})
+}
+
+// HandleGetWebhookDeliveries returns the delivery log of a subscription,
+// optionally filtered by the status query param.
+func HandleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookId := mux.Vars(r)["webhook_id"]
+
+	limit, err := limitFromURL(r)
+	if err != nil {
+		util.WriteJSONError(w, util.NewAPIError(http.StatusBadRequest, util.CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	status := models.WebhookDeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", models.WebhookDeliveryPending, models.WebhookDeliverySucceeded, models.WebhookDeliveryFailed:
+	default:
+		util.WriteJSONError(w, util.NewAPIError(
+			http.StatusBadRequest,
+			util.CodeInvalidRequest,
+			"unknown delivery status",
+			util.FieldError{Field: "status", Message: "must be pending, succeeded or failed"},
+		))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = mongo.FindWebhookSubscription(ctx, webhookId)
+	if webhookNotFound(w, err) {
+		return
+	}
+	if err != nil {
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	deliveries, err := mongo.FindWebhookDeliveries(ctx, webhookId, status, limit)
+	if err != nil {
+		logrus.Errorf("error db.FindWebhookDeliveries for WebhookId: %s : %v", webhookId, err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, deliveries)
+}
+
+// HandleReplayWebhookDeliveries queues failed deliveries again, a single one
+// when the route names it and every failed one of the subscription otherwise.
+func HandleReplayWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	replayed, err := mongo.ReplayWebhookDeliveries(ctx, vars["webhook_id"], vars["delivery_id"])
+	if webhookNotFound(w, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("error db.ReplayWebhookDeliveries for WebhookId: %s : %v", vars["webhook_id"], err)
+		util.WriteJSONError(w, err)
+		return
+	}
+
+	util.WriteJSONData(w, http.StatusOK, map[string]int64{"replayed": replayed})
+}
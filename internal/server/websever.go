@@ -2,14 +2,14 @@ package server
 
 import (
 	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/auth"
 	"messaging-engine/internal/config"
 	"net/http"
 	"strconv"
 	"sync"
 )
 
-var authMiddleware AuthMiddleware
-var messagingEngineConfig config.MessagingEngineConfig
+var authMiddleware AuthMiddleware = auth.Middleware
 
 func StartMessagingEngine(wg *sync.WaitGroup) {
 	defer wg.Done() // Decrement the counter when the goroutine completes
@@ -17,10 +17,10 @@ func StartMessagingEngine(wg *sync.WaitGroup) {
 	r := NewRouter(authMiddleware)
 	http.Handle("/", r)
 
-	logrus.Infof("Starting messaging engine at %v", messagingEngineConfig.Port)
+	logrus.Infof("Starting messaging engine at %v", config.Config.Port)
 	logrus.Infof("Engine Id: %v", config.EngineId)
 
-	err := http.ListenAndServe(":"+strconv.Itoa(messagingEngineConfig.Port), nil)
+	err := http.ListenAndServe(":"+strconv.Itoa(config.Config.Port), nil)
 
 	if err != nil {
 		logrus.Errorf("error starting engine service: %v", err)
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"messaging-engine/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var s3Authorization = regexp.MustCompile(
+	`^AWS4-HMAC-SHA256 Credential=test-access-key/\d{8}/eu-west-1/s3/aws4_request, ` +
+		`SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`,
+)
+
+// s3StandIn keeps the objects of one bucket in memory, checking that requests
+// are path style and signed.
+type s3StandIn struct {
+	sync.Mutex
+	t       *testing.T
+	objects map[string][]byte
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s3Authorization.MatchString(r.Header.Get("Authorization")) {
+		s.t.Errorf("%s %s is not signed: %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if _, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date")); err != nil {
+		s.t.Errorf("%s %s has no X-Amz-Date: %v", r.Method, r.URL.Path, err)
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/attachments-bucket/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/attachments-bucket/")
+
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if int64(len(body)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = body
+	case http.MethodGet:
+		object, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestS3Backend(t *testing.T) (*S3Backend, *s3StandIn) {
+	standIn := &s3StandIn{t: t, objects: map[string][]byte{}}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	backend := NewS3Backend(config.S3Config{
+		Endpoint:        server.URL + "/",
+		Region:          "eu-west-1",
+		Bucket:          "attachments-bucket",
+		AccessKeyId:     "test-access-key",
+		SecretAccessKey: "test-secret-key",
+	})
+	return backend, standIn
+}
+
+func TestS3BackendStoresUploads(t *testing.T) {
+	ctx := context.Background()
+	backend, standIn := newTestS3Backend(t)
+	body := []byte("attachment body")
+
+	spooled, err := Spool(bytes.NewReader(body), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooled.Close()
+
+	key := "attachments/0190a4c2/original"
+	if err := backend.Put(ctx, key, spooled.File, spooled.Size); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(standIn.objects[key], body) {
+		t.Errorf("the bucket holds %q under %s, want %q", standIn.objects[key], key, body)
+	}
+
+	blob, err := backend.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(blob)
+	blob.Close()
+	if !bytes.Equal(stored, body) {
+		t.Errorf("got %q back, want %q", stored, body)
+	}
+
+	if err := backend.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("getting a deleted object gave %v, want ErrBlobNotFound", err)
+	}
+}
+
+func TestS3BackendReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>AccessDenied</Code></Error>")
+	}))
+	defer server.Close()
+
+	backend := NewS3Backend(config.S3Config{Endpoint: server.URL, Bucket: "attachments-bucket"})
+	err := backend.Put(context.Background(), "key", strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("a refused put gave %v, want the error of the store", err)
+	}
+	if backend.cfg.Region != "us-east-1" {
+		t.Errorf("the default region is %q, want us-east-1", backend.cfg.Region)
+	}
+}
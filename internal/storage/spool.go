@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+var ErrTooLarge = errors.New("attachment is too large")
+
+// Spooled is an upload staged in a temporary file, so that its size, checksum
+// and content type are known before it reaches the backend.
+type Spooled struct {
+	File        *os.File
+	Size        int64
+	Sha256      string // hex encoded
+	ContentType string // sniffed from the leading bytes, not taken from the client
+}
+
+// Spool copies r to a temporary file, failing with ErrTooLarge past maxBytes.
+// The caller must Close the result.
+func Spool(r io.Reader, maxBytes int64) (*Spooled, error) {
+	file, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %v", err)
+	}
+	spooled := &Spooled{File: file}
+
+	hash := sha256.New()
+	head := &headBuffer{}
+	spooled.Size, err = io.Copy(io.MultiWriter(file, hash, head), io.LimitReader(r, maxBytes+1))
+	if err == nil && spooled.Size > maxBytes {
+		err = ErrTooLarge
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+
+	spooled.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	spooled.ContentType = http.DetectContentType(head.b)
+	return spooled, nil
+}
+
+func (s *Spooled) Close() {
+	s.File.Close()
+	os.Remove(s.File.Name())
+}
+
+// headBuffer keeps the bytes http.DetectContentType looks at.
+type headBuffer struct {
+	b []byte
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := 512 - len(h.b); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.b = append(h.b, p[:room]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"messaging-engine/internal/config"
+	"strconv"
+	"time"
+)
+
+const DefaultLocalDir = "data/attachments"
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Backend keeps attachment bytes under keys chosen by the engine.
+type Backend interface {
+	// Put stores exactly size bytes of body under key, replacing any blob there.
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob, succeeding when there is none.
+	Delete(ctx context.Context, key string) error
+}
+
+var Blobs Backend
+
+var signingKey []byte
+
+// Open selects the configured backend, the local filesystem unless s3 is asked
+// for, and the key download urls are signed with.
+func Open(cfg config.AttachmentsConfig) error {
+	switch cfg.Backend {
+	case "", "local":
+		dir := cfg.LocalDir
+		if dir == "" {
+			dir = DefaultLocalDir
+		}
+		Blobs = LocalBackend{Root: dir}
+
+	case "s3":
+		Blobs = NewS3Backend(cfg.S3)
+
+	default:
+		return fmt.Errorf("unknown attachment backend %q", cfg.Backend)
+	}
+
+	if cfg.SigningKey != "" {
+		signingKey = []byte(cfg.SigningKey)
+		return nil
+	}
+
+	// urls signed by this process stop working when it restarts, and are
+	// refused by any other node, which config.Validate rules out
+	signingKey = make([]byte, 32)
+	_, err := rand.Read(signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return nil
+}
+
+// SignDownload returns the signature of a download of the blob under key that
+// is valid until expires.
+func SignDownload(key string, expires time.Time) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDownload checks a signature made by SignDownload and that it has not
+// expired.
+func VerifyDownload(key string, expires time.Time, signature string) bool {
+	if time.Now().After(expires) {
+		return false
+	}
+	return hmac.Equal([]byte(SignDownload(key, expires)), []byte(signature))
+}
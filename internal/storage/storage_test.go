@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"messaging-engine/internal/config"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func TestSpoolComputesChecksumAndContentType(t *testing.T) {
+	body := append(append([]byte{}, pngHeader...), bytes.Repeat([]byte{7}, 4096)...)
+
+	spooled, err := Spool(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooled.Close()
+
+	sum := sha256.Sum256(body)
+	if spooled.Sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum is %s, want %x", spooled.Sha256, sum)
+	}
+	if spooled.Size != int64(len(body)) {
+		t.Errorf("size is %d, want %d", spooled.Size, len(body))
+	}
+	if spooled.ContentType != "image/png" {
+		t.Errorf("content type is %q, want image/png", spooled.ContentType)
+	}
+
+	spooledBody, err := io.ReadAll(spooled.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spooledBody, body) {
+		t.Error("the spool file does not hold the body from its start")
+	}
+}
+
+func TestSpoolRejectsTooLargeBodies(t *testing.T) {
+	_, err := Spool(strings.NewReader("0123456789"), 9)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("spooling 10 bytes with a limit of 9 gave %v, want ErrTooLarge", err)
+	}
+
+	spooled, err := Spool(strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Fatalf("spooling 10 bytes with a limit of 10 gave %v", err)
+	}
+	spooled.Close()
+	if _, err := os.Stat(spooled.File.Name()); !os.IsNotExist(err) {
+		t.Errorf("the spool file is left behind after Close: %v", err)
+	}
+}
+
+func TestLocalBackendStoresUploads(t *testing.T) {
+	ctx := context.Background()
+	backend := LocalBackend{Root: t.TempDir()}
+	body := []byte("attachment body")
+
+	spooled, err := Spool(bytes.NewReader(body), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooled.Close()
+
+	key := "attachments/0190a4c2/original"
+	if err := backend.Put(ctx, key, spooled.File, spooled.Size); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := backend.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(stored)
+	if hex.EncodeToString(sum[:]) != spooled.Sha256 {
+		t.Errorf("stored blob %q does not match the checksum of the upload", stored)
+	}
+
+	if err := backend.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("getting a deleted blob gave %v, want ErrBlobNotFound", err)
+	}
+	if err := backend.Delete(ctx, key); err != nil {
+		t.Errorf("deleting a missing blob gave %v", err)
+	}
+}
+
+func TestLocalBackendRejectsShortBodies(t *testing.T) {
+	ctx := context.Background()
+	backend := LocalBackend{Root: t.TempDir()}
+
+	if err := backend.Put(ctx, "short", strings.NewReader("abc"), 4); err == nil {
+		t.Fatal("putting 3 bytes announced as 4 succeeded")
+	}
+	if _, err := backend.Get(ctx, "short"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("a failed put left a blob behind: %v", err)
+	}
+}
+
+func TestLocalBackendRejectsKeysOutsideRoot(t *testing.T) {
+	backend := LocalBackend{Root: t.TempDir()}
+	for _, key := range []string{"", "../escape", "a/../../escape"} {
+		if err := backend.Put(context.Background(), key, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("putting under %q succeeded", key)
+		}
+	}
+}
+
+func TestSignedDownloads(t *testing.T) {
+	if err := Open(config.AttachmentsConfig{LocalDir: t.TempDir(), SigningKey: "test signing key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// urls carry the expiry in unix seconds
+	expires := time.Unix(time.Now().Add(time.Minute).Unix(), 0)
+	signature := SignDownload("attachments/a/original", expires)
+
+	if !VerifyDownload("attachments/a/original", expires, signature) {
+		t.Error("a valid signature was rejected")
+	}
+	if VerifyDownload("attachments/b/original", expires, signature) {
+		t.Error("the signature of a blob was accepted for another one")
+	}
+	if VerifyDownload("attachments/a/original", expires.Add(time.Hour), signature) {
+		t.Error("the signature was accepted with a later expiry")
+	}
+
+	expired := time.Unix(time.Now().Add(-time.Minute).Unix(), 0)
+	if VerifyDownload("attachments/a/original", expired, SignDownload("attachments/a/original", expired)) {
+		t.Error("an expired signature was accepted")
+	}
+
+	if err := Open(config.AttachmentsConfig{LocalDir: t.TempDir(), SigningKey: "another key"}); err != nil {
+		t.Fatal(err)
+	}
+	if VerifyDownload("attachments/a/original", expires, signature) {
+		t.Error("a signature was accepted under another signing key")
+	}
+}
+
+func TestOpenSelectsBackend(t *testing.T) {
+	if err := Open(config.AttachmentsConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if local, ok := Blobs.(LocalBackend); !ok || local.Root != DefaultLocalDir {
+		t.Errorf("the default backend is %#v, want a LocalBackend under %s", Blobs, DefaultLocalDir)
+	}
+	if len(signingKey) != 32 {
+		t.Errorf("the generated signing key has %d bytes, want 32", len(signingKey))
+	}
+
+	if err := Open(config.AttachmentsConfig{Backend: "s3"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Blobs.(*S3Backend); !ok {
+		t.Errorf("the s3 backend is %#v", Blobs)
+	}
+
+	if err := Open(config.AttachmentsConfig{Backend: "ftp"}); err == nil {
+		t.Error("an unknown backend was accepted")
+	}
+}
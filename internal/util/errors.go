@@ -0,0 +1,116 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// RequestIdHeader carries the id correlating a response with server logs.
+const RequestIdHeader = "X-Request-Id"
+
+// machine-readable error codes
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeRequestTooLarge      = "request_too_large"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeRateLimited          = "rate_limited"
+	CodeUnknownMessageType   = "unknown_message_type"
+	CodeInternal             = "internal_error"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is the single error model returned by HTTP handlers and carried by
+// WebSocket error frames.
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestId string       `json:"request_id,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func NewAPIError(status int, code, message string, details ...FieldError) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+		Details: details,
+	}
+}
+
+// AsAPIError converts any error into an APIError. Errors that are neither an
+// APIError nor a malformed request are reported as internal errors without
+// leaking their message.
+func AsAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var mr *malformedRequest
+	if errors.As(err, &mr) {
+		apiErr = NewAPIError(mr.status, codeForStatus(mr.status), mr.msg)
+		if mr.field != "" {
+			apiErr.Details = []FieldError{{Field: mr.field, Message: mr.msg}}
+		}
+		return apiErr
+	}
+
+	return NewAPIError(http.StatusInternalServerError, CodeInternal, "internal error")
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusInternalServerError:
+		return CodeInternal
+	default:
+		return CodeInvalidRequest
+	}
+}
+
+// WriteJSONError writes err in the {"error": ...} envelope, tagged with the
+// request id assigned to the response.
+func WriteJSONError(w http.ResponseWriter, err error) {
+	type envelope struct {
+		Error *APIError `json:"error"`
+	}
+
+	apiErr := *AsAPIError(err)
+	apiErr.RequestId = w.Header().Get(RequestIdHeader)
+
+	body, err := json.Marshal(envelope{Error: &apiErr})
+	if err != nil {
+		logrus.Errorf("error json.Marshal api error %v", err)
+		body = []byte(`{"error":{"code":"` + CodeInternal + `","message":"internal error"}}`)
+	}
+
+	WriteJSONResponse(w, apiErr.Status, body)
+}
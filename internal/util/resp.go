@@ -1,6 +1,7 @@
 package util
 
 import (
+	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
@@ -18,3 +19,20 @@ func WriteJSONResponse(w http.ResponseWriter, status int, data []byte) {
 		return
 	}
 }
+
+// WriteJSONData writes data wrapped in the {"data": ...} envelope shared by
+// all resource responses.
+func WriteJSONData(w http.ResponseWriter, status int, data interface{}) {
+	type envelope struct {
+		Data interface{} `json:"data"`
+	}
+
+	body, err := json.Marshal(envelope{Data: data})
+	if err != nil {
+		logrus.Errorf("error json.Marshal response data %v", err)
+		WriteJSONError(w, err)
+		return
+	}
+
+	WriteJSONResponse(w, status, body)
+}
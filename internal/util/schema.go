@@ -0,0 +1,227 @@
+package util
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaDialect is the JSON Schema draft published schemas are written in.
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema that SchemaOf generates and Validate
+// enforces.
+type Schema struct {
+	Dialect              string             `json:"$schema,omitempty"`
+	Id                   string             `json:"$id,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// SchemaProvider is implemented by types that are decoded from something else
+// than their fields, and describe what they accept themselves.
+type SchemaProvider interface {
+	JSONSchema() *Schema
+}
+
+var (
+	uuidType           = reflect.TypeOf(uuid.UUID{})
+	timeType           = reflect.TypeOf(time.Time{})
+	schemaProviderType = reflect.TypeOf((*SchemaProvider)(nil)).Elem()
+)
+
+// SchemaOf describes the JSON that decodes into t. Struct fields are named by
+// their mapstructure tag, as payloads are decoded with it, and closed to other
+// properties. A schema tag marks a field "required", and may give it a
+// "format=uuid" or restrict it to "enum=a|b".
+func SchemaOf(t reflect.Type) *Schema {
+	if t.Implements(schemaProviderType) {
+		return reflect.Zero(t).Interface().(SchemaProvider).JSONSchema()
+	}
+
+	switch t {
+	case uuidType:
+		return &Schema{Type: "string", Format: "uuid"}
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return SchemaOf(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: SchemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: new(bool)}
+		addFieldSchemas(schema, t)
+		sort.Strings(schema.Required)
+		return schema
+	}
+	return &Schema{}
+}
+
+func addFieldSchemas(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && options == "squash" {
+			addFieldSchemas(schema, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		property := SchemaOf(field.Type)
+		for _, option := range strings.Split(field.Tag.Get("schema"), ",") {
+			switch {
+			case option == "required":
+				schema.Required = append(schema.Required, name)
+			case strings.HasPrefix(option, "format="):
+				property.Format = strings.TrimPrefix(option, "format=")
+			case strings.HasPrefix(option, "enum="):
+				for _, value := range strings.Split(strings.TrimPrefix(option, "enum="), "|") {
+					property.Enum = append(property.Enum, value)
+				}
+			}
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// Validate checks a decoded JSON value against the schema, and returns an
+// error for every field that does not conform, named by its path under at.
+func (s *Schema) Validate(at string, value interface{}) []FieldError {
+	if s.Const != nil && !reflect.DeepEqual(value, s.Const) {
+		return []FieldError{{Field: at, Message: fmt.Sprintf("must be %v", s.Const)}}
+	}
+
+	if len(s.OneOf) > 0 {
+		for _, option := range s.OneOf {
+			if len(option.Validate(at, value)) == 0 {
+				return nil
+			}
+		}
+		return []FieldError{{Field: at, Message: "does not match any of the accepted forms"}}
+	}
+
+	if s.Type != "" && !hasSchemaType(value, s.Type) {
+		return []FieldError{{Field: at, Message: "must be " + withArticle(s.Type)}}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			found = found || reflect.DeepEqual(value, allowed)
+		}
+		if !found {
+			return []FieldError{{Field: at, Message: fmt.Sprintf("must be one of %v", s.Enum)}}
+		}
+	}
+
+	switch s.Format {
+	case "uuid":
+		if _, err := uuid.Parse(value.(string)); err != nil {
+			return []FieldError{{Field: at, Message: "must be a uuid"}}
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value.(string)); err != nil {
+			return []FieldError{{Field: at, Message: "must be an RFC 3339 date-time"}}
+		}
+	}
+
+	var errs []FieldError
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				errs = append(errs, FieldError{Field: joinPath(at, name), Message: "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			switch {
+			case ok:
+				errs = append(errs, property.Validate(joinPath(at, name), value[name])...)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				errs = append(errs, FieldError{Field: joinPath(at, name), Message: "is not a known field"})
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				errs = append(errs, s.Items.Validate(fmt.Sprintf("%s[%d]", at, i), item)...)
+			}
+		}
+	}
+	return errs
+}
+
+// hasSchemaType tells whether a value decoded by encoding/json is of a JSON
+// Schema type. null is only accepted where the type is not constrained.
+func hasSchemaType(value interface{}, schemaType string) bool {
+	switch value := value.(type) {
+	case bool:
+		return schemaType == "boolean"
+	case float64:
+		return schemaType == "number" || schemaType == "integer" && value == math.Trunc(value)
+	case string:
+		return schemaType == "string"
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+	return false
+}
+
+func withArticle(schemaType string) string {
+	if schemaType == "array" || schemaType == "object" || schemaType == "integer" {
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+func joinPath(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
@@ -13,6 +13,7 @@ import (
 type malformedRequest struct {
 	status int
 	msg    string
+	field  string // the offending field, when known
 }
 
 func (mr *malformedRequest) Error() string {
@@ -56,12 +57,12 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 				unmarshalTypeError.Field,
 				unmarshalTypeError.Offset,
 			)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
+			return &malformedRequest{status: http.StatusBadRequest, msg: msg, field: unmarshalTypeError.Field}
 
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			msg := fmt.Sprintf("Request body contains unknown field %s", fieldName)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
+			return &malformedRequest{status: http.StatusBadRequest, msg: msg, field: strings.Trim(fieldName, `"`)}
 
 		case errors.Is(err, io.EOF):
 			msg := "Request body must not be empty"
@@ -84,11 +85,3 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 
 	return nil
 }
-
-func FormatChannelCollectionName(ChannelId string) string {
-	return "channel_" + ChannelId
-}
-
-func FormatThreadCollectionName(threadId string) string {
-	return "thread_" + threadId
-}
@@ -0,0 +1,160 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"messaging-engine/internal/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers      = 4
+	DefaultMaxAttempts  = 8
+	DefaultBackoff      = 10 * time.Second
+	DefaultPollInterval = time.Second
+
+	maxBackoff   = time.Hour
+	sendTimeout  = 30 * time.Second
+	claimLease   = 2 * sendTimeout // a claimed delivery is retried after this if its worker dies
+	maxErrorBody = 512
+)
+
+// Store is the durable queue of deliveries.
+type Store interface {
+	// ClaimDueDelivery leases the pending delivery due the earliest, if any is
+	// due at now, by pushing its next attempt lease into the future.
+	ClaimDueDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.WebhookDelivery, bool, error)
+	FindSubscription(ctx context.Context, subscriptionId string) (models.WebhookSubscription, error)
+	// RecordAttempt saves the status, attempts and last attempt of a delivery.
+	RecordAttempt(ctx context.Context, delivery models.WebhookDelivery) error
+}
+
+// Dispatcher works through the queued deliveries, retrying failed ones with
+// exponential backoff until MaxAttempts is reached.
+type Dispatcher struct {
+	Store        Store
+	Client       *http.Client
+	MaxAttempts  int
+	Backoff      time.Duration // before the first retry, doubled for every next one up to an hour
+	PollInterval time.Duration // how long an idle worker waits before looking again
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		Store:        store,
+		Client:       &http.Client{Timeout: sendTimeout},
+		MaxAttempts:  DefaultMaxAttempts,
+		Backoff:      DefaultBackoff,
+		PollInterval: DefaultPollInterval,
+	}
+}
+
+// Run delivers with the given number of workers. It never returns.
+func (d *Dispatcher) Run(workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if !d.DeliverNext() {
+					time.Sleep(d.PollInterval)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// DeliverNext makes one attempt at the next due delivery and tells whether
+// there was one.
+func (d *Dispatcher) DeliverNext() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), claimLease)
+	defer cancel()
+
+	delivery, ok, err := d.Store.ClaimDueDelivery(ctx, time.Now().UTC(), claimLease)
+	if err != nil {
+		logrus.Errorf("failed to claim webhook delivery: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var statusCode int
+	subscription, err := d.Store.FindSubscription(ctx, delivery.SubscriptionId.String())
+	if err == nil {
+		statusCode, err = Send(ctx, d.Client, subscription, delivery, time.Now())
+	}
+
+	delivery = d.outcome(delivery, statusCode, err, time.Now().UTC())
+	if err := d.Store.RecordAttempt(ctx, delivery); err != nil {
+		logrus.Errorf("failed to record webhook delivery %s: %v", delivery.Id, err)
+	}
+	return true
+}
+
+// outcome updates a delivery with the result of an attempt at now.
+func (d *Dispatcher) outcome(delivery models.WebhookDelivery, statusCode int, err error, now time.Time) models.WebhookDelivery {
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+
+	switch {
+	case err == nil:
+		delivery.Status = models.WebhookDeliverySucceeded
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = models.WebhookDeliveryFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.Status = models.WebhookDeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	}
+	return delivery
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.Backoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// Send posts a delivery to its subscription, signed at now, and returns the
+// status code received. Anything but a 2xx answer is an error.
+func Send(ctx context.Context, client *http.Client, subscription models.WebhookSubscription, delivery models.WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(subscription.Secret, now, body))
+	req.Header.Set(EventIdHeader, delivery.EventId.String())
+	req.Header.Set(EventTypeHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.Id.String())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, fmt.Errorf("webhook answered %s: %s", resp.Status, answer)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,253 @@
+package webhooks
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"io"
+	"messaging-engine/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+// memStore queues deliveries in memory. skew moves its clock forward, so
+// retries come due without waiting for their backoff.
+type memStore struct {
+	sync.Mutex
+	subscription models.WebhookSubscription
+	deliveries   []models.WebhookDelivery
+	skew         time.Duration
+}
+
+func (s *memStore) ClaimDueDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.WebhookDelivery, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	due := -1
+	for i, delivery := range s.deliveries {
+		if delivery.Status != models.WebhookDeliveryPending || delivery.NextAttemptAt.After(now.Add(s.skew)) {
+			continue
+		}
+		if due < 0 || delivery.NextAttemptAt.Before(s.deliveries[due].NextAttemptAt) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return models.WebhookDelivery{}, false, nil
+	}
+	s.deliveries[due].NextAttemptAt = now.Add(lease)
+	return s.deliveries[due], true, nil
+}
+
+func (s *memStore) FindSubscription(ctx context.Context, subscriptionId string) (models.WebhookSubscription, error) {
+	return s.subscription, nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, delivery models.WebhookDelivery) error {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.deliveries {
+		if s.deliveries[i].Id == delivery.Id {
+			s.deliveries[i] = delivery
+		}
+	}
+	return nil
+}
+
+// replay does what mongo.ReplayWebhookDeliveries does to failed deliveries.
+func (s *memStore) replay() {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.deliveries {
+		if s.deliveries[i].Status == models.WebhookDeliveryFailed {
+			s.deliveries[i].Status = models.WebhookDeliveryPending
+			s.deliveries[i].Attempts = 0
+			s.deliveries[i].NextAttemptAt = time.Now().UTC()
+		}
+	}
+}
+
+func (s *memStore) delivery() models.WebhookDelivery {
+	s.Lock()
+	defer s.Unlock()
+	return s.deliveries[0]
+}
+
+type receivedDelivery struct {
+	body       string
+	eventId    string
+	deliveryId string
+}
+
+// receiver is a webhook endpoint answering with the status codes of answers
+// in turn, the last one for good. It fails the test on bad signatures.
+type receiver struct {
+	sync.Mutex
+	t        *testing.T
+	answers  []int
+	received []receivedDelivery
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := Verify(testSecret, r.Header.Get(SignatureHeader), body, 5*time.Minute, time.Now()); err != nil {
+		rc.t.Errorf("delivery %s: %v", r.Header.Get(DeliveryHeader), err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+	rc.received = append(rc.received, receivedDelivery{
+		body:       string(body),
+		eventId:    r.Header.Get(EventIdHeader),
+		deliveryId: r.Header.Get(DeliveryHeader),
+	})
+	w.WriteHeader(rc.answers[0])
+	if len(rc.answers) > 1 {
+		rc.answers = rc.answers[1:]
+	}
+}
+
+func (rc *receiver) answer(statuses ...int) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.answers = statuses
+}
+
+func newTestDispatcher(t *testing.T, answers ...int) (*Dispatcher, *memStore, *receiver) {
+	rc := &receiver{t: t, answers: answers}
+	server := httptest.NewServer(rc)
+	t.Cleanup(server.Close)
+
+	event := models.WebhookEvent{
+		Id:          uuid.New(),
+		Type:        models.WebhookMessageCreated,
+		DateCreated: time.Now().UTC(),
+		Data:        map[string]interface{}{"message_id": uuid.NewString()},
+	}
+	subscription := models.WebhookSubscription{Id: uuid.New(), Url: server.URL, Secret: testSecret}
+	deliveries, err := models.NewWebhookDeliveries(event, []models.WebhookSubscription{subscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memStore{subscription: subscription, deliveries: deliveries}
+	dispatcher := NewDispatcher(store)
+	dispatcher.Client = server.Client()
+	dispatcher.Backoff = time.Minute
+	return dispatcher, store, rc
+}
+
+func TestDispatcherSignsDeliveries(t *testing.T) {
+	dispatcher, store, rc := newTestDispatcher(t, http.StatusNoContent)
+	queued := store.delivery()
+
+	if !dispatcher.DeliverNext() {
+		t.Fatal("no delivery was due")
+	}
+
+	if len(rc.received) != 1 {
+		t.Fatalf("received %d deliveries, want 1", len(rc.received))
+	}
+	got := rc.received[0]
+	if got.body != queued.Body || got.eventId != queued.EventId.String() || got.deliveryId != queued.Id.String() {
+		t.Errorf("received %+v, want the body and ids of %+v", got, queued)
+	}
+
+	delivery := store.delivery()
+	if delivery.Status != models.WebhookDeliverySucceeded || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusNoContent {
+		t.Errorf("delivery is %s after %d attempts with %d, want succeeded after 1 with 204",
+			delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+	}
+	if dispatcher.DeliverNext() {
+		t.Error("a succeeded delivery was sent again")
+	}
+}
+
+func TestDispatcherRetriesWithBackoff(t *testing.T) {
+	dispatcher, store, rc := newTestDispatcher(t, http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK)
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if !dispatcher.DeliverNext() {
+			t.Fatalf("attempt %d was not due", attempt+1)
+		}
+		delivery := store.delivery()
+		if delivery.Status != models.WebhookDeliveryPending || delivery.Attempts != attempt+1 {
+			t.Fatalf("delivery is %s after %d attempts, want pending after %d", delivery.Status, delivery.Attempts, attempt+1)
+		}
+		if got := delivery.NextAttemptAt.Sub(*delivery.LastAttemptAt); got != backoff {
+			t.Errorf("attempt %d is retried after %v, want %v", attempt+1, got, backoff)
+		}
+		if !strings.Contains(delivery.LastError, "webhook answered") {
+			t.Errorf("last error is %q", delivery.LastError)
+		}
+
+		if dispatcher.DeliverNext() {
+			t.Fatalf("attempt %d was retried before its backoff", attempt+1)
+		}
+		store.skew += backoff
+	}
+
+	if !dispatcher.DeliverNext() {
+		t.Fatal("the last attempt was not due")
+	}
+	if delivery := store.delivery(); delivery.Status != models.WebhookDeliverySucceeded || delivery.Attempts != 3 {
+		t.Errorf("delivery is %s after %d attempts, want succeeded after 3", delivery.Status, delivery.Attempts)
+	}
+	if len(rc.received) != 3 {
+		t.Errorf("received %d deliveries, want 3", len(rc.received))
+	}
+}
+
+func TestDispatcherBackoffIsCapped(t *testing.T) {
+	dispatcher := NewDispatcher(nil)
+	if got := dispatcher.backoff(1); got != DefaultBackoff {
+		t.Errorf("first backoff is %v, want %v", got, DefaultBackoff)
+	}
+	if got := dispatcher.backoff(30); got != maxBackoff {
+		t.Errorf("backoff after 30 attempts is %v, want %v", got, maxBackoff)
+	}
+}
+
+func TestDispatcherReplaysFailedDeliveries(t *testing.T) {
+	dispatcher, store, rc := newTestDispatcher(t, http.StatusInternalServerError)
+	dispatcher.MaxAttempts = 2
+
+	for i := 0; i < dispatcher.MaxAttempts; i++ {
+		if !dispatcher.DeliverNext() {
+			t.Fatalf("attempt %d was not due", i+1)
+		}
+		store.skew += dispatcher.Backoff
+	}
+	failed := store.delivery()
+	if failed.Status != models.WebhookDeliveryFailed || failed.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("delivery is %s with %d, want failed with 500", failed.Status, failed.LastStatusCode)
+	}
+	if dispatcher.DeliverNext() {
+		t.Fatal("a failed delivery was retried without being replayed")
+	}
+
+	rc.answer(http.StatusOK)
+	store.replay()
+	if !dispatcher.DeliverNext() {
+		t.Fatal("the replayed delivery was not due")
+	}
+
+	replayed := store.delivery()
+	if replayed.Status != models.WebhookDeliverySucceeded || replayed.Attempts != 1 || replayed.LastError != "" {
+		t.Errorf("replayed delivery is %s after %d attempts with %q, want succeeded after 1",
+			replayed.Status, replayed.Attempts, replayed.LastError)
+	}
+	if len(rc.received) != 3 {
+		t.Fatalf("received %d deliveries, want 3", len(rc.received))
+	}
+	if rc.received[2] != rc.received[0] {
+		t.Errorf("replay sent %+v, want the original %+v", rc.received[2], rc.received[0])
+	}
+}
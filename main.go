@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
+	"messaging-engine/internal/config"
+	"messaging-engine/internal/db/mongo"
 	"messaging-engine/internal/models"
 	"messaging-engine/internal/server"
+	"messaging-engine/internal/storage"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
+	_ "time/tzdata" // quiet hours need time zones the runtime image lacks
 )
 
 func main() {
@@ -15,8 +21,24 @@ func main() {
 		logrus.Info("Captured Ctrl+C")
 	})
 
+	err := config.Load()
+	if err != nil {
+		logrus.Fatalf("error loading config: %v", err)
+	}
+	err = config.Config.Validate()
+	if err != nil {
+		logrus.Fatalf("invalid config: %v", err)
+	}
+
+	connectMongo()
+
+	err = storage.Open(config.Config.Attachments)
+	if err != nil {
+		logrus.Fatalf("error opening attachment storage: %v", err)
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(9)
 
 	// initialise ClientPool
 	ClientPool := models.NewClientPool()
@@ -27,9 +49,46 @@ func main() {
 	// start messaging-engine as a service
 	go server.StartMessagingEngine(&wg)
 
+	// hard-delete soft deleted messages past their grace period
+	go server.StartTombstonePurger(&wg)
+
+	// strip image metadata and make thumbnails off the request path
+	go server.StartAttachmentProcessor(&wg)
+
+	// push notifications to accounts that are offline or in the background
+	go server.StartPushDispatcher(&wg)
+
+	// deliver message lifecycle events to webhook subscribers
+	go server.StartWebhookDispatcher(&wg)
+
+	// publish committed state changes to the bus and webhooks
+	go server.StartOutboxRelay(&wg)
+
+	// deliver the bus messages of this node's connections
+	go server.StartBusSubscriber(&wg)
+
+	// fan out messages written by other services, when enabled
+	go server.StartChangeStreamFanOut(&wg)
+
 	wg.Wait() // Wait for all the goroutines to finish
 }
 
+func connectMongo() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := mongo.Connect(ctx, config.Config.Mongo.Uri)
+	if err != nil {
+		logrus.Fatalf("error connecting to mongo: %v", err)
+	}
+
+	// idempotent, a failure leaves queries slower but working
+	err = mongo.EnsureIndexes(ctx)
+	if err != nil {
+		logrus.Errorf("error ensuring mongo indexes: %v", err)
+	}
+}
+
 func handleSigterm(handleExit func()) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
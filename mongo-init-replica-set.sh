@@ -0,0 +1,16 @@
+#!/bin/bash
+# Starts mongod through the image's entrypoint, which creates the root user on
+# first start, and initiates the replica set once it accepts connections.
+set -e
+
+docker-entrypoint.sh mongod -f /etc/mongod.conf &
+mongod_pid=$!
+
+until mongosh --quiet \
+	-u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin \
+	--eval "try { rs.status().ok } catch (e) { rs.initiate({_id: 'rs0', members: [{_id: 0, host: '${MONGO_REPLICA_SET_HOST}'}]}).ok }" \
+	| grep -q 1; do
+	sleep 1
+done
+
+wait $mongod_pid